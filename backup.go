@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/noahmern/terara/pkg/storage"
+)
+
+// terara backup -data dir -db name [-since n] [-out file]
+//
+// writes a backup of a database to a file or stdout and prints the -since
+// of the next incremental backup
+func backupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	data := flags.String("data", "data", "data directory")
+	key := keyFlags(flags)
+	name := flags.String("db", "", "database to back up")
+	since := flags.Uint64("since", 0, "only back up the changes after this version, printed by the previous backup")
+	out := flags.String("out", "-", "backup file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-db is required")
+	}
+	registry, err := key.openRegistry(*data)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+	db, err := registry.Get(*name)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	next, err := db.Backup(w, *since)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "next incremental backup: -since %d\n", next)
+	return nil
+}
+
+// terara restore -data dir -db name [-in file]
+//
+// restores a backup, the database is created if it doesn't exist.
+// incremental backups are restored one after the other in order
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	data := flags.String("data", "data", "data directory")
+	key := keyFlags(flags)
+	name := flags.String("db", "", "database to restore into")
+	in := flags.String("in", "-", "backup file, - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-db is required")
+	}
+	registry, err := key.openRegistry(*data)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+	db, err := registry.Get(*name)
+	if err == storage.ErrDatabaseNotFound {
+		db, err = registry.Create(*name)
+	}
+	if err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return db.Restore(r)
+}
+
+// terara recover -data dir -db name -backup file -log dir [-version n | -time t]
+//
+// restores a full backup into a new database and rolls it forward with the
+// change log of the original database, up to a commit or a time
+func recoverCommand(args []string) error {
+	flags := flag.NewFlagSet("recover", flag.ContinueOnError)
+	data := flags.String("data", "data", "data directory")
+	key := keyFlags(flags)
+	name := flags.String("db", "", "new database to recover into")
+	backup := flags.String("backup", "", "full backup to start from")
+	logDir := flags.String("log", "", "change log directory of the original database")
+	version := flags.Uint64("version", 0, "last commit to replay")
+	at := flags.String("time", "", "replay the commits made until this RFC 3339 time")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *backup == "" || *logDir == "" {
+		return errors.New("-db, -backup and -log are required")
+	}
+	target := storage.RecoveryTarget{Version: *version}
+	if *at != "" {
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return err
+		}
+		target.Time = t
+	}
+	registry, err := key.openRegistry(*data)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+	db, err := registry.Create(*name)
+	if err != nil {
+		return err
+	}
+	last, err := recoverDatabase(db, *backup, *logDir, target)
+	if err != nil {
+		// don't leave a half recovered database behind
+		registry.Drop(*name)
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "recovered up to version %d\n", last)
+	return nil
+}
+
+func recoverDatabase(db *storage.Database, backup, logDir string, target storage.RecoveryTarget) (uint64, error) {
+	f, err := os.Open(backup)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := db.Restore(f); err != nil {
+		return 0, err
+	}
+	return db.Replay(logDir, target)
+}
@@ -2,9 +2,10 @@ module github.com/noahmern/terara
 
 go 1.21.0
 
+require github.com/dgraph-io/badger/v4 v4.2.0
+
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
-	github.com/dgraph-io/badger/v4 v4.2.0 // indirect
 	github.com/dgraph-io/ristretto v0.1.1 // indirect
 	github.com/dustin/go-humanize v1.0.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
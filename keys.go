@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/noahmern/terara/pkg/storage"
+)
+
+// where a command reads the master key of encrypted databases from
+type keySource struct {
+	file *string
+	env  *string
+}
+
+func keyFlags(flags *flag.FlagSet) keySource {
+	return keySource{
+		file: flags.String("key-file", "", "file with the encryption key, in hex, base64 or raw"),
+		env:  flags.String("key-env", "", "environment variable with the encryption key, in hex or base64"),
+	}
+}
+
+func (k keySource) load() ([]byte, error) {
+	return storage.LoadEncryptionKey(*k.file, *k.env)
+}
+
+func (k keySource) openRegistry(data string) (*storage.Registry, error) {
+	key, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	opts := storage.DefaultOptions()
+	opts.EncryptionKey = key
+	return storage.NewRegistryWithOptions(data, opts)
+}
+
+// terara rotate-key -data dir -db name -key-file old -new-key-file new
+//
+// encrypts the data keys of a database with a new master key, the
+// database must not be in use by another process
+func rotateKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	data := flags.String("data", "data", "data directory")
+	name := flags.String("db", "", "database to rotate the key of")
+	oldKey := keyFlags(flags)
+	newKey := keySource{
+		file: flags.String("new-key-file", "", "file with the new encryption key"),
+		env:  flags.String("new-key-env", "", "environment variable with the new encryption key"),
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" {
+		return errors.New("-db is required")
+	}
+	old, err := oldKey.load()
+	if err != nil {
+		return err
+	}
+	key, err := newKey.load()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return errors.New("-new-key-file or -new-key-env is required")
+	}
+	registry, err := storage.NewRegistry(*data)
+	if err != nil {
+		return err
+	}
+	defer registry.Close()
+	if err := registry.RotateKey(*name, old, key); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "key rotated, open "+*name+" with the new key from now on")
+	return nil
+}
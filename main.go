@@ -1,11 +1,38 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
+	"github.com/noahmern/terara/pkg/engine"
 	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/storage"
 )
 
+// subcommands, without one the lexer demo runs
+var commands = map[string]func(args []string) error{
+	"backup":     backupCommand,
+	"restore":    restoreCommand,
+	"recover":    recoverCommand,
+	"rotate-key": rotateKeyCommand,
+}
+
 func main() {
-	l := lexer.NewLexer(`
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "terara "+os.Args[1]+": "+err.Error())
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	lexDemo()
+}
+
+// the demo script, the first collection namespace is misspelled on
+// purpose so the check has something to report
+const demoScript = `
 	param($from_id,$to_id,$amount);
 	use(ice);
 	let balance = colletion::transfers.filter(id = $from_id).select('amount').sum();
@@ -15,7 +42,10 @@ func main() {
 		{'id': uuid(),
 			'timestamp': now()})
 	));
-	`)
+	`
+
+func lexDemo() {
+	l := lexer.NewLexer(demoScript)
 	for {
 		token, err := l.NextToken()
 		if err != nil {
@@ -26,4 +56,31 @@ func main() {
 		}
 		println(token.String() + ": " + token.Value)
 	}
+	checkDemo()
+}
+
+// checkDemo prints what Check finds in the demo script, it runs against
+// an empty database of its own
+func checkDemo() {
+	dir, err := os.MkdirTemp("", "terara-demo")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, err := storage.NewRegistry(dir)
+	if err != nil {
+		panic(err)
+	}
+	defer registry.Close()
+	// the database and collection the script uses
+	db, err := registry.Create("ice")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := db.CreateCollection("transfers"); err != nil {
+		panic(err)
+	}
+	if err := engine.NewEngine(registry).NewSession().Check(demoScript); err != nil {
+		println("check: " + err.Error())
+	}
 }
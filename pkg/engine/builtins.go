@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// Builtin is a function callable from scripts, it gets the arguments
+// unevaluated so it can treat bare names like use(ice) specially
+type Builtin func(sc *scope, args []parser.Expr) (types.Object, error)
+
+// Method is called on the value on the left of the dot
+type Method func(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error)
+
+var builtins map[string]Builtin
+
+var methods map[string]Method
+
+// the tables are assigned in init because the functions refer back to the evaluator
+func init() {
+	builtins = map[string]Builtin{
+		"use":     builtinUse,
+		"param":   builtinParam,
+		"version": builtinVersion,
+		"watch":   builtinWatch,
+		"email":   builtinEmail,
+		"phone":   builtinPhone,
+		"ref":     builtinRef,
+		"deref":   builtinDeref,
+		"explain": builtinExplain,
+		"analyze": builtinAnalyze,
+	}
+	methods = map[string]Method{
+		"insert_many": methodInsertMany,
+		"update":      methodUpdate,
+		"upsert":      methodUpsert,
+		"as_of":       methodAsOf,
+		"filter":      methodFilter,
+		"get":         methodGet,
+		"history":     methodHistory,
+		"join":        methodJoin,
+		"left_join":   methodLeftJoin,
+		"lookup":      methodLookup,
+		"group_by":    methodGroupBy,
+		"aggregate":   methodAggregate,
+		"having":      methodHaving,
+		"order_by":    methodOrderBy,
+		"limit":       methodLimit,
+		"skip":        methodSkip,
+		"select":      methodSelect,
+	}
+	for fn := range aggregateFuncs {
+		methods[fn] = aggregateMethod(fn)
+	}
+}
+
+// use(name) selects the database the rest of the script runs against,
+// the name can be a bare identifier or a string
+func builtinUse(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("use expects 1 argument, got %d", len(args))
+	}
+	var name string
+	switch arg := args[0].(type) {
+	case *parser.Ident:
+		name = arg.Name
+	default:
+		value, err := sc.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		if value.Type() != types.StringType {
+			return nil, fmt.Errorf("use expects a database name, got %s", value.String())
+		}
+		name = value.String()
+	}
+	if err := sc.session.Use(name); err != nil {
+		return nil, err
+	}
+	return types.String(name), nil
+}
+
+// param($a, $b: int64, ...) declares the parameters the script needs,
+// with an optional type, and fails early if any of them was not given or
+// has another type
+func builtinParam(sc *scope, args []parser.Expr) (types.Object, error) {
+	for _, arg := range args {
+		param, ok := arg.(*parser.Param)
+		if !ok {
+			return nil, fmt.Errorf("param expects parameters like $name, got %s", arg.String())
+		}
+		value, ok := sc.params[param.Name]
+		if !ok {
+			return nil, errorfAt(param, "missing parameter $%s", param.Name)
+		}
+		if err := checkParam(param, value); err != nil {
+			return nil, err
+		}
+	}
+	return types.Null{}, nil
+}
+
+// email('a@example.com') makes an email value out of a string, it fails if
+// the string is not an address
+func builtinEmail(sc *scope, args []parser.Expr) (types.Object, error) {
+	s, err := stringArg(sc, "email", args)
+	if err != nil {
+		return nil, err
+	}
+	return types.NewEmail(s)
+}
+
+// phone('+1 555 0100') makes a phone value out of a string
+func builtinPhone(sc *scope, args []parser.Expr) (types.Object, error) {
+	s, err := stringArg(sc, "phone", args)
+	if err != nil {
+		return nil, err
+	}
+	return types.NewPhone(s)
+}
+
+// stringArg evaluates the single string argument of a builtin
+func stringArg(sc *scope, name string, args []parser.Expr) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s expects 1 argument, got %d", name, len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return "", err
+	}
+	if value.Type() != types.StringType {
+		return "", fmt.Errorf("%s expects a string, got %s", name, typeName(value))
+	}
+	return value.String(), nil
+}
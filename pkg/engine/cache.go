@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/noahmern/terara/pkg/parser"
+)
+
+// programCache keeps the compiled programs of the latest scripts, by the
+// hash of their source
+type programCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	// most recently used first
+	lru *list.List
+}
+
+type cachedProgram struct {
+	key  [sha256.Size]byte
+	src  string
+	prog *program
+}
+
+func newProgramCache(size int) *programCache {
+	return &programCache{
+		size:    size,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// compile returns the program of src, it is parsed and compiled only if
+// it isn't in the cache
+func (c *programCache) compile(src string) (*program, error) {
+	key := sha256.Sum256([]byte(src))
+	if prog := c.get(key, src); prog != nil {
+		return prog, nil
+	}
+	ast, err := parser.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	prog := newProgram(ast)
+	c.put(key, src, prog)
+	return prog, nil
+}
+
+func (c *programCache) get(key [sha256.Size]byte, src string) *program {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok || elem.Value.(*cachedProgram).src != src {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedProgram).prog
+}
+
+func (c *programCache) put(key [sha256.Size]byte, src string, prog *program) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cachedProgram{key: key, src: src, prog: prog}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cachedProgram{key: key, src: src, prog: prog})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedProgram).key)
+	}
+}
@@ -0,0 +1,731 @@
+package engine
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// static types the checker uses besides the types of values
+const (
+	// nothing is known of the value
+	anyType = types.LastType + 1 + iota
+	// a number of any of the numeric types
+	numberType
+)
+
+// vtype is what the checker knows of the values of an expression
+type vtype struct {
+	t byte
+	// for a collection or a query, the types of the fields of its rows,
+	// nil when they are not known
+	fields map[string]vtype
+	// the query ends with a group_by, aggregates add to the groups and
+	// see the fields of the rows that were grouped
+	grouped bool
+	source  map[string]vtype
+}
+
+var anyValue = vtype{t: anyType}
+
+func (v vtype) known() bool {
+	return v.t != anyType
+}
+
+func (v vtype) numeric() bool {
+	return v.t == numberType || types.IsNumeric(v.t)
+}
+
+// staticName is the name of a type in the messages of the checker
+func staticName(t byte) string {
+	switch t {
+	case anyType:
+		return "any"
+	case numberType:
+		return "number"
+	}
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "type " + strconv.Itoa(int(t))
+}
+
+// sample returns a value of type t to try the operators on, ok is false
+// for the types the checker doesn't try
+func sample(t byte) (types.Object, bool) {
+	switch t {
+	case types.NullType:
+		return types.Null{}, true
+	case types.BoolType:
+		return types.Bool(true), true
+	case types.Int64Type, numberType:
+		return types.Int64(1), true
+	case types.Int32Type:
+		return types.Int32(1), true
+	case types.FloatType:
+		return types.Float(1), true
+	case types.StringType:
+		return types.String("a"), true
+	case types.CharType:
+		return types.Char('a'), true
+	case types.EmailType:
+		return types.Email("a@example.com"), true
+	case types.PhoneType:
+		return types.Phone("+1 555 0100"), true
+	case types.ArrayType:
+		return types.Array{}, true
+	case types.DocumentType:
+		return newDocument(), true
+	}
+	return nil, false
+}
+
+// the number of arguments of the builtins, at least and at most
+var builtinArgs = map[string][2]int{
+	"use":     {1, 1},
+	"version": {0, 0},
+	"watch":   {1, 2},
+	"email":   {1, 1},
+	"phone":   {1, 1},
+	"ref":     {2, 2},
+	"deref":   {1, 1},
+	"explain": {1, 1},
+	"analyze": {1, 1},
+}
+
+// aggregates that only take numbers
+var numericAggregates = map[string]bool{
+	"sum":        true,
+	"avg":        true,
+	"median":     true,
+	"percentile": true,
+}
+
+// checker infers the types of the expressions of a script without
+// running it, from the literals, the declared types of the parameters and
+// the types analyze found in the fields of the collections, or a sample
+// of their documents. it reports
+// what would fail or can't be what was meant, like comparing a string
+// with a number, and leaves unchecked what it doesn't know
+type checker struct {
+	session *Session
+	db      *storage.Database
+	params  map[string]vtype
+	vars    map[string]vtype
+	errs    []error
+}
+
+// Check finds the errors of a script that don't depend on the data, like
+// a misspelled collection or comparing a string with a number, without
+// running it. the collections are looked up in the selected database or
+// the one the script uses. the types of their fields come from analyze,
+// or from the first documents when it never ran, a field or a type the
+// sample doesn't have goes unchecked
+func (s *Session) Check(src string) error {
+	prog, err := s.engine.programs.compile(src)
+	if err != nil {
+		return err
+	}
+	_, err = s.check(prog.ast)
+	return err
+}
+
+// check checks a script and returns the parameters it declares
+func (s *Session) check(ast *parser.Program) ([]*parser.Param, error) {
+	decls, err := declaredParams(ast)
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{
+		session: s,
+		db:      s.db,
+		params:  make(map[string]vtype),
+		vars:    make(map[string]vtype),
+	}
+	for _, decl := range decls {
+		c.params[decl.Name] = declaredType(decl.Type)
+	}
+	for _, stmt := range ast.Statements {
+		switch stmt := stmt.(type) {
+		case *parser.LetStmt:
+			c.vars[stmt.Name] = c.expr(stmt.Value, nil)
+		case *parser.ExprStmt:
+			c.expr(stmt.Expr, nil)
+		}
+	}
+	return decls, errors.Join(c.errs...)
+}
+
+// declaredType is the static type of a parameter declared with name
+func declaredType(name string) vtype {
+	switch name {
+	case "number", "money":
+		return vtype{t: numberType}
+	}
+	for t, typeName := range typeNames {
+		if typeName == name {
+			return vtype{t: t}
+		}
+	}
+	return anyValue
+}
+
+func (c *checker) errorf(node parser.Node, format string, args ...interface{}) {
+	c.errs = append(c.errs, errorfAt(node, format, args...))
+}
+
+// expr returns the type of e, the fields of the rows of row are visible
+// as bare names when it is not nil
+func (c *checker) expr(e parser.Expr, row *vtype) vtype {
+	switch e := e.(type) {
+	case *parser.NumberLit, *parser.StringLit, *parser.BoolLit, *parser.NullLit:
+		if value, ok := fold(e); ok {
+			return vtype{t: value.Type()}
+		}
+	case *parser.Param:
+		if t, ok := c.params[e.Name]; ok {
+			return t
+		}
+	case *parser.Ident:
+		return c.ident(e, row)
+	case *parser.Path:
+		return c.path(e)
+	case *parser.Call:
+		return c.call(e, row)
+	case *parser.MethodCall:
+		return c.method(e, e.Name, c.expr(e.Recv, row), e.Args, row)
+	case *parser.Pipe:
+		return c.pipe(e, row)
+	case *parser.Member:
+		recv := c.expr(e.Recv, row)
+		if recv.known() && recv.t != types.DocumentType {
+			c.errorf(e, "cannot get field %s of %s", e.Name, staticName(recv.t))
+		}
+	case *parser.Index:
+		c.expr(e.Recv, row)
+		c.expr(e.Index, row)
+	case *parser.Unary:
+		return c.unary(e, c.expr(e.Operand, row))
+	case *parser.Binary:
+		return c.binary(e, row)
+	case *parser.Postfix:
+		c.errorf(e, "%s can only be used in update(...)", e.String())
+	case *parser.Order:
+		c.errorf(e, "%s can only be used in order_by(...)", e.String())
+	case *parser.ArrayLit:
+		for _, element := range e.Elements {
+			c.expr(element, row)
+		}
+		return vtype{t: types.ArrayType}
+	case *parser.ObjectLit:
+		for _, field := range e.Fields {
+			c.expr(field.Value, row)
+		}
+		return vtype{t: types.DocumentType}
+	}
+	return anyValue
+}
+
+// ident is like scope.lookup, the fields of the row come before the
+// variables
+func (c *checker) ident(e *parser.Ident, row *vtype) vtype {
+	if row != nil {
+		if t, ok := row.fields[e.Name]; ok {
+			return t
+		}
+	}
+	if t, ok := c.vars[e.Name]; ok {
+		return t
+	}
+	if row == nil {
+		c.errorf(e, "undefined variable %s", e.Name)
+	}
+	return anyValue
+}
+
+func (c *checker) path(e *parser.Path) vtype {
+	if e.Namespace != "collection" {
+		c.errorf(e, "unknown namespace %s%s", e.Namespace, suggest(e.Namespace, []string{"collection"}))
+		return anyValue
+	}
+	if c.db == nil {
+		return vtype{t: types.CollectionType}
+	}
+	coll, err := c.db.Collection(e.Name)
+	if err != nil {
+		c.errorf(e, "%s: %v%s", e.String(), err, suggest(e.Name, c.db.Collections()))
+		return vtype{t: types.CollectionType}
+	}
+	return vtype{t: types.CollectionType, fields: fieldTypes(coll)}
+}
+
+// fieldTypes returns the types of the top level fields of the documents
+// of coll, a field that had values of different types is any. they come
+// from analyze, or from a sample of the documents when coll was never
+// analyzed, nil if it can't be read
+func fieldTypes(coll *storage.Collection) map[string]vtype {
+	var fields map[string]*storage.FieldStats
+	if stats := coll.Stats(); stats != nil {
+		fields = stats.Fields
+	} else if fields = sampleFields(coll); fields == nil {
+		return nil
+	}
+	result := make(map[string]vtype, len(fields))
+	for name, field := range fields {
+		result[name] = fieldType(field)
+	}
+	return result
+}
+
+func fieldType(field *storage.FieldStats) vtype {
+	t := anyValue
+	for typ := range field.Types {
+		switch {
+		case typ == types.NullType:
+		case !t.known():
+			t = vtype{t: typ}
+		case t.numeric() && types.IsNumeric(typ):
+			t = vtype{t: numberType}
+		default:
+			return anyValue
+		}
+	}
+	return t
+}
+
+// how many documents are read for the types of a collection that was
+// never analyzed
+const checkSample = 100
+
+// sampleFields counts the types of the top level fields of the first
+// documents of coll like analyze does, a field they don't have is not
+// known. encrypted fields are left out
+func sampleFields(coll *storage.Collection) map[string]*storage.FieldStats {
+	it, err := coll.Scan(storage.ScanOptions{Limit: checkSample})
+	if err != nil {
+		return nil
+	}
+	defer it.Close()
+	encrypted := make(map[string]bool)
+	for _, field := range coll.EncryptedFields() {
+		encrypted[field.Field] = true
+	}
+	fields := make(map[string]*storage.FieldStats)
+	for it.Next() {
+		doc := it.Document()
+		for _, key := range doc.Keys() {
+			if encrypted[string(key)] {
+				continue
+			}
+			value, _ := doc.Get(key)
+			if value == nil {
+				continue
+			}
+			field, ok := fields[string(key)]
+			if !ok {
+				field = &storage.FieldStats{Types: make(map[byte]int64)}
+				fields[string(key)] = field
+			}
+			field.Count++
+			field.Types[value.Type()]++
+		}
+	}
+	if it.Err() != nil {
+		return nil
+	}
+	return fields
+}
+
+// suggest returns ", did you mean x?" with the one of names closest to
+// name if it is close enough to be a typo
+func suggest(name string, names []string) string {
+	best, distance := "", len(name)/3+1
+	for _, other := range names {
+		if d := editDistance(name, other); d < distance {
+			best, distance = other, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return ", did you mean " + best + "?"
+}
+
+// editDistance is the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func (c *checker) unary(e *parser.Unary, operand vtype) vtype {
+	value, ok := sample(operand.t)
+	if !ok {
+		return anyValue
+	}
+	result, err := unaryOp(e, value)
+	if err != nil {
+		c.errorf(e, "cannot negate %s", staticName(operand.t))
+		return anyValue
+	}
+	return resultType(result)
+}
+
+func (c *checker) binary(e *parser.Binary, row *vtype) vtype {
+	left, right := c.expr(e.Left, row), c.expr(e.Right, row)
+	switch e.Op {
+	case lexer.TokenAnd, lexer.TokenOr:
+		return vtype{t: types.BoolType}
+	}
+	l, lok := sample(left.t)
+	r, rok := sample(right.t)
+	if !lok || !rok {
+		return anyValue
+	}
+	switch e.Op {
+	case lexer.TokenEqual, lexer.TokenNotEqual:
+		// anything can be compared with null, a missing field is null
+		if left.t != types.NullType && right.t != types.NullType && !types.Comparable(l, r) {
+			c.errorf(e, "comparing %s with %s is always %t", staticName(left.t), staticName(right.t), e.Op == lexer.TokenNotEqual)
+		}
+		return vtype{t: types.BoolType}
+	}
+	result, err := binaryOp(e.Op, l, r)
+	if err != nil {
+		if _, ok := flipped[e.Op]; ok {
+			c.errorf(e, "cannot compare %s with %s", staticName(left.t), staticName(right.t))
+		} else {
+			c.errorf(e, "invalid operands %s and %s for %s", staticName(left.t), staticName(right.t), lexer.TokenName(e.Op))
+		}
+		return anyValue
+	}
+	return resultType(result)
+}
+
+// resultType is the type of the result of an operator on sample values,
+// the type of the number depends on the values
+func resultType(result types.Object) vtype {
+	if types.IsNumeric(result.Type()) {
+		return vtype{t: numberType}
+	}
+	return vtype{t: result.Type()}
+}
+
+// args checks arguments and returns their types
+func (c *checker) args(args []parser.Expr, row *vtype) []vtype {
+	ts := make([]vtype, len(args))
+	for i, arg := range args {
+		ts[i] = c.expr(arg, row)
+	}
+	return ts
+}
+
+func (c *checker) call(e *parser.Call, row *vtype) vtype {
+	ident, ok := e.Func.(*parser.Ident)
+	if !ok {
+		c.errorf(e, "%s is not a function", e.Func.String())
+		return anyValue
+	}
+	name := ident.Name
+	if _, ok := builtins[name]; !ok {
+		if _, ok := c.session.engine.function(name); !ok {
+			c.errorf(e, "unknown function %s", name)
+		}
+		c.args(e.Args, row)
+		return anyValue
+	}
+	if n, ok := builtinArgs[name]; ok && (len(e.Args) < n[0] || len(e.Args) > n[1]) {
+		c.errorf(e, "%s", argCount(name, n, len(e.Args)))
+		return anyValue
+	}
+	switch name {
+	case "param":
+		return vtype{t: types.NullType}
+	case "use":
+		c.use(e.Args[0])
+		return vtype{t: types.StringType}
+	case "version":
+		return vtype{t: types.Int64Type}
+	case "ref":
+		c.args(e.Args, row)
+		return vtype{t: types.ReferenceType}
+	case "email", "phone":
+		if arg := c.expr(e.Args[0], row); arg.known() && arg.t != types.StringType {
+			c.errorf(e, "%s expects a string, got %s", name, staticName(arg.t))
+		}
+		if name == "email" {
+			return vtype{t: types.EmailType}
+		}
+		return vtype{t: types.PhoneType}
+	case "explain":
+		if arg := c.expr(e.Args[0], row); arg.known() && arg.t != types.CollectionType {
+			c.errorf(e.Args[0], "explain expects a query, got %s", staticName(arg.t))
+		}
+		return vtype{t: types.StringType}
+	case "analyze":
+		if arg := c.expr(e.Args[0], row); arg.known() && arg.t != types.CollectionType {
+			c.errorf(e.Args[0], "analyze expects a collection, got %s", staticName(arg.t))
+		}
+		return vtype{t: types.DocumentType}
+	}
+	c.args(e.Args, row)
+	return anyValue
+}
+
+func argCount(name string, n [2]int, got int) string {
+	switch {
+	case n[1] == 0:
+		return name + " expects no arguments, got " + strconv.Itoa(got)
+	case n[0] == n[1] && n[0] == 1:
+		return name + " expects 1 argument, got " + strconv.Itoa(got)
+	case n[0] == n[1]:
+		return name + " expects " + strconv.Itoa(n[0]) + " arguments, got " + strconv.Itoa(got)
+	}
+	return name + " expects " + strconv.Itoa(n[0]) + " or " + strconv.Itoa(n[1]) + " arguments, got " + strconv.Itoa(got)
+}
+
+// use selects the database the collections after it are looked up in
+func (c *checker) use(arg parser.Expr) {
+	var name string
+	switch arg := arg.(type) {
+	case *parser.Ident:
+		name = arg.Name
+	case *parser.StringLit:
+		name = arg.Value
+	default:
+		// the database is only known when it runs
+		c.expr(arg, nil)
+		c.db = nil
+		return
+	}
+	registry := c.session.engine.registry
+	if !registry.Exists(name) {
+		names, _ := registry.Names()
+		c.errorf(arg, "use(%s): %v%s", name, storage.ErrDatabaseNotFound, suggest(name, names))
+		c.db = nil
+		return
+	}
+	db, err := registry.Get(name)
+	if err != nil {
+		c.db = nil
+		return
+	}
+	c.db = db
+}
+
+func (c *checker) pipe(e *parser.Pipe, row *vtype) vtype {
+	value := c.expr(e.Value, row)
+	var name string
+	var args []parser.Expr
+	switch call := e.Call.(type) {
+	case *parser.Call:
+		name, args = call.Func.(*parser.Ident).Name, call.Args
+	case *parser.Ident:
+		name = call.Name
+	}
+	if _, ok := methods[name]; ok {
+		return c.method(e.Call, name, value, args, row)
+	}
+	if _, ok := builtins[name]; !ok {
+		if _, ok := c.session.engine.function(name); !ok {
+			c.errorf(e.Call, "unknown function %s", name)
+		}
+	}
+	c.args(args, row)
+	return anyValue
+}
+
+// method checks a method called on a value of type recv
+func (c *checker) method(node parser.Node, name string, recv vtype, args []parser.Expr, row *vtype) vtype {
+	if _, ok := methods[name]; !ok {
+		c.errorf(node, "unknown method %s", name)
+		c.args(args, row)
+		return anyValue
+	}
+	if recv.known() && recv.t != types.CollectionType {
+		c.errorf(node, "%s can only be called on a collection, got %s", name, staticName(recv.t))
+		return anyValue
+	}
+	if _, ok := aggregateFuncs[name]; ok {
+		result := c.aggregate(node, name, args, recv)
+		if recv.grouped {
+			return recv
+		}
+		return result
+	}
+	rows := vtype{t: types.DocumentType, fields: recv.fields}
+	query := vtype{t: types.CollectionType}
+	switch name {
+	case "filter":
+		c.args(args, &rows)
+		return recv
+	case "order_by":
+		for _, arg := range args {
+			if order, ok := arg.(*parser.Order); ok {
+				arg = order.Expr
+			}
+			c.expr(arg, &rows)
+		}
+		return recv
+	case "select":
+		return selectFields(recv, args)
+	case "limit", "skip":
+		for _, arg := range c.args(args, row) {
+			if arg.known() && !arg.numeric() {
+				c.errorf(node, "%s expects a count, got %s", name, staticName(arg.t))
+			}
+		}
+		return recv
+	case "as_of":
+		c.args(args, row)
+		return recv
+	case "get":
+		c.args(args, row)
+		return anyValue
+	case "history":
+		c.args(args, row)
+		return vtype{t: types.ArrayType}
+	case "group_by":
+		c.args(args, &rows)
+		query.grouped, query.source = true, recv.fields
+		return query
+	case "having":
+		c.args(args, &vtype{t: types.DocumentType})
+		return recv
+	case "aggregate":
+		return c.aggregates(node, recv, args)
+	case "join", "left_join", "lookup":
+		// the conditions name the rows after their collections
+		if len(args) > 0 {
+			c.expr(args[0], row)
+		}
+		return query
+	}
+	// the changes of update and upsert are not expressions of the rows
+	return anyValue
+}
+
+// selectFields narrows the fields of the rows to the ones selected
+func selectFields(recv vtype, args []parser.Expr) vtype {
+	if recv.fields == nil {
+		return recv
+	}
+	fields := make(map[string]vtype, len(args))
+	for _, arg := range args {
+		field, ok := rowField(arg)
+		if !ok {
+			return recv
+		}
+		root, rest, nested := strings.Cut(field, ".")
+		if t, ok := recv.fields[root]; ok && !nested {
+			fields[root] = t
+		} else if rest != "" || !ok {
+			fields[root] = anyValue
+		}
+	}
+	recv.fields = fields
+	return recv
+}
+
+// rowField returns the field a row expression names, like newRowExpr
+func rowField(expr parser.Expr) (string, bool) {
+	if lit, ok := expr.(*parser.StringLit); ok {
+		return lit.Value, true
+	}
+	return fieldPath(expr)
+}
+
+// aggregates checks x.aggregate({'name': fn(...), ...})
+func (c *checker) aggregates(node parser.Node, recv vtype, args []parser.Expr) vtype {
+	if len(args) != 1 {
+		c.errorf(node, "aggregate expects 1 argument, got %d", len(args))
+		return anyValue
+	}
+	obj, ok := args[0].(*parser.ObjectLit)
+	if !ok {
+		return anyValue
+	}
+	for _, field := range obj.Fields {
+		call, ok := field.Value.(*parser.Call)
+		var fn *parser.Ident
+		if ok {
+			fn, ok = call.Func.(*parser.Ident)
+		}
+		if ok {
+			_, ok = aggregateFuncs[fn.Name]
+		}
+		if !ok {
+			c.errorf(field.Value, "%s is not an aggregate function", field.Value.String())
+			continue
+		}
+		c.aggregate(call, fn.Name, call.Args, recv)
+	}
+	if recv.grouped {
+		return recv
+	}
+	return vtype{t: types.DocumentType}
+}
+
+// aggregate checks fn(args) over the rows of recv and returns the type of
+// its result
+func (c *checker) aggregate(node parser.Node, fn string, args []parser.Expr, recv vtype) vtype {
+	if recv.grouped {
+		recv.fields = recv.source
+	}
+	rows := vtype{t: types.DocumentType, fields: recv.fields}
+	value := anyValue
+	what := ""
+	switch {
+	case len(args) > 0:
+		if field, ok := rowField(args[0]); ok {
+			what = "field " + field
+			if t, ok := recv.fields[field]; ok {
+				value = t
+			}
+		} else {
+			what = args[0].String()
+			value = c.expr(args[0], &rows)
+		}
+		if len(args) > 1 {
+			c.args(args[1:], nil)
+		}
+	case len(recv.fields) == 1:
+		// fn() takes the only field of the rows
+		for field, t := range recv.fields {
+			what, value = "field "+field, t
+		}
+	}
+	if numericAggregates[fn] && value.known() && !value.numeric() && value.t != types.NullType {
+		c.errorf(node, "%s() needs numbers, %s is %s", fn, what, staticName(value.t))
+	}
+	switch fn {
+	case "count", "count_distinct":
+		return vtype{t: types.Int64Type}
+	case "sum":
+		return vtype{t: numberType}
+	case "avg", "median", "percentile":
+		return vtype{t: types.FloatType}
+	case "collect":
+		return vtype{t: types.ArrayType}
+	}
+	return value
+}
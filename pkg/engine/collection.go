@@ -0,0 +1,377 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// sameValue reports if a and b are the same value of the same type,
+// documents are compared field by field whatever the order of their keys
+func sameValue(a, b types.Object) bool {
+	if a.Type() != b.Type() {
+		return false
+	}
+	switch a := a.(type) {
+	case types.Document:
+		b, ok := b.(types.Document)
+		if !ok || len(a.Keys()) != len(b.Keys()) {
+			return false
+		}
+		for _, key := range a.Keys() {
+			av, _ := a.Get(key)
+			bv, _ := b.Get(key)
+			if bv == nil || !sameValue(av, bv) {
+				return false
+			}
+		}
+		return true
+	case types.Array:
+		b := b.(types.Array)
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameValue(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return types.Equal(a, b)
+}
+
+func toCollection(name string, recv types.Object) (*storage.Collection, error) {
+	coll, ok := recv.(*storage.Collection)
+	if !ok {
+		return nil, fmt.Errorf("%s can only be called on a collection, got %s", name, typeName(recv))
+	}
+	return coll, nil
+}
+
+// collection::x.insert_many([{...}, ...]) loads the documents in bulk,
+// documents that can't be inserted are reported without stopping the load.
+// it returns {'inserted': n, 'errors': ['...', ...]}
+func methodInsertMany(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	coll, err := toCollection("insert_many", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("insert_many expects 1 argument, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := value.(types.Array)
+	if !ok {
+		return nil, fmt.Errorf("insert_many expects an array of documents, got %s", typeName(value))
+	}
+	docs := make([]*storage.Document, len(arr))
+	for i, element := range arr {
+		doc, ok := element.(*storage.Document)
+		if !ok {
+			return nil, fmt.Errorf("insert_many expects documents, element %d is %s", i, typeName(element))
+		}
+		docs[i] = doc
+	}
+	result, err := coll.BulkInsert(docs)
+	if err != nil {
+		return nil, err
+	}
+	errs := make(types.Array, len(result.Errors))
+	for i, e := range result.Errors {
+		errs[i] = types.String(e.Error())
+	}
+	doc := newDocument()
+	doc.Set([]byte("inserted"), types.Int64(result.Inserted))
+	doc.Set([]byte("errors"), errs)
+	return doc, nil
+}
+
+// update operators usable in an update spec, like {'balance': inc(5)}
+var updateOps = map[string]int{
+	"set":      storage.UpdateSet,
+	"unset":    storage.UpdateUnset,
+	"inc":      storage.UpdateInc,
+	"dec":      storage.UpdateDec,
+	"push":     storage.UpdatePush,
+	"pull":     storage.UpdatePull,
+	"addToSet": storage.UpdateAddToSet,
+	"merge":    storage.UpdateMerge,
+}
+
+// collection::x.update(filter, spec...) changes every document matching
+// the filter in a single transaction. a spec is one of
+//
+//	{'field': op, ...}  op is inc(n), dec(n), set(v), unset(), push(v),
+//	                    pull(v), addToSet(v), merge({...}) or a value to set
+//	merge({...})        deep merges into the document itself
+//	field++, field--    increments or decrements by one
+//
+// specs are evaluated against each document so they can use its fields.
+// it returns {'matched': n, 'modified': n}
+func methodUpdate(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	coll, err := toCollection("update", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 2 {
+		return nil, fmt.Errorf("update expects a filter and at least one change")
+	}
+	filter, specs := args[0], args[1:]
+	matched, modified := 0, 0
+	err = coll.Database().Update(func(txn *badger.Txn) error {
+		docs, err := sc.filterTxn(txn, coll, filter)
+		if err != nil {
+			return err
+		}
+		matched = len(docs)
+		for _, doc := range docs {
+			ops, err := sc.withDocument(doc).updateOps(specs)
+			if err != nil {
+				return err
+			}
+			before := copyRow(doc)
+			if err := storage.ApplyUpdate(doc, ops...); err != nil {
+				return err
+			}
+			if sameValue(before, doc) {
+				continue
+			}
+			if err := coll.SetTxn(txn, doc); err != nil {
+				return err
+			}
+			modified++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc := newDocument()
+	doc.Set([]byte("matched"), types.Int64(matched))
+	doc.Set([]byte("modified"), types.Int64(modified))
+	return doc, nil
+}
+
+// collection::x.upsert({...}, spec...) inserts the document if there is
+// none with its id, otherwise it applies the specs, see update(...), to
+// the stored document or replaces it when there are no specs.
+// it returns {'id': id, 'inserted': bool}
+func methodUpsert(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	coll, err := toCollection("upsert", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) < 1 {
+		return nil, fmt.Errorf("upsert expects a document")
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := value.(*storage.Document)
+	if !ok {
+		return nil, fmt.Errorf("upsert expects a document, got %s", typeName(value))
+	}
+	if doc.ID() == nil {
+		return nil, fmt.Errorf("upsert: %w", types.ErrInvalidDocument)
+	}
+	inserted := false
+	err = coll.Database().Update(func(txn *badger.Txn) error {
+		// the specs see the stored document if there is one
+		target := doc
+		current, err := coll.GetTxn(txn, doc.ID())
+		if err == nil {
+			target = current
+		} else if err != storage.ErrDocumentNotFound {
+			return err
+		}
+		ops, err := sc.withDocument(target).updateOps(args[1:])
+		if err != nil {
+			return err
+		}
+		_, inserted, err = coll.UpsertTxn(txn, doc, ops...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := newDocument()
+	result.Set([]byte("id"), doc.ID())
+	result.Set([]byte("inserted"), types.Bool(inserted))
+	return result, nil
+}
+
+// filterTxn returns the documents of the collection the filter is true for
+func (sc *scope) filterTxn(txn *badger.Txn, coll *storage.Collection, filter parser.Expr) ([]*storage.Document, error) {
+	it, err := coll.ScanTxn(txn, storage.ScanOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	docs := make([]*storage.Document, 0)
+	for it.Next() {
+		doc := it.Document()
+		ok, err := sc.withDocument(doc).evalCode(filter)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(ok) {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, it.Err()
+}
+
+// updateOps turns the specs of update(...) into storage operators
+func (sc *scope) updateOps(specs []parser.Expr) ([]storage.UpdateOp, error) {
+	ops := make([]storage.UpdateOp, 0)
+	for _, spec := range specs {
+		switch spec := spec.(type) {
+		case *parser.ObjectLit:
+			for _, field := range spec.Fields {
+				op, err := sc.updateOp(field.Key, field.Value)
+				if err != nil {
+					return nil, err
+				}
+				ops = append(ops, op)
+			}
+		case *parser.Postfix:
+			field, ok := fieldPath(spec.Operand)
+			if !ok {
+				return nil, errorfAt(spec, "%s needs a field name", spec.String())
+			}
+			op := storage.UpdateOp{Op: storage.UpdateInc, Field: field, Value: types.Int64(1)}
+			if spec.Op == lexer.TokenDec {
+				op.Op = storage.UpdateDec
+			}
+			ops = append(ops, op)
+		case *parser.Call:
+			if ident, ok := spec.Func.(*parser.Ident); !ok || ident.Name != "merge" {
+				return nil, errorfAt(spec, "invalid update %s", spec.String())
+			}
+			op, err := sc.updateOp("", spec)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+		default:
+			return nil, errorfAt(spec, "invalid update %s", spec.String())
+		}
+	}
+	return ops, nil
+}
+
+func (sc *scope) updateOp(field string, expr parser.Expr) (storage.UpdateOp, error) {
+	call, ok := expr.(*parser.Call)
+	if ok {
+		if ident, ok := call.Func.(*parser.Ident); ok {
+			if kind, ok := updateOps[ident.Name]; ok {
+				return sc.updateCall(field, kind, call)
+			}
+		}
+	}
+	// anything else is the value to set
+	value, err := sc.eval(expr)
+	if err != nil {
+		return storage.UpdateOp{}, err
+	}
+	return storage.UpdateOp{Op: storage.UpdateSet, Field: field, Value: value}, nil
+}
+
+func (sc *scope) updateCall(field string, kind int, call *parser.Call) (storage.UpdateOp, error) {
+	op := storage.UpdateOp{Op: kind, Field: field}
+	switch {
+	case kind == storage.UpdateUnset:
+		if len(call.Args) != 0 {
+			return op, errorfAt(call, "unset expects no arguments")
+		}
+		return op, nil
+	case (kind == storage.UpdateInc || kind == storage.UpdateDec) && len(call.Args) == 0:
+		op.Value = types.Int64(1)
+		return op, nil
+	}
+	if len(call.Args) != 1 {
+		return op, errorfAt(call, "%s expects 1 argument, got %d", call.Func.String(), len(call.Args))
+	}
+	value, err := sc.eval(call.Args[0])
+	if err != nil {
+		return op, err
+	}
+	op.Value = value
+	return op, nil
+}
+
+// fieldPath turns a.b.c into the path "a.b.c"
+func fieldPath(expr parser.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *parser.Ident:
+		return expr.Name, true
+	case *parser.Member:
+		recv, ok := fieldPath(expr.Recv)
+		if !ok {
+			return "", false
+		}
+		return recv + "." + expr.Name, true
+	}
+	return "", false
+}
+
+// analyze(collection::x) counts the documents of x and the distinct
+// values of its indexes for the planner, the statistics are kept until it
+// is analyzed again. it returns {'documents': n, 'size': bytes, 'version':
+// v, 'indexes': {'name': {'entries': n, 'distinct': [n, ...], 'buckets':
+// n}, ...}, 'fields': {'name': {'type': n, ...}, ...}}, distinct counts the
+// values of the first fields of the index and fields the types of the
+// values of each field
+func builtinAnalyze(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("analyze expects 1 argument, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	coll, ok := value.(*storage.Collection)
+	if !ok {
+		return nil, errorfAt(args[0], "analyze expects a collection, got %s", typeName(value))
+	}
+	stats, err := coll.Analyze()
+	if err != nil {
+		return nil, err
+	}
+	indexes := make(types.Map, len(stats.Indexes))
+	for name, index := range stats.Indexes {
+		distinct := make(types.Array, len(index.Distinct))
+		for i, n := range index.Distinct {
+			distinct[i] = types.Int64(n)
+		}
+		indexes[name] = types.Map{
+			"entries":  types.Int64(index.Entries),
+			"distinct": distinct,
+			"buckets":  types.Int64(len(index.Histogram)),
+		}
+	}
+	fields := make(types.Map, len(stats.Fields))
+	for name, field := range stats.Fields {
+		counts := make(types.Map, len(field.Types))
+		for t, n := range field.Types {
+			counts[staticName(t)] = types.Int64(n)
+		}
+		fields[name] = counts
+	}
+	return types.Map{
+		"documents": types.Int64(stats.Documents),
+		"size":      types.Int64(stats.Size),
+		"version":   types.Int64(stats.Version),
+		"indexes":   indexes,
+		"fields":    fields,
+	}, nil
+}
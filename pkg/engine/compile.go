@@ -0,0 +1,241 @@
+package engine
+
+import (
+	"sync"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// the instructions of the virtual machine, it works on a stack of values
+type opcode byte
+
+const (
+	// push consts[arg]
+	opConst opcode = iota
+	// push the value of the param, or of the field or variable, of the node
+	opParam
+	opLoad
+	// push the value of the node from the tree walking evaluator, for the
+	// calls of builtins which get their arguments unevaluated
+	opEval
+	// run the statement of the node with the tree walking evaluator
+	opExec
+	// set the variable of the let of the node to the top value, it stays
+	opLet
+	opPop
+	// replace the top value with the unary operator of the node applied
+	// to it, or the two top values with the binary operator arg
+	opUnary
+	opBinary
+	// && and ||, when the top value decides the result it is replaced
+	// with false or true and the code goes on at arg, else it is popped
+	opJumpFalse
+	opJumpTrue
+	// replace the top value with whether it is truthy
+	opTruthy
+	// replace the arg top values with an array of them, or a document
+	// with the keys of the node
+	opArray
+	opObject
+	// replace the top value with its field of the node, or the two top
+	// values with recv[index]
+	opMember
+	opIndex
+	// call the method or the right side of the pipe of the node with the
+	// top value
+	opMethod
+	opPipe
+)
+
+type instr struct {
+	op  opcode
+	arg int
+}
+
+// code is a script or an expression compiled for the virtual machine,
+// nodes[i] is the node instrs[i] was compiled from
+type code struct {
+	instrs []instr
+	nodes  []parser.Node
+	consts []types.Object
+	// the most values on the stack at once
+	depth int
+}
+
+type compiler struct {
+	c     *code
+	depth int
+}
+
+// emit adds an instruction that changes the number of values on the
+// stack by delta, it returns its index
+func (cp *compiler) emit(op opcode, arg int, node parser.Node, delta int) int {
+	cp.c.instrs = append(cp.c.instrs, instr{op: op, arg: arg})
+	cp.c.nodes = append(cp.c.nodes, node)
+	cp.depth += delta
+	cp.c.depth = max(cp.c.depth, cp.depth)
+	return len(cp.c.instrs) - 1
+}
+
+func (cp *compiler) constant(value types.Object) int {
+	cp.c.consts = append(cp.c.consts, value)
+	return len(cp.c.consts) - 1
+}
+
+// compileProgram compiles the statements of a script, the value of the
+// last one is left on the stack
+func compileProgram(ast *parser.Program) *code {
+	cp := &compiler{c: &code{}}
+	if len(ast.Statements) == 0 {
+		cp.emit(opConst, cp.constant(types.Null{}), nil, 1)
+	}
+	for i, stmt := range ast.Statements {
+		if i > 0 {
+			cp.emit(opPop, 0, stmt, -1)
+		}
+		switch stmt := stmt.(type) {
+		case *parser.LetStmt:
+			cp.expr(stmt.Value)
+			cp.emit(opLet, 0, stmt, 0)
+		case *parser.ExprStmt:
+			cp.expr(stmt.Expr)
+		default:
+			cp.emit(opExec, 0, stmt, 1)
+		}
+	}
+	return cp.c
+}
+
+func compileExpr(expr parser.Expr) *code {
+	cp := &compiler{c: &code{}}
+	cp.expr(expr)
+	return cp.c
+}
+
+func (cp *compiler) expr(expr parser.Expr) {
+	if value, ok := fold(expr); ok {
+		cp.emit(opConst, cp.constant(value), expr, 1)
+		return
+	}
+	switch expr := expr.(type) {
+	case *parser.Param:
+		cp.emit(opParam, 0, expr, 1)
+	case *parser.Ident:
+		cp.emit(opLoad, 0, expr, 1)
+	case *parser.Unary:
+		cp.expr(expr.Operand)
+		cp.emit(opUnary, 0, expr, 0)
+	case *parser.Binary:
+		cp.expr(expr.Left)
+		if expr.Op == lexer.TokenAnd || expr.Op == lexer.TokenOr {
+			op := opJumpFalse
+			if expr.Op == lexer.TokenOr {
+				op = opJumpTrue
+			}
+			jump := cp.emit(op, 0, expr, -1)
+			cp.expr(expr.Right)
+			cp.emit(opTruthy, 0, expr, 0)
+			cp.c.instrs[jump].arg = len(cp.c.instrs)
+			return
+		}
+		cp.expr(expr.Right)
+		cp.emit(opBinary, expr.Op, expr, -1)
+	case *parser.ArrayLit:
+		for _, element := range expr.Elements {
+			cp.expr(element)
+		}
+		cp.emit(opArray, len(expr.Elements), expr, 1-len(expr.Elements))
+	case *parser.ObjectLit:
+		for _, field := range expr.Fields {
+			cp.expr(field.Value)
+		}
+		cp.emit(opObject, len(expr.Fields), expr, 1-len(expr.Fields))
+	case *parser.Member:
+		cp.expr(expr.Recv)
+		cp.emit(opMember, 0, expr, 0)
+	case *parser.Index:
+		cp.expr(expr.Recv)
+		cp.expr(expr.Index)
+		cp.emit(opIndex, 0, expr, -1)
+	case *parser.MethodCall:
+		cp.expr(expr.Recv)
+		cp.emit(opMethod, 0, expr, 0)
+	case *parser.Pipe:
+		cp.expr(expr.Value)
+		cp.emit(opPipe, 0, expr, 0)
+	default:
+		cp.emit(opEval, 0, expr, 1)
+	}
+}
+
+// fold returns the value of an expression of literals and operators, ok
+// is false when it depends on anything else or fails, the error is then
+// reported when it runs
+func fold(expr parser.Expr) (value types.Object, ok bool) {
+	switch expr := expr.(type) {
+	case *parser.NumberLit:
+		value, err := parseNumber(expr)
+		return value, err == nil
+	case *parser.StringLit:
+		return types.String(expr.Value), true
+	case *parser.BoolLit:
+		return types.Bool(expr.Value), true
+	case *parser.NullLit:
+		return types.Null{}, true
+	case *parser.Unary:
+		operand, ok := fold(expr.Operand)
+		if !ok {
+			return nil, false
+		}
+		value, err := unaryOp(expr, operand)
+		return value, err == nil
+	case *parser.Binary:
+		left, ok := fold(expr.Left)
+		if !ok {
+			return nil, false
+		}
+		// the right side is not evaluated if the left one decides
+		switch {
+		case expr.Op == lexer.TokenAnd && !truthy(left):
+			return types.Bool(false), true
+		case expr.Op == lexer.TokenOr && truthy(left):
+			return types.Bool(true), true
+		}
+		right, ok := fold(expr.Right)
+		if !ok {
+			return nil, false
+		}
+		if expr.Op == lexer.TokenAnd || expr.Op == lexer.TokenOr {
+			return types.Bool(truthy(right)), true
+		}
+		value, err := binaryOp(expr.Op, left, right)
+		return value, err == nil
+	}
+	return nil, false
+}
+
+// program is a compiled script, it is shared by the runs of the same
+// source. the expressions that are evaluated for every row, like the
+// conditions of filters, are compiled the first time they run
+type program struct {
+	ast   *parser.Program
+	main  *code
+	exprs sync.Map
+	// the accesses choose picked for the queries by planKey
+	plans sync.Map
+}
+
+func newProgram(ast *parser.Program) *program {
+	return &program{ast: ast, main: compileProgram(ast)}
+}
+
+// expr returns the code of an expression of the script
+func (p *program) expr(expr parser.Expr) *code {
+	if c, ok := p.exprs.Load(expr); ok {
+		return c.(*code)
+	}
+	c, _ := p.exprs.LoadOrStore(expr, compileExpr(expr))
+	return c.(*code)
+}
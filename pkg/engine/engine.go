@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrNoDatabase     = errors.New("no database selected, use(name) first")
+	ErrFunctionExists = errors.New("function already exists")
+)
+
+// Error is returned when a script fails while running, Pos is the
+// offset in the source of the expression that failed
+type Error struct {
+	Pos int
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Err.Error(), e.Pos)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Options configure how an engine runs queries
+type Options struct {
+	// bytes of rows a query can hold in memory, like the groups of
+	// group_by, before it spills to temporary files. 0 for 64 MiB
+	MemoryBudget int64
+	// directory of the temporary files, empty for the system one
+	TempDir string
+	// compiled scripts kept for Exec to run them again without parsing
+	// them, 0 for 256 and negative to keep none
+	ProgramCache int
+}
+
+func DefaultOptions() Options {
+	return Options{}
+}
+
+const (
+	defaultMemoryBudget = 64 << 20
+	defaultProgramCache = 256
+)
+
+// Engine runs scripts against the databases of a registry
+type Engine struct {
+	registry *storage.Registry
+	opts     Options
+
+	mu        sync.RWMutex
+	functions map[string]Function
+
+	programs *programCache
+}
+
+// Function is a function defined by the program that embeds the engine,
+// scripts call it like a builtin, f(a, b) or a | f(b). queries in the
+// arguments are read into arrays before it is called
+type Function func(args []types.Object) (types.Object, error)
+
+func NewEngine(registry *storage.Registry) *Engine {
+	return NewEngineWithOptions(registry, DefaultOptions())
+}
+
+func NewEngineWithOptions(registry *storage.Registry, opts Options) *Engine {
+	if opts.MemoryBudget <= 0 {
+		opts.MemoryBudget = defaultMemoryBudget
+	}
+	if opts.ProgramCache == 0 {
+		opts.ProgramCache = defaultProgramCache
+	}
+	return &Engine{
+		registry:  registry,
+		opts:      opts,
+		functions: make(map[string]Function),
+		programs:  newProgramCache(opts.ProgramCache),
+	}
+}
+
+// Define makes fn callable from scripts as name, it can't replace a
+// builtin, a method or another function
+func (e *Engine) Define(name string, fn Function) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, builtin := builtins[name]
+	_, method := methods[name]
+	_, defined := e.functions[name]
+	if builtin || method || defined {
+		return fmt.Errorf("%s: %w", name, ErrFunctionExists)
+	}
+	e.functions[name] = fn
+	return nil
+}
+
+func (e *Engine) function(name string) (Function, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	fn, ok := e.functions[name]
+	return fn, ok
+}
+
+func (e *Engine) Options() Options {
+	return e.opts
+}
+
+func (e *Engine) Registry() *storage.Registry {
+	return e.registry
+}
+
+// Session keeps the state shared by the scripts run one after another,
+// like the database selected with use(...)
+type Session struct {
+	engine *Engine
+	db     *storage.Database
+}
+
+func (e *Engine) NewSession() *Session {
+	return &Session{
+		engine: e,
+	}
+}
+
+// Database returns the selected database or nil
+func (s *Session) Database() *storage.Database {
+	return s.db
+}
+
+// Use selects the database the following scripts run against
+func (s *Session) Use(name string) error {
+	db, err := s.engine.registry.Get(name)
+	if err != nil {
+		return fmt.Errorf("use(%s): %w", name, err)
+	}
+	s.db = db
+	return nil
+}
+
+// Exec parses and runs a script, the value of the last statement is
+// returned. the compiled scripts are cached so running the same source
+// again doesn't parse it
+func (s *Session) Exec(src string, params map[string]types.Object) (types.Object, error) {
+	prog, err := s.engine.programs.compile(src)
+	if err != nil {
+		return nil, err
+	}
+	return s.run(prog, params)
+}
+
+// Run runs a parsed script
+func (s *Session) Run(program *parser.Program, params map[string]types.Object) (types.Object, error) {
+	return s.run(newProgram(program), params)
+}
+
+func (s *Session) run(prog *program, params map[string]types.Object) (types.Object, error) {
+	if params == nil {
+		params = make(map[string]types.Object)
+	}
+	sc := &scope{
+		session: s,
+		params:  params,
+		vars:    make(map[string]types.Object),
+		prog:    prog,
+	}
+	result, err := sc.run(prog.main)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(result)
+}
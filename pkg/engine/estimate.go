@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"math"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// fractions of the rows a condition is guessed to keep when there are no
+// statistics for its field
+const (
+	equalSelectivity = 0.1
+	rangeSelectivity = 0.3
+	otherSelectivity = 0.5
+)
+
+// reading a document through an index costs that many reads of the
+// primary key, the entry is read before the document
+const indexReadCost = 2
+
+// estimator guesses how many rows the steps of a plan produce, from the
+// statistics of the collection when it was analyzed and otherwise from
+// fixed fractions of its number of documents
+type estimator struct {
+	n       float64
+	coll    *storage.Collection
+	stats   *storage.Stats
+	indexes []storage.IndexInfo
+}
+
+func newEstimator(coll *storage.Collection, stats *storage.Stats, n float64) *estimator {
+	return &estimator{n: n, coll: coll, stats: stats, indexes: coll.Indexes()}
+}
+
+// keyStats returns the statistics of an index, or of the primary key for
+// an empty name, nil if there are none
+func (e *estimator) keyStats(index string) *storage.IndexStats {
+	if e.stats == nil {
+		return nil
+	}
+	if index == "" {
+		return e.stats.Primary
+	}
+	return e.stats.Indexes[index]
+}
+
+// keyValue returns a value of the first field of an index as its entries,
+// and so its histogram, hold it. ok is false if it can't be compared with
+// them, like the bound of a range over an encrypted field
+func (e *estimator) keyValue(index string, value types.Object, exact bool) (types.Object, bool) {
+	if value == nil {
+		return nil, true
+	}
+	values, err := e.coll.IndexValues(index, exact, value)
+	if err != nil {
+		return nil, false
+	}
+	return values[0], true
+}
+
+// estimateValue and estimateRange are the estimates of st, the statistics
+// of index, for values of its first field
+func (e *estimator) estimateValue(st *storage.IndexStats, index string, value types.Object) float64 {
+	key, ok := e.keyValue(index, value, true)
+	if !ok {
+		return st.EstimateEqual(1)
+	}
+	return st.EstimateValue(key)
+}
+
+func (e *estimator) estimateRange(st *storage.IndexStats, index string, start, end types.Object) float64 {
+	lo, ok := e.keyValue(index, start, false)
+	hi, hiOk := e.keyValue(index, end, false)
+	if !ok || !hiOk {
+		return float64(st.Entries) * rangeSelectivity
+	}
+	return st.EstimateRange(lo, hi)
+}
+
+// fieldStats returns the statistics of the id or of an index that starts
+// with field and the name of the index, nil if there are none
+func (e *estimator) fieldStats(field string) (*storage.IndexStats, string) {
+	if field == "id" {
+		return e.keyStats(""), ""
+	}
+	for _, info := range e.indexes {
+		if info.Fields[0] == field {
+			if st := e.keyStats(info.Name); st != nil {
+				return st, info.Name
+			}
+		}
+	}
+	return nil, ""
+}
+
+// access guesses how many documents a scan reads
+func (e *estimator) access(a *access) float64 {
+	if a.single {
+		return math.Min(1, e.n)
+	}
+	st := e.keyStats(a.opts.Index)
+	if st == nil {
+		est := e.n * math.Pow(equalSelectivity, float64(a.eq))
+		if a.ranged {
+			est *= rangeSelectivity
+		}
+		return est
+	}
+	switch {
+	case a.eq == 0 && a.ranged:
+		return e.estimateRange(st, a.opts.Index, a.opts.Start[0], a.opts.End[0])
+	case a.eq == 0:
+		return float64(st.Entries)
+	case a.eq == 1 && !a.ranged:
+		return e.estimateValue(st, a.opts.Index, a.opts.Prefix[0])
+	}
+	est := st.EstimateEqual(a.eq)
+	if a.ranged {
+		est *= rangeSelectivity
+	}
+	return est
+}
+
+// cost guesses how much reading the documents of a scan costs. a scan in
+// the order of an order_by with a limit stops once it has enough rows
+func (e *estimator) cost(a *access, p *plan) float64 {
+	rows := e.access(a)
+	if a.sorted {
+		if o, ok := p.stages[0].(*orderStage); ok && o.top > 0 {
+			if keep := e.residual(p.filters, a.bounds); keep > 0 {
+				rows = math.Min(rows, float64(o.top)/keep)
+			}
+		}
+	}
+	if a.opts.Index != "" {
+		return rows * indexReadCost
+	}
+	return rows
+}
+
+// residual guesses the fraction of the documents of a scan the filters
+// keep, the conditions the scan is bounded by are already counted
+func (e *estimator) residual(filters []queryFilter, bounds []sarg) float64 {
+	bounded := make(map[parser.Expr]bool)
+	for _, a := range bounds {
+		bounded[a.expr] = true
+	}
+	keep := 1.0
+	for _, filter := range filters {
+		for _, cond := range conjuncts(filter.expr) {
+			if !bounded[cond] {
+				keep *= e.selectivity(filter, cond)
+			}
+		}
+	}
+	return keep
+}
+
+// selectivity guesses the fraction of the documents cond keeps, from the
+// statistics of the id or an index on its field when there are some
+func (e *estimator) selectivity(f queryFilter, cond parser.Expr) float64 {
+	if a, ok := f.sarg(cond); ok && e.n > 0 {
+		if st, index := e.fieldStats(a.field); st != nil {
+			if a.op == lexer.TokenEqual {
+				return math.Min(1, e.estimateValue(st, index, a.value)/e.n)
+			}
+			if start, end, bounds := rangeOf([]sarg{a}, a.field); bounds != nil {
+				return math.Min(1, e.estimateRange(st, index, start, end)/e.n)
+			}
+		}
+	}
+	return selectivity(cond)
+}
+
+// selectivity guesses the fraction of the rows cond keeps from its
+// operator
+func selectivity(cond parser.Expr) float64 {
+	if b, ok := cond.(*parser.Binary); ok {
+		switch b.Op {
+		case lexer.TokenEqual:
+			return equalSelectivity
+		case lexer.TokenLessThan, lexer.TokenLessThanEqual, lexer.TokenGreaterThan, lexer.TokenGreaterThanEqual:
+			return rangeSelectivity
+		}
+	}
+	return otherSelectivity
+}
+
+// stage guesses how many rows st produces from in rows
+func (e *estimator) stage(st stage, in float64) float64 {
+	switch st := st.(type) {
+	case *filterStage:
+		for _, cond := range conjuncts(st.filter.expr) {
+			in *= selectivity(cond)
+		}
+	case *orderStage:
+		if st.top > 0 {
+			in = math.Min(in, float64(st.top))
+		}
+	case *limitStage:
+		in = math.Min(in, float64(st.n))
+	case *skipStage:
+		in = math.Max(in-float64(st.n), 0)
+	case *groupStage:
+		if len(st.keys) == 0 {
+			return 1
+		}
+		// as many groups as the field of the key has values
+		if len(st.keys) == 1 && st.keys[0].field != "" {
+			if ks, _ := e.fieldStats(st.keys[0].field); ks != nil && len(ks.Distinct) > 0 {
+				return math.Min(in, float64(ks.Distinct[0]))
+			}
+		}
+		in = math.Min(in, math.Max(1, in*equalSelectivity))
+	}
+	return in
+}
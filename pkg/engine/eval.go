@@ -0,0 +1,592 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrDivisionByZero = errors.New("division by zero")
+)
+
+// scope holds the state of a single run of a script
+type scope struct {
+	session *Session
+	params  map[string]types.Object
+	vars    map[string]types.Object
+	// the document a filter or an update is evaluated against, its fields
+	// can be used as bare names
+	doc types.Document
+	// the compiled script, nil for an expression evaluated on its own
+	prog *program
+}
+
+// withDocument returns a scope where the fields of doc are visible
+func (sc *scope) withDocument(doc types.Document) *scope {
+	child := *sc
+	child.doc = doc
+	return &child
+}
+
+// evalCode evaluates an expression of the script with the virtual
+// machine, for the ones that are evaluated for every row
+func (sc *scope) evalCode(expr parser.Expr) (types.Object, error) {
+	if sc.prog == nil {
+		return sc.eval(expr)
+	}
+	return sc.run(sc.prog.expr(expr))
+}
+
+func errorAt(node parser.Node, err error) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{node.Position(), err}
+}
+
+func errorfAt(node parser.Node, format string, args ...interface{}) error {
+	return &Error{node.Position(), fmt.Errorf(format, args...)}
+}
+
+func (sc *scope) exec(stmt parser.Stmt) (types.Object, error) {
+	switch stmt := stmt.(type) {
+	case *parser.LetStmt:
+		value, err := sc.eval(stmt.Value)
+		if err != nil {
+			return nil, err
+		}
+		sc.vars[stmt.Name] = value
+		return value, nil
+	case *parser.ExprStmt:
+		return sc.eval(stmt.Expr)
+	}
+	return nil, errorfAt(stmt, "unknown statement %s", stmt.String())
+}
+
+func (sc *scope) eval(expr parser.Expr) (types.Object, error) {
+	switch expr := expr.(type) {
+	case *parser.NumberLit:
+		return parseNumber(expr)
+	case *parser.StringLit:
+		return types.String(expr.Value), nil
+	case *parser.BoolLit:
+		return types.Bool(expr.Value), nil
+	case *parser.NullLit:
+		return types.Null{}, nil
+	case *parser.Param:
+		if expr.Type != "" {
+			return nil, errorfAt(expr, "the type of $%s can only be declared in param(...)", expr.Name)
+		}
+		value, ok := sc.params[expr.Name]
+		if !ok {
+			return nil, errorfAt(expr, "missing parameter $%s", expr.Name)
+		}
+		return value, nil
+	case *parser.Ident:
+		return sc.lookup(expr)
+	case *parser.Path:
+		return sc.evalPath(expr)
+	case *parser.Call:
+		return sc.evalCall(expr)
+	case *parser.MethodCall:
+		return sc.evalMethod(expr)
+	case *parser.Pipe:
+		return sc.evalPipe(expr)
+	case *parser.Member:
+		recv, err := sc.eval(expr.Recv)
+		if err != nil {
+			return nil, err
+		}
+		return member(expr, recv, expr.Name)
+	case *parser.Index:
+		return sc.evalIndex(expr)
+	case *parser.Unary:
+		return sc.evalUnary(expr)
+	case *parser.Binary:
+		return sc.evalBinary(expr)
+	case *parser.Postfix:
+		return nil, errorfAt(expr, "%s can only be used in update(...)", expr.String())
+	case *parser.Order:
+		return nil, errorfAt(expr, "%s can only be used in order_by(...)", expr.String())
+	case *parser.ArrayLit:
+		arr := make(types.Array, 0, len(expr.Elements))
+		for _, element := range expr.Elements {
+			value, err := sc.eval(element)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		return arr, nil
+	case *parser.ObjectLit:
+		doc := newDocument()
+		for _, field := range expr.Fields {
+			value, err := sc.eval(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			doc.Set([]byte(field.Key), value)
+		}
+		return doc, nil
+	}
+	return nil, errorfAt(expr, "cannot evaluate %s", expr.String())
+}
+
+// newDocument creates a document that doesn't belong to a collection yet
+func newDocument() *storage.Document {
+	return storage.NewDocument(nil, nil, nil)
+}
+
+func parseNumber(expr *parser.NumberLit) (types.Object, error) {
+	if strings.Contains(expr.Value, ".") {
+		f, err := strconv.ParseFloat(expr.Value, 64)
+		if err != nil {
+			return nil, errorAt(expr, err)
+		}
+		return types.Float(f), nil
+	}
+	i, err := strconv.ParseInt(expr.Value, 10, 64)
+	if err != nil {
+		return nil, errorAt(expr, err)
+	}
+	return types.Int64(i), nil
+}
+
+// lookup resolves a bare name, the fields of the current document come
+// first, then the variables. a missing field is null since documents
+// don't have to share the same fields
+func (sc *scope) lookup(expr *parser.Ident) (types.Object, error) {
+	if sc.doc != nil {
+		value, err := sc.doc.Get([]byte(expr.Name))
+		if err != nil {
+			return nil, errorAt(expr, err)
+		}
+		if value != nil {
+			return value, nil
+		}
+	}
+	if value, ok := sc.vars[expr.Name]; ok {
+		return value, nil
+	}
+	if sc.doc != nil {
+		return types.Null{}, nil
+	}
+	return nil, errorfAt(expr, "undefined variable %s", expr.Name)
+}
+
+func (sc *scope) evalPath(expr *parser.Path) (types.Object, error) {
+	switch expr.Namespace {
+	case "collection":
+		db := sc.session.db
+		if db == nil {
+			return nil, errorAt(expr, ErrNoDatabase)
+		}
+		coll, err := db.Collection(expr.Name)
+		if err != nil {
+			return nil, errorfAt(expr, "%s: %w", expr.String(), err)
+		}
+		return coll, nil
+	}
+	return nil, errorfAt(expr, "unknown namespace %s", expr.Namespace)
+}
+
+func (sc *scope) evalCall(expr *parser.Call) (types.Object, error) {
+	ident, ok := expr.Func.(*parser.Ident)
+	if !ok {
+		return nil, errorfAt(expr, "%s is not a function", expr.Func.String())
+	}
+	builtin, ok := builtins[ident.Name]
+	if !ok {
+		fn, ok := sc.session.engine.function(ident.Name)
+		if !ok {
+			return nil, errorfAt(expr, "unknown function %s", ident.Name)
+		}
+		return sc.callFunction(expr, fn, nil, expr.Args)
+	}
+	value, err := builtin(sc, expr.Args)
+	if err != nil {
+		return nil, errorAt(expr, err)
+	}
+	return value, nil
+}
+
+// callFunction evaluates the arguments of a function defined with
+// Engine.Define and calls it, first is the value piped into it if any
+func (sc *scope) callFunction(node parser.Node, fn Function, first types.Object, args []parser.Expr) (types.Object, error) {
+	values := make([]types.Object, 0, len(args)+1)
+	if first != nil {
+		values = append(values, first)
+	}
+	for _, arg := range args {
+		value, err := sc.eval(arg)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	for i, value := range values {
+		if coll, ok := value.(*storage.Collection); ok {
+			value = &Query{coll: coll}
+		}
+		var err error
+		if values[i], err = resolve(value); err != nil {
+			return nil, errorAt(node, err)
+		}
+	}
+	value, err := fn(values)
+	if err != nil {
+		return nil, errorAt(node, err)
+	}
+	if value == nil {
+		return types.Null{}, nil
+	}
+	return value, nil
+}
+
+// value | f(args) calls the method f on value, or the builtin or defined
+// function f with value before the arguments
+func (sc *scope) evalPipe(expr *parser.Pipe) (types.Object, error) {
+	value, err := sc.eval(expr.Value)
+	if err != nil {
+		return nil, err
+	}
+	return sc.pipe(expr, value)
+}
+
+// pipe calls the right side of expr with the value of the left side
+func (sc *scope) pipe(expr *parser.Pipe, value types.Object) (types.Object, error) {
+	var name string
+	args := []parser.Expr{}
+	switch call := expr.Call.(type) {
+	case *parser.Call:
+		name, args = call.Func.(*parser.Ident).Name, call.Args
+	case *parser.Ident:
+		name = call.Name
+	}
+	if method, ok := methods[name]; ok {
+		value, err := method(sc, value, args)
+		if err != nil {
+			return nil, errorAt(expr.Call, err)
+		}
+		return value, nil
+	}
+	if name == "use" || name == "param" {
+		return nil, errorfAt(expr.Call, "%s takes names, it can't be used after |", name)
+	}
+	if builtin, ok := builtins[name]; ok {
+		// builtins get their arguments unevaluated, the value is passed
+		// as a variable no script can name
+		piped := sc.withVar(pipeVar, value)
+		value, err := builtin(piped, append([]parser.Expr{&parser.Ident{Pos: expr.Pos, Name: pipeVar}}, args...))
+		if err != nil {
+			return nil, errorAt(expr.Call, err)
+		}
+		return value, nil
+	}
+	if fn, ok := sc.session.engine.function(name); ok {
+		return sc.callFunction(expr.Call, fn, value, args)
+	}
+	return nil, errorfAt(expr.Call, "unknown function %s", name)
+}
+
+// a name that is not an identifier
+const pipeVar = "|"
+
+// withVar returns a scope with one more variable, the variables of sc
+// are not changed
+func (sc *scope) withVar(name string, value types.Object) *scope {
+	child := *sc
+	child.vars = make(map[string]types.Object, len(sc.vars)+1)
+	for k, v := range sc.vars {
+		child.vars[k] = v
+	}
+	child.vars[name] = value
+	return &child
+}
+
+func (sc *scope) evalMethod(expr *parser.MethodCall) (types.Object, error) {
+	recv, err := sc.eval(expr.Recv)
+	if err != nil {
+		return nil, err
+	}
+	return sc.callMethod(expr, recv)
+}
+
+// callMethod calls the method of expr on the value of its receiver
+func (sc *scope) callMethod(expr *parser.MethodCall, recv types.Object) (types.Object, error) {
+	method, ok := methods[expr.Name]
+	if !ok {
+		return nil, errorfAt(expr, "unknown method %s", expr.Name)
+	}
+	value, err := method(sc, recv, expr.Args)
+	if err != nil {
+		return nil, errorAt(expr, err)
+	}
+	return value, nil
+}
+
+func member(node parser.Node, recv types.Object, name string) (types.Object, error) {
+	doc, ok := recv.(types.Document)
+	if !ok {
+		return nil, errorfAt(node, "cannot get field %s of %s", name, recv.String())
+	}
+	value, err := doc.Get([]byte(name))
+	if err != nil {
+		return nil, errorAt(node, err)
+	}
+	if value == nil {
+		return types.Null{}, nil
+	}
+	return value, nil
+}
+
+func (sc *scope) evalIndex(expr *parser.Index) (types.Object, error) {
+	recv, err := sc.eval(expr.Recv)
+	if err != nil {
+		return nil, err
+	}
+	index, err := sc.eval(expr.Index)
+	if err != nil {
+		return nil, err
+	}
+	return indexValue(expr, recv, index)
+}
+
+// indexValue returns recv[index]
+func indexValue(expr *parser.Index, recv, index types.Object) (types.Object, error) {
+	switch recv := recv.(type) {
+	case types.Array:
+		i, ok := types.ToInt64(index)
+		if !ok {
+			return nil, errorfAt(expr, "array index must be an integer, got %s", index.String())
+		}
+		if i < 0 {
+			i += int64(len(recv))
+		}
+		if i < 0 || i >= int64(len(recv)) {
+			return types.Null{}, nil
+		}
+		return recv[i], nil
+	case types.Document:
+		return member(expr, recv, index.String())
+	}
+	return nil, errorfAt(expr, "cannot index %s", recv.String())
+}
+
+func (sc *scope) evalUnary(expr *parser.Unary) (types.Object, error) {
+	value, err := sc.eval(expr.Operand)
+	if err != nil {
+		return nil, err
+	}
+	return unaryOp(expr, value)
+}
+
+// unaryOp applies the operator of expr to value
+func unaryOp(expr *parser.Unary, value types.Object) (types.Object, error) {
+	switch expr.Op {
+	case lexer.TokenBang:
+		return types.Bool(!truthy(value)), nil
+	case lexer.TokenMinus:
+		switch v := value.(type) {
+		case types.Int64:
+			return -v, nil
+		case types.Int32:
+			return -v, nil
+		case types.Float:
+			return -v, nil
+		}
+		return nil, errorfAt(expr, "cannot negate %s", value.String())
+	}
+	return nil, errorfAt(expr, "unknown operator %s", expr.String())
+}
+
+// truthy decides if a value counts as true in conditions
+func truthy(o types.Object) bool {
+	switch v := o.(type) {
+	case types.Bool:
+		return bool(v)
+	case types.Null:
+		return false
+	case types.String:
+		return v != ""
+	case types.Array:
+		return len(v) > 0
+	}
+	if f, ok := types.ToFloat(o); ok {
+		return f != 0
+	}
+	return true
+}
+
+func (sc *scope) evalBinary(expr *parser.Binary) (types.Object, error) {
+	left, err := sc.eval(expr.Left)
+	if err != nil {
+		return nil, err
+	}
+	// && and || don't evaluate the right side if they don't need it
+	switch expr.Op {
+	case lexer.TokenAnd:
+		if !truthy(left) {
+			return types.Bool(false), nil
+		}
+		right, err := sc.eval(expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		return types.Bool(truthy(right)), nil
+	case lexer.TokenOr:
+		if truthy(left) {
+			return types.Bool(true), nil
+		}
+		right, err := sc.eval(expr.Right)
+		if err != nil {
+			return nil, err
+		}
+		return types.Bool(truthy(right)), nil
+	}
+	right, err := sc.eval(expr.Right)
+	if err != nil {
+		return nil, err
+	}
+	value, err := binaryOp(expr.Op, left, right)
+	if err != nil {
+		return nil, errorAt(expr, err)
+	}
+	return value, nil
+}
+
+// binaryOp applies every binary operator except && and ||
+func binaryOp(op int, left, right types.Object) (types.Object, error) {
+	switch op {
+	case lexer.TokenEqual:
+		return types.Bool(types.Equal(left, right)), nil
+	case lexer.TokenNotEqual:
+		return types.Bool(!types.Equal(left, right)), nil
+	case lexer.TokenLessThan, lexer.TokenLessThanEqual, lexer.TokenGreaterThan, lexer.TokenGreaterThanEqual:
+		if !types.Comparable(left, right) {
+			return nil, fmt.Errorf("cannot compare %s with %s", typeName(left), typeName(right))
+		}
+		c := types.Compare(left, right)
+		switch op {
+		case lexer.TokenLessThan:
+			return types.Bool(c < 0), nil
+		case lexer.TokenLessThanEqual:
+			return types.Bool(c <= 0), nil
+		case lexer.TokenGreaterThan:
+			return types.Bool(c > 0), nil
+		}
+		return types.Bool(c >= 0), nil
+	case lexer.TokenPlus:
+		if left.Type() == types.StringType && right.Type() == types.StringType {
+			return types.String(left.String() + right.String()), nil
+		}
+		if l, ok := left.(types.Array); ok {
+			if r, ok := right.(types.Array); ok {
+				return append(append(types.Array{}, l...), r...), nil
+			}
+		}
+	}
+	return arithmetic(op, left, right)
+}
+
+func arithmetic(op int, left, right types.Object) (types.Object, error) {
+	if !types.IsNumeric(left.Type()) || !types.IsNumeric(right.Type()) {
+		return nil, fmt.Errorf("invalid operands %s and %s for %s", typeName(left), typeName(right), lexer.TokenName(op))
+	}
+	li, lok := types.ToInt64(left)
+	ri, rok := types.ToInt64(right)
+	if lok && rok {
+		switch op {
+		case lexer.TokenPlus:
+			return types.Int64(li + ri), nil
+		case lexer.TokenMinus:
+			return types.Int64(li - ri), nil
+		case lexer.TokenAsterisk:
+			return types.Int64(li * ri), nil
+		case lexer.TokenSlash, lexer.TokenDoubleSlash, lexer.TokenPercent:
+			if ri == 0 {
+				return nil, ErrDivisionByZero
+			}
+			if op == lexer.TokenPercent {
+				return types.Int64(li % ri), nil
+			}
+			if op == lexer.TokenDoubleSlash || li%ri == 0 {
+				return types.Int64(floorDiv(li, ri)), nil
+			}
+			return types.Float(float64(li) / float64(ri)), nil
+		case lexer.TokenDoubleAsterisk:
+			if ri >= 0 {
+				return types.Int64(math.Pow(float64(li), float64(ri))), nil
+			}
+		}
+	}
+	lf, _ := types.ToFloat(left)
+	rf, _ := types.ToFloat(right)
+	switch op {
+	case lexer.TokenPlus:
+		return types.Float(lf + rf), nil
+	case lexer.TokenMinus:
+		return types.Float(lf - rf), nil
+	case lexer.TokenAsterisk:
+		return types.Float(lf * rf), nil
+	case lexer.TokenSlash:
+		if rf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return types.Float(lf / rf), nil
+	case lexer.TokenDoubleSlash:
+		if rf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return types.Float(math.Floor(lf / rf)), nil
+	case lexer.TokenPercent:
+		if rf == 0 {
+			return nil, ErrDivisionByZero
+		}
+		return types.Float(math.Mod(lf, rf)), nil
+	case lexer.TokenDoubleAsterisk:
+		return types.Float(math.Pow(lf, rf)), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", lexer.TokenName(op))
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q--
+	}
+	return q
+}
+
+var typeNames = map[byte]string{
+	types.NullType:       "null",
+	types.BoolType:       "bool",
+	types.Int64Type:      "int64",
+	types.Int32Type:      "int32",
+	types.FloatType:      "float",
+	types.StringType:     "string",
+	types.CharType:       "char",
+	types.ArrayType:      "array",
+	types.DocumentType:   "document",
+	types.CollectionType: "collection",
+	types.EmailType:      "email",
+	types.PhoneType:      "phone",
+	types.BinaryType:     "binary",
+	types.ReferenceType:  "reference",
+}
+
+func typeName(o types.Object) string {
+	if name, ok := typeNames[o.Type()]; ok {
+		return name
+	}
+	return "type " + strconv.Itoa(int(o.Type()))
+}
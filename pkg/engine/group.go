@@ -0,0 +1,759 @@
+package engine
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// rowExpr is a value taken from each row, a field given by name like
+// 'total' or total, or an expression evaluated against the row
+type rowExpr struct {
+	// path of the field, empty for an expression
+	field string
+	sc    *scope
+	expr  parser.Expr
+}
+
+func newRowExpr(sc *scope, expr parser.Expr) rowExpr {
+	if lit, ok := expr.(*parser.StringLit); ok {
+		return rowExpr{field: lit.Value, sc: sc, expr: expr}
+	}
+	if field, ok := fieldPath(expr); ok {
+		return rowExpr{field: field, sc: sc, expr: expr}
+	}
+	return rowExpr{sc: sc, expr: expr}
+}
+
+// value returns null for a missing field
+func (e rowExpr) value(row types.Document) (types.Object, error) {
+	if e.field == "" {
+		return e.sc.withDocument(row).evalCode(e.expr)
+	}
+	value, err := types.GetPath(row, e.field)
+	if value == nil && err == nil {
+		value = types.Null{}
+	}
+	return value, err
+}
+
+func (e rowExpr) String() string {
+	return e.expr.String()
+}
+
+// aggregate functions and whether they take no argument, one, or a value
+// and a fraction
+var aggregateFuncs = map[string]int{
+	"count":          0,
+	"sum":            1,
+	"avg":            1,
+	"min":            1,
+	"max":            1,
+	"first":          1,
+	"last":           1,
+	"collect":        1,
+	"count_distinct": 1,
+	"median":         1,
+	"percentile":     2,
+}
+
+// aggregate is one value computed over the rows of each group
+type aggregate struct {
+	fn string
+	// field of the result
+	name string
+	// nil for count() and for fn() on rows of a single field
+	arg *rowExpr
+	// fraction of percentile, 0.5 for median
+	p float64
+}
+
+func (a *aggregate) String() string {
+	s := a.fn + "("
+	if a.arg != nil {
+		s += a.arg.String()
+	}
+	if a.fn == "percentile" {
+		s += ", " + strconv.FormatFloat(a.p, 'g', -1, 64)
+	}
+	return s + ")"
+}
+
+// newAggregate parses fn(args), the result is named after the function
+// and the field unless name is given
+func newAggregate(sc *scope, fn, name string, args []parser.Expr) (*aggregate, error) {
+	a := &aggregate{fn: fn, name: name}
+	switch {
+	case fn == "count" && len(args) <= 1:
+	case fn == "median" && len(args) <= 1:
+		a.p = 0.5
+	case fn == "percentile" && len(args) == 2:
+		value, err := sc.eval(args[1])
+		if err != nil {
+			return nil, err
+		}
+		p, ok := types.ToFloat(value)
+		if !ok || p < 0 || p > 1 {
+			return nil, fmt.Errorf("percentile expects a fraction between 0 and 1, got %s", value.String())
+		}
+		a.p = p
+	case aggregateFuncs[fn] == 1 && len(args) <= 1:
+	case fn != "percentile":
+		return nil, fmt.Errorf("%s expects 0 or 1 argument, got %d", fn, len(args))
+	default:
+		return nil, fmt.Errorf("percentile expects 2 arguments, got %d", len(args))
+	}
+	if len(args) > 0 {
+		arg := newRowExpr(sc, args[0])
+		a.arg = &arg
+	}
+	if a.name == "" {
+		a.name = fn
+		if fn == "percentile" {
+			a.name = "p" + strconv.FormatFloat(a.p*100, 'g', -1, 64)
+		}
+		if a.arg != nil && a.arg.field != "" {
+			a.name += "_" + strings.ReplaceAll(a.arg.field, ".", "_")
+		}
+	}
+	return a, nil
+}
+
+// value returns what the aggregate adds for a row. without an argument
+// count counts the rows and the other functions take the only field of
+// the row, like sum() after select('amount')
+func (a *aggregate) value(row types.Document) (types.Object, error) {
+	switch {
+	case a.arg != nil:
+		return a.arg.value(row)
+	case a.fn == "count":
+		return types.Bool(true), nil
+	}
+	keys := row.Keys()
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("%s() needs rows with a single field like after select('field'), got %d fields", a.fn, len(keys))
+	}
+	return row.Get(keys[0])
+}
+
+// accumulator computes an aggregate over the values of a group, add
+// returns about how many bytes the value made it hold
+type accumulator interface {
+	add(value types.Object) (int64, error)
+	result() types.Object
+}
+
+func (a *aggregate) accumulator() accumulator {
+	switch a.fn {
+	case "count":
+		return &countAcc{all: a.arg == nil}
+	case "sum":
+		return &sumAcc{}
+	case "avg":
+		return &avgAcc{}
+	case "min":
+		return &extremeAcc{sign: -1}
+	case "max":
+		return &extremeAcc{sign: 1}
+	case "first":
+		return &firstAcc{}
+	case "last":
+		return &lastAcc{}
+	case "collect":
+		return &collectAcc{values: make(types.Array, 0)}
+	case "count_distinct":
+		return &distinctAcc{seen: make(map[string]struct{})}
+	}
+	return &percentileAcc{p: a.p}
+}
+
+func isNull(value types.Object) bool {
+	return value.Type() == types.NullType
+}
+
+// count() counts the rows, count(x) the rows where x is not null
+type countAcc struct {
+	all bool
+	n   int64
+}
+
+func (c *countAcc) add(value types.Object) (int64, error) {
+	if c.all || !isNull(value) {
+		c.n++
+	}
+	return 0, nil
+}
+
+func (c *countAcc) result() types.Object {
+	return types.Int64(c.n)
+}
+
+// sum stays an integer while it only adds integers, nulls are skipped
+type sumAcc struct {
+	ints    int64
+	floats  float64
+	isFloat bool
+}
+
+func (s *sumAcc) add(value types.Object) (int64, error) {
+	if isNull(value) {
+		return 0, nil
+	}
+	if !types.IsNumeric(value.Type()) {
+		return 0, fmt.Errorf("sum of %s", typeName(value))
+	}
+	if i, ok := types.ToInt64(value); ok {
+		s.ints += i
+		return 0, nil
+	}
+	f, _ := types.ToFloat(value)
+	s.floats += f
+	s.isFloat = true
+	return 0, nil
+}
+
+func (s *sumAcc) result() types.Object {
+	if s.isFloat {
+		return types.Float(s.floats + float64(s.ints))
+	}
+	return types.Int64(s.ints)
+}
+
+type avgAcc struct {
+	sum float64
+	n   int64
+}
+
+func (a *avgAcc) add(value types.Object) (int64, error) {
+	if isNull(value) {
+		return 0, nil
+	}
+	f, ok := types.ToFloat(value)
+	if !ok {
+		return 0, fmt.Errorf("avg of %s", typeName(value))
+	}
+	a.sum += f
+	a.n++
+	return 0, nil
+}
+
+func (a *avgAcc) result() types.Object {
+	if a.n == 0 {
+		return types.Null{}
+	}
+	return types.Float(a.sum / float64(a.n))
+}
+
+// min and max order values with types.Compare, values of different types
+// are ordered by their type
+type extremeAcc struct {
+	sign  int
+	value types.Object
+}
+
+func (e *extremeAcc) add(value types.Object) (int64, error) {
+	if isNull(value) {
+		return 0, nil
+	}
+	if e.value == nil || types.Compare(value, e.value) == e.sign {
+		size := objectSize(value)
+		if e.value != nil {
+			size -= objectSize(e.value)
+		}
+		e.value = value
+		return size, nil
+	}
+	return 0, nil
+}
+
+func (e *extremeAcc) result() types.Object {
+	if e.value == nil {
+		return types.Null{}
+	}
+	return e.value
+}
+
+// first and last are the values of the first and last rows of the group,
+// in the order the rows come in
+type firstAcc struct {
+	value types.Object
+}
+
+func (f *firstAcc) add(value types.Object) (int64, error) {
+	if f.value != nil {
+		return 0, nil
+	}
+	f.value = value
+	return objectSize(value), nil
+}
+
+func (f *firstAcc) result() types.Object {
+	if f.value == nil {
+		return types.Null{}
+	}
+	return f.value
+}
+
+type lastAcc struct {
+	value types.Object
+}
+
+func (l *lastAcc) add(value types.Object) (int64, error) {
+	size := objectSize(value)
+	if l.value != nil {
+		size -= objectSize(l.value)
+	}
+	l.value = value
+	return size, nil
+}
+
+func (l *lastAcc) result() types.Object {
+	if l.value == nil {
+		return types.Null{}
+	}
+	return l.value
+}
+
+type collectAcc struct {
+	values types.Array
+}
+
+func (c *collectAcc) add(value types.Object) (int64, error) {
+	c.values = append(c.values, value)
+	return objectSize(value), nil
+}
+
+func (c *collectAcc) result() types.Object {
+	return c.values
+}
+
+// values that are types.Equal count once, nulls don't count
+type distinctAcc struct {
+	seen map[string]struct{}
+}
+
+func (d *distinctAcc) add(value types.Object) (int64, error) {
+	if isNull(value) {
+		return 0, nil
+	}
+	key, err := valueKey(value)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := d.seen[key]; ok {
+		return 0, nil
+	}
+	d.seen[key] = struct{}{}
+	return 16 + int64(len(key)), nil
+}
+
+func (d *distinctAcc) result() types.Object {
+	return types.Int64(len(d.seen))
+}
+
+// percentiles interpolate between the two closest values, they keep
+// every value of the group
+type percentileAcc struct {
+	p      float64
+	values []float64
+}
+
+func (p *percentileAcc) add(value types.Object) (int64, error) {
+	if isNull(value) {
+		return 0, nil
+	}
+	f, ok := types.ToFloat(value)
+	if !ok {
+		return 0, fmt.Errorf("percentile of %s", typeName(value))
+	}
+	p.values = append(p.values, f)
+	return 8, nil
+}
+
+func (p *percentileAcc) result() types.Object {
+	if len(p.values) == 0 {
+		return types.Null{}
+	}
+	sort.Float64s(p.values)
+	rank := p.p * float64(len(p.values)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return types.Float(p.values[lower] + (p.values[upper]-p.values[lower])*(rank-float64(lower)))
+}
+
+// valueKey is the same for values that are types.Equal, values that
+// can't be keys, like documents, are compared by their encoding
+func valueKey(value types.Object) (string, error) {
+	if key, err := storage.EncodeKey(nil, value); err == nil {
+		return string(key), nil
+	}
+	b, err := types.MarshalObject(value)
+	return string(b), err
+}
+
+// groupStage groups the rows by the values of keys and makes a row with
+// the keys and the aggregates of each group, without keys all the rows
+// are one group. groups are held in memory until the memory budget is
+// used, the rows of the groups that come after are partitioned by key to
+// temporary files and grouped one file at a time
+type groupStage struct {
+	keys []rowExpr
+	aggs []*aggregate
+	opts Options
+}
+
+// groups are partitioned in that many files, a file that still has too
+// many groups is partitioned again up to maxSpillDepth times
+const (
+	spillFanout   = 16
+	maxSpillDepth = 8
+)
+
+func (g *groupStage) String() string {
+	keys := make([]string, len(g.keys))
+	for i, key := range g.keys {
+		keys[i] = key.String()
+	}
+	s := "group_by(" + strings.Join(keys, ", ") + ")"
+	for _, a := range g.aggs {
+		s += "." + a.String()
+	}
+	return s
+}
+
+func (g *groupStage) open(ex *execution, next sink) (sink, error) {
+	return g.sink(ex, next, 0), nil
+}
+
+func (g *groupStage) sink(ex *execution, next sink, depth int) *groupSink {
+	return &groupSink{groupStage: g, ex: ex, next: next, depth: depth, groups: make(map[string]*group)}
+}
+
+// copy returns a stage that aggregates can be added to without changing g
+func (g *groupStage) copy() *groupStage {
+	c := *g
+	c.aggs = append([]*aggregate{}, g.aggs...)
+	return &c
+}
+
+func (g *groupStage) add(a *aggregate) error {
+	for _, key := range g.keys {
+		if key.name() == a.name {
+			return fmt.Errorf("%s is already a key of group_by", a.name)
+		}
+	}
+	for _, other := range g.aggs {
+		if other.name == a.name {
+			return fmt.Errorf("there is already an aggregate named %s, name them with aggregate({...})", a.name)
+		}
+	}
+	g.aggs = append(g.aggs, a)
+	return nil
+}
+
+// name is the field of the key in the rows of the groups
+func (e rowExpr) name() string {
+	if e.field != "" {
+		return e.field
+	}
+	return e.expr.String()
+}
+
+type group struct {
+	key  types.Array
+	accs []accumulator
+}
+
+type groupSink struct {
+	*groupStage
+	ex    *execution
+	next  sink
+	depth int
+
+	groups map[string]*group
+	used   int64
+	// the rows of the groups that didn't fit, by hash of their key
+	parts []*spill
+}
+
+func (gs *groupSink) push(row types.Document) error {
+	key := make(types.Array, len(gs.keys))
+	for i, e := range gs.keys {
+		value, err := e.value(row)
+		if err != nil {
+			return err
+		}
+		key[i] = value
+	}
+	k, err := valueKey(key)
+	if err != nil {
+		return err
+	}
+	g, ok := gs.groups[k]
+	if !ok {
+		if len(gs.groups) > 0 && gs.used > gs.opts.MemoryBudget && gs.depth < maxSpillDepth {
+			return gs.spill(k, row)
+		}
+		g = &group{key: key, accs: accumulators(gs.aggs)}
+		gs.groups[k] = g
+		gs.used += 64 + int64(len(k)) + objectSize(key) + 32*int64(len(g.accs))
+	}
+	for i, a := range gs.aggs {
+		value, err := a.value(row)
+		if err != nil {
+			return err
+		}
+		size, err := g.accs[i].add(value)
+		if err != nil {
+			return err
+		}
+		gs.used += size
+	}
+	return nil
+}
+
+func (gs *groupSink) spill(key string, row types.Document) error {
+	if gs.parts == nil {
+		gs.parts = make([]*spill, spillFanout)
+	}
+	// the depth changes the hash so a file is split differently again
+	h := fnv.New32a()
+	h.Write([]byte{byte(gs.depth)})
+	h.Write([]byte(key))
+	i := h.Sum32() % spillFanout
+	if gs.parts[i] == nil {
+		sp, err := gs.ex.spill(gs.opts)
+		if err != nil {
+			return err
+		}
+		gs.parts[i] = sp
+	}
+	return gs.parts[i].write(row)
+}
+
+func (gs *groupSink) done() error {
+	if err := gs.flush(); err != nil {
+		return err
+	}
+	return gs.next.done()
+}
+
+// flush pushes the groups in memory ordered by key, then groups the
+// spilled rows
+func (gs *groupSink) flush() error {
+	if len(gs.groups) == 0 && len(gs.keys) == 0 && gs.depth == 0 {
+		// aggregates of no rows, like a count of 0
+		gs.groups[""] = &group{accs: accumulators(gs.aggs)}
+	}
+	groups := make([]*group, 0, len(gs.groups))
+	for _, g := range gs.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return types.Compare(groups[i].key, groups[j].key) < 0
+	})
+	gs.groups = nil
+	for _, g := range groups {
+		if err := gs.next.push(gs.row(g)); err != nil {
+			return err
+		}
+	}
+	for _, part := range gs.parts {
+		if part == nil {
+			continue
+		}
+		if err := part.rewind(); err != nil {
+			return err
+		}
+		child := gs.sink(gs.ex, gs.next, gs.depth+1)
+		for {
+			row, err := part.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if err := child.push(row); err != nil {
+				return err
+			}
+		}
+		part.remove()
+		if err := child.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// row makes the result of a group, keys that are fields are set at their
+// path so group_by(address.city) gives {'address': {'city': ...}, ...}
+func (g *groupStage) row(grp *group) types.Map {
+	row := make(types.Map)
+	for i, e := range g.keys {
+		if e.field != "" {
+			types.SetPath(row, e.field, grp.key[i])
+		} else {
+			row[e.name()] = grp.key[i]
+		}
+	}
+	for i, a := range g.aggs {
+		row[a.name] = grp.accs[i].result()
+	}
+	return row
+}
+
+// lastGroup returns the group_by the query ends with, if any
+func (q *Query) lastGroup() *groupStage {
+	if len(q.stages) == 0 {
+		return nil
+	}
+	g, _ := q.stages[len(q.stages)-1].(*groupStage)
+	return g
+}
+
+// x.group_by(key, ...) groups the rows of x by the keys, a key is a field
+// like city, 'city' or address.city, or an expression of the fields. the
+// aggregates chained after it are computed for every group, for example
+// x.group_by(city).count().sum(total) gives rows like
+// {'city': ..., 'count': n, 'sum_total': n}. groups come ordered by key
+// unless there were too many to hold in memory
+func methodGroupBy(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("group_by", recv)
+	if err != nil {
+		return nil, err
+	}
+	g := &groupStage{keys: make([]rowExpr, len(args)), opts: sc.session.engine.opts}
+	names := make(map[string]bool)
+	for i, arg := range args {
+		g.keys[i] = newRowExpr(sc, arg)
+		if names[g.keys[i].name()] {
+			return nil, fmt.Errorf("group_by has %s twice", g.keys[i].name())
+		}
+		names[g.keys[i].name()] = true
+	}
+	q.stages = append(q.stages, g)
+	return q, nil
+}
+
+// aggregateMethod makes the method of an aggregate function. after
+// group_by(...) it adds the aggregate to the groups, on any other query
+// it returns the aggregate of all its rows, like
+// collection::t.filter(id = $from_id).sum(amount)
+func aggregateMethod(fn string) Method {
+	return func(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+		a, err := newAggregate(sc, fn, "", args)
+		if err != nil {
+			return nil, err
+		}
+		return addAggregates(sc, fn, recv, a)
+	}
+}
+
+// x.group_by(...).aggregate({'name': fn(...), ...}) adds aggregates with
+// the given names, without group_by it returns a single row
+func methodAggregate(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("aggregate expects 1 argument, got %d", len(args))
+	}
+	obj, ok := args[0].(*parser.ObjectLit)
+	if !ok {
+		return nil, fmt.Errorf("aggregate expects {'name': fn(...), ...}, got %s", args[0].String())
+	}
+	aggs := make([]*aggregate, len(obj.Fields))
+	for i, field := range obj.Fields {
+		call, ok := field.Value.(*parser.Call)
+		var fn *parser.Ident
+		if ok {
+			fn, ok = call.Func.(*parser.Ident)
+		}
+		if ok {
+			_, ok = aggregateFuncs[fn.Name]
+		}
+		if !ok {
+			return nil, errorfAt(field.Value, "%s is not an aggregate function", field.Value.String())
+		}
+		a, err := newAggregate(sc, fn.Name, field.Key, call.Args)
+		if err != nil {
+			return nil, errorAt(call, err)
+		}
+		aggs[i] = a
+	}
+	return addAggregates(sc, "aggregate", recv, aggs...)
+}
+
+func addAggregates(sc *scope, name string, recv types.Object, aggs ...*aggregate) (types.Object, error) {
+	q, err := toQuery(name, recv)
+	if err != nil {
+		return nil, err
+	}
+	g := q.lastGroup()
+	grouped := g != nil
+	if grouped {
+		g = g.copy()
+	} else {
+		g = &groupStage{opts: sc.session.engine.opts}
+	}
+	for _, a := range aggs {
+		if err := g.add(a); err != nil {
+			return nil, err
+		}
+	}
+	if grouped {
+		q.stages[len(q.stages)-1] = g
+		return q, nil
+	}
+	q.stages = append(q.stages, g)
+	rows, err := q.run()
+	if err != nil {
+		return nil, err
+	}
+	// no rows at all for as_of before anything existed
+	var row types.Document = g.row(&group{accs: accumulators(g.aggs)})
+	if len(rows) > 0 {
+		row = rows[0].(types.Document)
+	}
+	if name == "aggregate" {
+		return row, nil
+	}
+	return row.Get([]byte(aggs[0].name))
+}
+
+func accumulators(aggs []*aggregate) []accumulator {
+	accs := make([]accumulator, len(aggs))
+	for i, a := range aggs {
+		accs[i] = a.accumulator()
+	}
+	return accs
+}
+
+// x.group_by(...).aggregates.having(cond) keeps the groups cond is true
+// for, cond sees the keys and the aggregates as fields
+func methodHaving(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("having", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("having expects 1 argument, got %d", len(args))
+	}
+	grouped := false
+	for _, s := range q.stages {
+		if _, ok := s.(*groupStage); ok {
+			grouped = true
+		}
+	}
+	if !grouped {
+		return nil, fmt.Errorf("having needs a group_by before it, use filter")
+	}
+	q.stages = append(q.stages, &filterStage{filter: queryFilter{sc: sc, expr: args[0]}})
+	return q, nil
+}
@@ -0,0 +1,391 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+type joinKind int
+
+const (
+	// rows for the pairs that match
+	innerJoin joinKind = iota
+	// like innerJoin but a left row without a match is kept as it is
+	leftJoin
+	// every left row with the array of its matches in a field
+	lookupJoin
+)
+
+var joinNames = map[joinKind]string{
+	innerJoin:  "join",
+	leftJoin:   "left_join",
+	lookupJoin: "lookup",
+}
+
+// joinStage pairs the rows of a query with the documents of another
+// collection read in the same snapshot. the documents are found by id or
+// through an index when the join is on a field of the other collection,
+// with a hash table of the other collection when there is no index, and
+// by comparing every pair when the condition is not an equality
+type joinStage struct {
+	kind joinKind
+	// the collection of the query and the other one, with its filters
+	left  string
+	right *Query
+	// left.local = right.foreign, empty if there is no equality to use
+	local   string
+	foreign string
+	// the condition as written, nil for join(other, 'local', 'foreign')
+	on *queryFilter
+	// the field lookup puts the matches in
+	as string
+}
+
+func (j *joinStage) String() string {
+	args := j.right.String()
+	if j.on != nil {
+		args += ", " + j.on.expr.String()
+	} else {
+		args += ", '" + j.local + "', '" + j.foreign + "'"
+	}
+	if j.kind == lookupJoin {
+		args += ", '" + j.as + "'"
+	}
+	return joinNames[j.kind] + "(" + args + ")"
+}
+
+// x.join(collection::y, 'local', 'foreign') pairs the rows of x with the
+// documents of y whose foreign field equals their local field, null never
+// matches. x.join(collection::y, x.a = y.b && ...) pairs them on a
+// condition where the rows are named after their collection. the pairs are
+// merged into one row, a field both have is kept from x and the one from y
+// is renamed y_field. y can be filtered, like collection::y.filter(...)
+func methodJoin(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	return join(sc, innerJoin, recv, args)
+}
+
+// x.left_join(...) is join(...) that also keeps the rows of x that match
+// nothing
+func methodLeftJoin(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	return join(sc, leftJoin, recv, args)
+}
+
+// x.lookup(collection::y, 'local', 'foreign', 'as') or x.lookup(
+// collection::y, cond, 'as') adds to every row of x the field as with the
+// array of the documents of y that match it
+func methodLookup(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	return join(sc, lookupJoin, recv, args)
+}
+
+func join(sc *scope, kind joinKind, recv types.Object, args []parser.Expr) (types.Object, error) {
+	name := joinNames[kind]
+	q, err := toQuery(name, recv)
+	if err != nil {
+		return nil, err
+	}
+	// the field names and the condition forms of the arguments
+	fields, cond := 3, 2
+	if kind == lookupJoin {
+		fields, cond = 4, 3
+	}
+	if len(args) != fields && len(args) != cond {
+		return nil, fmt.Errorf("%s expects %d or %d arguments, got %d", name, cond, fields, len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	right, err := toQuery(name, value)
+	if err != nil {
+		return nil, err
+	}
+	if right.coll.Database() != q.coll.Database() {
+		return nil, fmt.Errorf("%s needs a collection of the same database", name)
+	}
+	if right.asOf > 0 || right.none || len(right.stages) > 0 {
+		return nil, fmt.Errorf("%s reads %s at the version of the query, it can only be filtered", name, right.coll.String())
+	}
+	j := &joinStage{kind: kind, left: q.coll.Name(), right: right}
+	if len(args) == fields {
+		if j.local, err = stringArg(sc, name, args[1:2]); err != nil {
+			return nil, err
+		}
+		if j.foreign, err = stringArg(sc, name, args[2:3]); err != nil {
+			return nil, err
+		}
+	} else {
+		if j.left == right.coll.Name() {
+			return nil, fmt.Errorf("%s of %s with itself needs the field names", name, j.left)
+		}
+		j.on = &queryFilter{sc: sc, expr: args[1]}
+		j.local, j.foreign = j.equality(args[1])
+	}
+	if kind == lookupJoin {
+		if j.as, err = stringArg(sc, name, args[len(args)-1:]); err != nil {
+			return nil, err
+		}
+	}
+	q.stages = append(q.stages, j)
+	return q, nil
+}
+
+// equality looks in the && of cond for left.a = right.b, the fields the
+// documents can be found by
+func (j *joinStage) equality(cond parser.Expr) (local, foreign string) {
+	expr, ok := cond.(*parser.Binary)
+	if !ok {
+		return "", ""
+	}
+	switch expr.Op {
+	case lexer.TokenAnd:
+		if local, foreign = j.equality(expr.Left); local != "" {
+			return local, foreign
+		}
+		return j.equality(expr.Right)
+	case lexer.TokenEqual:
+		a, aField := sideField(expr.Left)
+		b, bField := sideField(expr.Right)
+		if a == j.left && b == j.right.coll.Name() {
+			return aField, bField
+		}
+		if a == j.right.coll.Name() && b == j.left {
+			return bField, aField
+		}
+	}
+	return "", ""
+}
+
+// sideField splits side.field
+func sideField(expr parser.Expr) (side, field string) {
+	member, ok := expr.(*parser.Member)
+	if !ok {
+		return "", ""
+	}
+	ident, ok := member.Recv.(*parser.Ident)
+	if !ok {
+		return "", ""
+	}
+	return ident.Name, member.Name
+}
+
+func (j *joinStage) open(ex *execution, next sink) (sink, error) {
+	js := &joinSink{joinStage: j, s: ex.s, next: next}
+	switch {
+	case j.local == "":
+		return js, js.load(nil)
+	case j.foreign == "id":
+		js.find = js.findByID
+		return js, nil
+	}
+	// indexes created after the version of the snapshot are empty in it
+	if ex.s.Version() == 0 {
+		for _, index := range j.right.coll.Indexes() {
+			if index.Fields[0] == j.foreign {
+				js.index = index.Name
+				js.find = js.findByIndex
+				return js, nil
+			}
+		}
+	}
+	js.hash = make(map[string][]types.Document)
+	js.find = js.findByHash
+	return js, js.load(js.hash)
+}
+
+type joinSink struct {
+	*joinStage
+	s    *storage.Snapshot
+	next sink
+
+	// the documents that may match a value of the local field
+	find  func(value types.Object) ([]types.Document, error)
+	index string
+	// the other collection by the foreign field, or all of it in docs
+	hash map[string][]types.Document
+	docs []types.Document
+}
+
+// load reads the other collection, into hash by the foreign field if
+// hash is not nil
+func (js *joinSink) load(hash map[string][]types.Document) error {
+	it, err := js.s.Scan(js.right.coll, storage.ScanOptions{})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		doc := it.Document()
+		ok, err := js.right.match(doc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if hash == nil {
+			js.docs = append(js.docs, doc)
+			continue
+		}
+		value, err := types.GetPath(doc, js.foreign)
+		if err != nil {
+			return err
+		}
+		if value == nil || value.Type() == types.NullType {
+			continue
+		}
+		key, err := storage.EncodeKey(nil, value)
+		if err != nil {
+			// can't be equal to a value that can be a key
+			continue
+		}
+		hash[string(key)] = append(hash[string(key)], doc)
+	}
+	return it.Err()
+}
+
+func (js *joinSink) findByID(value types.Object) ([]types.Document, error) {
+	doc, err := js.s.Get(js.right.coll, value)
+	if err == storage.ErrDocumentNotFound || err == storage.ErrUnsupportedKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []types.Document{doc}, nil
+}
+
+func (js *joinSink) findByIndex(value types.Object) ([]types.Document, error) {
+	it, err := js.s.Scan(js.right.coll, storage.ScanOptions{Index: js.index, Prefix: []types.Object{value}})
+	if err == storage.ErrUnsupportedKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	docs := make([]types.Document, 0)
+	for it.Next() {
+		docs = append(docs, it.Document())
+	}
+	return docs, it.Err()
+}
+
+func (js *joinSink) findByHash(value types.Object) ([]types.Document, error) {
+	key, err := storage.EncodeKey(nil, value)
+	if err != nil {
+		return nil, nil
+	}
+	return js.hash[string(key)], nil
+}
+
+// matches returns the documents of the other collection that go with row
+func (js *joinSink) matches(row types.Document) ([]types.Document, error) {
+	candidates := js.docs
+	var value types.Object
+	if js.local != "" {
+		var err error
+		if value, err = types.GetPath(row, js.local); err != nil {
+			return nil, err
+		}
+		if value == nil || value.Type() == types.NullType {
+			return nil, nil
+		}
+		if candidates, err = js.find(value); err != nil {
+			return nil, err
+		}
+	}
+	matches := make([]types.Document, 0)
+	for _, doc := range candidates {
+		if js.local != "" {
+			// indexes can fold case, and the filters of the other
+			// collection were not applied to what they return
+			other, err := types.GetPath(doc, js.foreign)
+			if err != nil {
+				return nil, err
+			}
+			if other == nil || !types.Equal(value, other) {
+				continue
+			}
+			if js.hash == nil {
+				ok, err := js.right.match(doc)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			}
+		}
+		if js.on != nil {
+			pair := types.Map{js.left: row, js.right.coll.Name(): doc}
+			ok, err := js.on.match(pair)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		matches = append(matches, doc)
+	}
+	return matches, nil
+}
+
+func (js *joinSink) push(row types.Document) error {
+	matches, err := js.matches(row)
+	if err != nil {
+		return err
+	}
+	switch {
+	case js.kind == lookupJoin:
+		joined := copyRow(row)
+		arr := make(types.Array, len(matches))
+		for i, doc := range matches {
+			arr[i] = doc
+		}
+		joined[js.as] = arr
+		return js.next.push(joined)
+	case len(matches) == 0 && js.kind == leftJoin:
+		return js.next.push(copyRow(row))
+	}
+	for _, doc := range matches {
+		if err := js.next.push(js.merge(row, doc)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (js *joinSink) done() error {
+	return js.next.done()
+}
+
+// merge makes the row of a pair, the fields of doc that row already has
+// are renamed <collection>_<field>
+func (js *joinSink) merge(row, doc types.Document) types.Map {
+	joined := copyRow(row)
+	prefix := js.right.coll.Name() + "_"
+	for _, key := range doc.Keys() {
+		value, _ := doc.Get(key)
+		name := string(key)
+		if _, ok := joined[name]; ok {
+			name = prefix + name
+		}
+		joined[name] = value
+	}
+	return joined
+}
+
+// copyRow makes a row that can get more fields without changing row
+func copyRow(row types.Document) types.Map {
+	keys := row.Keys()
+	copied := make(types.Map, len(keys))
+	for _, key := range keys {
+		copied[string(key)], _ = row.Get(key)
+	}
+	return copied
+}
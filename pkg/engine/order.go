@@ -0,0 +1,449 @@
+package engine
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// errStop is returned by a sink that doesn't need more rows, like a limit
+// that has all of its rows. the stages before it stop and the query ends
+// without error
+var errStop = errors.New("query stopped")
+
+type sortKey struct {
+	expr rowExpr
+	desc bool
+}
+
+// orderStage sorts the rows. the rows are sorted in memory until the
+// memory budget is used, then sorted runs are written to temporary files
+// and merged. when a limit follows the sort only the rows it keeps are
+// held, in a heap
+type orderStage struct {
+	keys []sortKey
+	// how many rows the limit after the sort keeps, 0 for all of them
+	top  int
+	opts Options
+}
+
+// past that many rows a limit is sorted like all the rows
+const maxTopN = 100000
+
+func (o *orderStage) String() string {
+	keys := make([]string, len(o.keys))
+	for i, key := range o.keys {
+		keys[i] = key.expr.String()
+		if key.desc {
+			keys[i] += " desc"
+		}
+	}
+	return "order_by(" + strings.Join(keys, ", ") + ")"
+}
+
+// sortRow is a row with the values it is sorted by, seq keeps the order
+// rows with the same values came in
+type sortRow struct {
+	keys types.Array
+	row  types.Document
+	seq  int
+}
+
+func (o *orderStage) sortRow(row types.Document, seq int) (sortRow, error) {
+	keys := make(types.Array, len(o.keys))
+	for i, key := range o.keys {
+		value, err := key.expr.value(row)
+		if err != nil {
+			return sortRow{}, err
+		}
+		keys[i] = value
+	}
+	return sortRow{keys: keys, row: row, seq: seq}, nil
+}
+
+func (o *orderStage) compare(a, b sortRow) int {
+	for i, key := range o.keys {
+		c := types.Compare(a.keys[i], b.keys[i])
+		if key.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	switch {
+	case a.seq < b.seq:
+		return -1
+	case a.seq > b.seq:
+		return 1
+	}
+	return 0
+}
+
+func (o *orderStage) open(ex *execution, next sink) (sink, error) {
+	if o.top > 0 && o.top <= maxTopN {
+		return &topSink{orderStage: o, next: next}, nil
+	}
+	return &sortSink{orderStage: o, ex: ex, next: next}, nil
+}
+
+type sortSink struct {
+	*orderStage
+	ex   *execution
+	next sink
+
+	rows []sortRow
+	used int64
+	// sorted runs of rows, a run written earlier has the earlier rows
+	runs []*spill
+}
+
+func (ss *sortSink) push(row types.Document) error {
+	r, err := ss.sortRow(row, len(ss.rows))
+	if err != nil {
+		return err
+	}
+	ss.rows = append(ss.rows, r)
+	ss.used += objectSize(row) + objectSize(r.keys) + 32
+	if ss.used > ss.opts.MemoryBudget {
+		return ss.writeRun()
+	}
+	return nil
+}
+
+func (ss *sortSink) sort() {
+	sort.Slice(ss.rows, func(i, j int) bool {
+		return ss.compare(ss.rows[i], ss.rows[j]) < 0
+	})
+}
+
+func (ss *sortSink) writeRun() error {
+	ss.sort()
+	sp, err := ss.ex.spill(ss.opts)
+	if err != nil {
+		return err
+	}
+	for _, r := range ss.rows {
+		if err := sp.write(r.row); err != nil {
+			return err
+		}
+	}
+	ss.runs = append(ss.runs, sp)
+	ss.rows = ss.rows[:0]
+	ss.used = 0
+	return nil
+}
+
+func (ss *sortSink) done() error {
+	if len(ss.runs) == 0 {
+		ss.sort()
+		for _, r := range ss.rows {
+			if err := ss.next.push(r.row); err != nil {
+				return err
+			}
+		}
+		return ss.next.done()
+	}
+	if len(ss.rows) > 0 {
+		if err := ss.writeRun(); err != nil {
+			return err
+		}
+	}
+	if err := ss.merge(); err != nil {
+		return err
+	}
+	return ss.next.done()
+}
+
+// merge pushes the rows of the runs in order, the first row of every run
+// is in a heap and is replaced by the next one of its run when it is taken
+func (ss *sortSink) merge() error {
+	h := &rowHeap{order: ss.orderStage}
+	read := func(run int) error {
+		row, err := ss.runs[run].read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// the run breaks ties so rows that compare equal keep their order
+		r, err := ss.sortRow(row, run)
+		if err != nil {
+			return err
+		}
+		heap.Push(h, r)
+		return nil
+	}
+	for run, sp := range ss.runs {
+		if err := sp.rewind(); err != nil {
+			return err
+		}
+		if err := read(run); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		r := heap.Pop(h).(sortRow)
+		if err := ss.next.push(r.row); err != nil {
+			return err
+		}
+		if err := read(r.seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowHeap has the smallest row on top, or the biggest if max is set
+type rowHeap struct {
+	order *orderStage
+	rows  []sortRow
+	max   bool
+}
+
+func (h *rowHeap) Len() int { return len(h.rows) }
+func (h *rowHeap) Less(i, j int) bool {
+	c := h.order.compare(h.rows[i], h.rows[j])
+	if h.max {
+		return c > 0
+	}
+	return c < 0
+}
+func (h *rowHeap) Swap(i, j int)      { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *rowHeap) Push(x interface{}) { h.rows = append(h.rows, x.(sortRow)) }
+func (h *rowHeap) Pop() interface{} {
+	r := h.rows[len(h.rows)-1]
+	h.rows = h.rows[:len(h.rows)-1]
+	return r
+}
+
+// topSink keeps the first top rows in a heap with the last of them on
+// top, a row that sorts before it replaces it
+type topSink struct {
+	*orderStage
+	next sink
+	seq  int
+	h    *rowHeap
+}
+
+func (ts *topSink) push(row types.Document) error {
+	if ts.h == nil {
+		ts.h = &rowHeap{order: ts.orderStage, max: true}
+	}
+	r, err := ts.sortRow(row, ts.seq)
+	if err != nil {
+		return err
+	}
+	ts.seq++
+	if ts.h.Len() < ts.top {
+		heap.Push(ts.h, r)
+		return nil
+	}
+	if ts.compare(r, ts.h.rows[0]) < 0 {
+		ts.h.rows[0] = r
+		heap.Fix(ts.h, 0)
+	}
+	return nil
+}
+
+func (ts *topSink) done() error {
+	if ts.h != nil {
+		rows := ts.h.rows
+		sort.Slice(rows, func(i, j int) bool {
+			return ts.compare(rows[i], rows[j]) < 0
+		})
+		for _, r := range rows {
+			if err := ts.next.push(r.row); err != nil {
+				return err
+			}
+		}
+	}
+	return ts.next.done()
+}
+
+// sortFields returns the fields of the order_by the query starts with
+// when they are plain fields that all go in the same direction, a scan in
+// the order of these fields doesn't have to be sorted
+func (q *Query) sortFields() (fields []string, desc bool, ok bool) {
+	if len(q.stages) == 0 {
+		return nil, false, false
+	}
+	o, ok := q.stages[0].(*orderStage)
+	if !ok {
+		return nil, false, false
+	}
+	desc = o.keys[0].desc
+	fields = make([]string, len(o.keys))
+	for i, key := range o.keys {
+		if key.desc != desc || key.expr.field == "" || strings.Contains(key.expr.field, ".") {
+			return nil, false, false
+		}
+		fields[i] = key.expr.field
+	}
+	return fields, desc, true
+}
+
+// limitStage passes on the first n rows then stops the query
+type limitStage struct {
+	n int
+}
+
+func (l *limitStage) String() string {
+	return fmt.Sprintf("limit(%d)", l.n)
+}
+
+func (l *limitStage) open(ex *execution, next sink) (sink, error) {
+	return &limitSink{n: l.n, next: next}, nil
+}
+
+type limitSink struct {
+	n        int
+	count    int
+	next     sink
+	finished bool
+}
+
+func (ls *limitSink) push(row types.Document) error {
+	if ls.count < ls.n {
+		ls.count++
+		if err := ls.next.push(row); err != nil {
+			return err
+		}
+	}
+	if ls.count < ls.n {
+		return nil
+	}
+	// the rest of the query ends here, nothing else is pushed
+	ls.finished = true
+	if err := ls.next.done(); err != nil {
+		return err
+	}
+	return errStop
+}
+
+func (ls *limitSink) done() error {
+	if ls.finished {
+		return nil
+	}
+	return ls.next.done()
+}
+
+// skipStage drops the first n rows
+type skipStage struct {
+	n int
+}
+
+func (s *skipStage) String() string {
+	return fmt.Sprintf("skip(%d)", s.n)
+}
+
+func (s *skipStage) open(ex *execution, next sink) (sink, error) {
+	return &skipSink{n: s.n, next: next}, nil
+}
+
+type skipSink struct {
+	n    int
+	next sink
+}
+
+func (ss *skipSink) push(row types.Document) error {
+	if ss.n > 0 {
+		ss.n--
+		return nil
+	}
+	return ss.next.push(row)
+}
+
+func (ss *skipSink) done() error {
+	return ss.next.done()
+}
+
+// x.order_by(key, ...) sorts the rows, a key is a field or an expression
+// followed by asc, the default, or desc, like order_by(total desc, name).
+// values of different types are ordered like types.Compare orders them,
+// nulls and missing fields first
+func methodOrderBy(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("order_by", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("order_by expects at least 1 key")
+	}
+	o := &orderStage{keys: make([]sortKey, len(args)), opts: sc.session.engine.opts}
+	for i, arg := range args {
+		if order, ok := arg.(*parser.Order); ok {
+			o.keys[i] = sortKey{expr: newRowExpr(sc, order.Expr), desc: order.Desc}
+		} else {
+			o.keys[i] = sortKey{expr: newRowExpr(sc, arg)}
+		}
+	}
+	q.stages = append(q.stages, o)
+	return q, nil
+}
+
+// x.limit(n) keeps the first n rows, the query stops reading once it has
+// them
+func methodLimit(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("limit", recv)
+	if err != nil {
+		return nil, err
+	}
+	n, err := countArg(sc, "limit", args)
+	if err != nil {
+		return nil, err
+	}
+	// a sort right before only has to keep the rows the limit keeps
+	i, top := len(q.stages)-1, n
+	if i >= 0 {
+		if skip, ok := q.stages[i].(*skipStage); ok {
+			i, top = i-1, n+skip.n
+		}
+	}
+	if i >= 0 {
+		if o, ok := q.stages[i].(*orderStage); ok && (o.top == 0 || top < o.top) {
+			c := *o
+			c.top = top
+			q.stages[i] = &c
+		}
+	}
+	q.stages = append(q.stages, &limitStage{n: n})
+	return q, nil
+}
+
+// x.skip(n) drops the first n rows
+func methodSkip(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("skip", recv)
+	if err != nil {
+		return nil, err
+	}
+	n, err := countArg(sc, "skip", args)
+	if err != nil {
+		return nil, err
+	}
+	q.stages = append(q.stages, &skipStage{n: n})
+	return q, nil
+}
+
+// countArg evaluates the single count argument of limit or skip
+func countArg(sc *scope, name string, args []parser.Expr) (int, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("%s expects 1 argument, got %d", name, len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return 0, err
+	}
+	n, ok := types.ToInt64(value)
+	if !ok || n < 0 {
+		return 0, fmt.Errorf("%s expects a count, got %s", name, value.String())
+	}
+	return int(n), nil
+}
@@ -0,0 +1,195 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// paramTypes are the types a parameter can be declared with, like
+// param($amount: money). null is not a value of any of them
+var paramTypes = map[string]func(types.Object) bool{
+	"number": isNumber,
+	// amounts are numbers, in the unit the collection stores them in
+	"money": isNumber,
+}
+
+func init() {
+	for t, name := range typeNames {
+		if t != types.NullType && t != types.CollectionType {
+			paramTypes[name] = hasType(t)
+		}
+	}
+}
+
+func isNumber(value types.Object) bool {
+	return types.IsNumeric(value.Type())
+}
+
+func hasType(t byte) func(types.Object) bool {
+	return func(value types.Object) bool {
+		return value.Type() == t
+	}
+}
+
+// checkParam checks value against the type decl is declared with
+func checkParam(decl *parser.Param, value types.Object) error {
+	if decl.Type == "" {
+		return nil
+	}
+	is, ok := paramTypes[decl.Type]
+	if !ok {
+		return unknownParamType(decl)
+	}
+	if !is(value) {
+		return errorfAt(decl, "parameter $%s must be %s, got %s", decl.Name, decl.Type, typeName(value))
+	}
+	return nil
+}
+
+func unknownParamType(decl *parser.Param) error {
+	names := make([]string, 0, len(paramTypes))
+	for name := range paramTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return errorfAt(decl, "unknown type %s of $%s, expected one of %s", decl.Type, decl.Name, strings.Join(names, ", "))
+}
+
+// declaredParams returns the parameters the param(...) statements of a
+// script declare in order, and checks the script only uses those
+func declaredParams(ast *parser.Program) ([]*parser.Param, error) {
+	var decls []*parser.Param
+	declared := make(map[string]bool)
+	for _, stmt := range ast.Statements {
+		call, ok := paramCall(stmt)
+		if !ok {
+			continue
+		}
+		for _, arg := range call.Args {
+			decl, ok := arg.(*parser.Param)
+			if !ok {
+				return nil, errorfAt(arg, "param expects parameters like $name, got %s", arg.String())
+			}
+			if declared[decl.Name] {
+				return nil, errorfAt(decl, "parameter $%s is declared twice", decl.Name)
+			}
+			if _, ok := paramTypes[decl.Type]; !ok && decl.Type != "" {
+				return nil, unknownParamType(decl)
+			}
+			declared[decl.Name] = true
+			decls = append(decls, decl)
+		}
+	}
+	var err error
+	for _, stmt := range ast.Statements {
+		if _, ok := paramCall(stmt); ok {
+			continue
+		}
+		walkStmt(stmt, func(e parser.Expr) bool {
+			param, ok := e.(*parser.Param)
+			switch {
+			case !ok || err != nil:
+			case param.Type != "":
+				err = errorfAt(param, "the type of $%s can only be declared in param(...)", param.Name)
+			case decls != nil && !declared[param.Name]:
+				err = errorfAt(param, "parameter $%s is not declared in param(...)", param.Name)
+			}
+			return err == nil
+		})
+	}
+	return decls, err
+}
+
+// paramCall returns the call of a param(...) statement
+func paramCall(stmt parser.Stmt) (*parser.Call, bool) {
+	es, ok := stmt.(*parser.ExprStmt)
+	if !ok {
+		return nil, false
+	}
+	call, ok := es.Expr.(*parser.Call)
+	if !ok {
+		return nil, false
+	}
+	ident, ok := call.Func.(*parser.Ident)
+	return call, ok && ident.Name == "param"
+}
+
+// walkStmt walks the expressions of a statement like parser.Walk
+func walkStmt(stmt parser.Stmt, fn func(parser.Expr) bool) {
+	switch stmt := stmt.(type) {
+	case *parser.LetStmt:
+		parser.Walk(stmt.Value, fn)
+	case *parser.ExprStmt:
+		parser.Walk(stmt.Expr, fn)
+	}
+}
+
+// Prepared is a script parsed, checked and compiled once to be run many
+// times with different parameters. the plans of its queries are made the
+// first time they run and reused while the collections keep the same
+// indexes and statistics
+type Prepared struct {
+	session *Session
+	prog    *program
+	params  []*parser.Param
+}
+
+// Prepare parses and checks a script for Exec like Check, the parameters
+// it declares with param(...) must all be given and have their declared
+// types
+func (s *Session) Prepare(src string) (*Prepared, error) {
+	prog, err := s.engine.programs.compile(src)
+	if err != nil {
+		return nil, err
+	}
+	params, err := s.check(prog.ast)
+	if err != nil {
+		return nil, err
+	}
+	return &Prepared{session: s, prog: prog, params: params}, nil
+}
+
+// Params returns the parameters the script declares, in order
+func (p *Prepared) Params() []*parser.Param {
+	return p.params
+}
+
+// Exec checks params against the declared parameters and runs the script
+func (p *Prepared) Exec(params map[string]types.Object) (types.Object, error) {
+	if err := p.check(params); err != nil {
+		return nil, err
+	}
+	return p.session.run(p.prog, params)
+}
+
+func (p *Prepared) check(params map[string]types.Object) error {
+	declared := make(map[string]bool, len(p.params))
+	for _, decl := range p.params {
+		value, ok := params[decl.Name]
+		if !ok {
+			return errorfAt(decl, "missing parameter $%s", decl.Name)
+		}
+		if err := checkParam(decl, value); err != nil {
+			return err
+		}
+		declared[decl.Name] = true
+	}
+	if p.params == nil {
+		return nil
+	}
+	var unknown []string
+	for name := range params {
+		if !declared[name] {
+			unknown = append(unknown, "$"+name)
+		}
+	}
+	if unknown != nil {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,709 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/noahmern/terara/pkg/lexer"
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// plan is how a query is run: the scan that reads the collection, the
+// filters and then the stages. the planner bounds the scan with the
+// conditions of the filters an index or the primary key can answer, reads
+// only the fields a select at the start needs, and drops an order_by the
+// scan already gives. the filters are still checked on every document the
+// scan returns, an index can fold case or hold more than they match
+type plan struct {
+	q *Query
+	access
+	// the filters of the query and the ones moved before a select
+	filters []queryFilter
+	stages  []stage
+	// rows read by the scan, kept by the filters and produced by each
+	// stage, only counted for explain
+	actual []int64
+}
+
+// access is a way to read the collection
+type access struct {
+	opts storage.ScanOptions
+	// the conditions of the filters the scan is bounded by
+	bounds []sarg
+	// the number of fields bounded by an equality and if the next one is
+	// bounded by a range
+	eq     int
+	ranged bool
+	// the scan returns at most one document
+	single bool
+	// the scan is in the order of the order_by the query starts with
+	sorted bool
+}
+
+// better reports if a reads fewer documents than b, or as many in a
+// useful order
+func (a *access) better(b *access) bool {
+	switch {
+	case a.single != b.single:
+		return a.single
+	case a.eq != b.eq:
+		return a.eq > b.eq
+	case a.ranged != b.ranged:
+		return a.ranged
+	}
+	return a.sorted && !b.sorted
+}
+
+// sarg is a condition field op value of a filter where the value is the
+// same for every document, a scan can be bounded by it
+type sarg struct {
+	field string
+	// = < <= > or >=, with the field on the left
+	op    int
+	value types.Object
+	// the condition as written
+	expr parser.Expr
+}
+
+// plan decides how to run the query in s
+func (q *Query) plan(s *storage.Snapshot) *plan {
+	p := &plan{q: q, filters: q.filters, stages: q.stages}
+	p.pushdown()
+	p.access = p.choose(s)
+	if p.sorted {
+		p.stages = p.stages[1:]
+	}
+	p.opts.Fields = p.projection()
+	return p
+}
+
+// pushdown moves the filters right after a select at the start before
+// it, when they only use fields the select keeps whole they see the same
+// values in the documents
+func (p *plan) pushdown() {
+	if len(p.stages) == 0 {
+		return
+	}
+	sel, ok := p.stages[0].(*selectStage)
+	if !ok {
+		return
+	}
+	kept := make(map[string]bool)
+	for _, field := range sel.fields {
+		kept[field] = true
+	}
+	n := 1
+	for ; n < len(p.stages); n++ {
+		f, ok := p.stages[n].(*filterStage)
+		if !ok || !onlyFields(f.filter.expr, kept) {
+			break
+		}
+		p.filters = append(append([]queryFilter{}, p.filters...), f.filter)
+	}
+	if n > 1 {
+		p.stages = append([]stage{sel}, p.stages[n:]...)
+	}
+}
+
+// onlyFields reports if the names expr uses are all in fields
+func onlyFields(expr parser.Expr, fields map[string]bool) bool {
+	ok := true
+	walkNames(expr, func(name string) {
+		ok = ok && fields[name]
+	})
+	return ok
+}
+
+// walkNames calls fn with the bare names expr uses, the fields of a
+// document it is evaluated against or variables
+func walkNames(expr parser.Expr, fn func(name string)) {
+	var visit func(e parser.Expr) bool
+	visit = func(e parser.Expr) bool {
+		switch e := e.(type) {
+		case *parser.Ident:
+			fn(e.Name)
+		case *parser.Call:
+			// the name of a function is not a field
+			for _, arg := range e.Args {
+				parser.Walk(arg, visit)
+			}
+			return false
+		case *parser.Pipe:
+			parser.Walk(e.Value, visit)
+			if call, ok := e.Call.(*parser.Call); ok {
+				for _, arg := range call.Args {
+					parser.Walk(arg, visit)
+				}
+			}
+			return false
+		}
+		return true
+	}
+	parser.Walk(expr, visit)
+}
+
+// projection returns the fields to read when the rows go to a select
+// first, the ones it keeps and the ones the filters use
+func (p *plan) projection() []string {
+	if len(p.stages) == 0 {
+		return nil
+	}
+	sel, ok := p.stages[0].(*selectStage)
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	fields := make([]string, 0)
+	add := func(path string) {
+		root, _, _ := strings.Cut(path, ".")
+		if !seen[root] && root != "id" {
+			seen[root] = true
+			fields = append(fields, root)
+		}
+	}
+	for _, field := range sel.fields {
+		add(field)
+	}
+	for _, filter := range p.filters {
+		walkNames(filter.expr, add)
+	}
+	return fields
+}
+
+// sargs returns the conditions of the filters a scan can be bounded by
+func sargs(filters []queryFilter) []sarg {
+	var sargs []sarg
+	for _, filter := range filters {
+		for _, cond := range conjuncts(filter.expr) {
+			if a, ok := filter.sarg(cond); ok {
+				sargs = append(sargs, a)
+			}
+		}
+	}
+	return sargs
+}
+
+// conjuncts splits a && b && ... into its conditions
+func conjuncts(expr parser.Expr) []parser.Expr {
+	if b, ok := expr.(*parser.Binary); ok && b.Op == lexer.TokenAnd {
+		return append(conjuncts(b.Left), conjuncts(b.Right)...)
+	}
+	return []parser.Expr{expr}
+}
+
+// flipped is the operator of a comparison with its sides swapped
+var flipped = map[int]int{
+	lexer.TokenEqual:            lexer.TokenEqual,
+	lexer.TokenLessThan:         lexer.TokenGreaterThan,
+	lexer.TokenLessThanEqual:    lexer.TokenGreaterThanEqual,
+	lexer.TokenGreaterThan:      lexer.TokenLessThan,
+	lexer.TokenGreaterThanEqual: lexer.TokenLessThanEqual,
+}
+
+func (f queryFilter) sarg(cond parser.Expr) (sarg, bool) {
+	b, ok := cond.(*parser.Binary)
+	if !ok {
+		return sarg{}, false
+	}
+	if _, ok := flipped[b.Op]; !ok {
+		return sarg{}, false
+	}
+	field, value, op := b.Left, b.Right, b.Op
+	if _, ok := field.(*parser.Ident); !ok {
+		field, value, op = b.Right, b.Left, flipped[b.Op]
+	}
+	ident, ok := field.(*parser.Ident)
+	if !ok || !constant(value) {
+		return sarg{}, false
+	}
+	// the variable is used for the documents that don't have the field
+	if _, ok := f.sc.vars[ident.Name]; ok {
+		return sarg{}, false
+	}
+	v, err := f.sc.eval(value)
+	if err != nil || v.Type() == types.NullType {
+		return sarg{}, false
+	}
+	if _, err := storage.EncodeKey(nil, v); err != nil {
+		return sarg{}, false
+	}
+	return sarg{field: ident.Name, op: op, value: v, expr: cond}, true
+}
+
+// constant reports if expr has the same value for every document,
+// literals and params with operators
+func constant(expr parser.Expr) bool {
+	ok := true
+	parser.Walk(expr, func(e parser.Expr) bool {
+		switch e.(type) {
+		case *parser.NumberLit, *parser.StringLit, *parser.BoolLit, *parser.NullLit, *parser.Param,
+			*parser.Unary, *parser.Binary, *parser.ArrayLit, *parser.ObjectLit:
+			return ok
+		}
+		ok = false
+		return false
+	})
+	return ok
+}
+
+// typeRange returns the bounds of the keys of the numbers or of the
+// strings, a range on a field stays within the type of its values
+func typeRange(value types.Object) (lower, upper types.Object, ok bool) {
+	switch {
+	case types.IsNumeric(value.Type()):
+		return types.Float(math.Inf(-1)), types.String(""), true
+	case types.Comparable(value, types.String("")):
+		return types.String(""), types.Array{}, true
+	}
+	return nil, nil, false
+}
+
+// rangeOf returns the bounds the range conditions on field give a scan,
+// start is inclusive and end exclusive so > and <= are only checked by
+// the filters
+func rangeOf(sargs []sarg, field string) (start, end types.Object, bounds []sarg) {
+	var class types.Object
+	for _, a := range sargs {
+		if a.field != field || a.op == lexer.TokenEqual {
+			continue
+		}
+		lower, upper, ok := typeRange(a.value)
+		if !ok {
+			continue
+		}
+		if class == nil {
+			class, start, end = lower, lower, upper
+		} else if !types.Equal(class, lower) {
+			continue
+		}
+		switch a.op {
+		case lexer.TokenGreaterThan, lexer.TokenGreaterThanEqual:
+			if types.Compare(a.value, start) > 0 {
+				start = a.value
+			}
+		case lexer.TokenLessThan:
+			if types.Compare(a.value, end) < 0 {
+				end = a.value
+			}
+		}
+		bounds = append(bounds, a)
+	}
+	return start, end, bounds
+}
+
+// choose picks how to read the collection for the conditions of the
+// filters and the order_by the query starts with. with statistics it
+// picks the cheapest way, without them the one bounded by the most
+// conditions. a script reuses the choice for the queries of the same
+// text on the same collection, the scan is only bounded by the values of
+// this run
+func (p *plan) choose(s *storage.Snapshot) access {
+	sargs := sargs(p.filters)
+	fields, desc, ordered := p.q.sortFields()
+	encrypted := encryptedFields(p.q.coll)
+	stats := p.q.coll.Stats()
+	var indexes []storage.IndexInfo
+	// indexes created after the version of the snapshot are empty in it
+	if s.Version() == 0 {
+		indexes = p.q.coll.Indexes()
+	}
+	prog, key := p.q.program(), newPlanKey(p.q, stats)
+	if prog != nil {
+		if chosen, ok := prog.plans.Load(key); ok {
+			if a, ok := chosen.(*chosenAccess).reuse(stats, indexes, sargs, encrypted, fields, desc, ordered); ok {
+				return a
+			}
+		}
+	}
+	candidates := []access{primaryAccess(sargs, fields, desc, ordered)}
+	for _, index := range indexes {
+		if a, ok := indexAccess(index, sargs, encrypted, fields, desc, ordered); ok {
+			candidates = append(candidates, a)
+		}
+	}
+	best := candidates[0]
+	if stats == nil {
+		for _, a := range candidates[1:] {
+			if a.better(&best) {
+				best = a
+			}
+		}
+	} else {
+		e := newEstimator(p.q.coll, stats, float64(stats.Documents))
+		cost := e.cost(&best, p)
+		for _, a := range candidates[1:] {
+			if c := e.cost(&a, p); c < cost || c == cost && a.better(&best) {
+				best, cost = a, c
+			}
+		}
+	}
+	if prog != nil {
+		prog.plans.Store(key, &chosenAccess{index: best.opts.Index, stats: stats, indexes: indexNames(indexes)})
+	}
+	return best
+}
+
+// planKey identifies a query of a script for choose, programs are shared
+// by the sessions so the same text can read collections of different
+// databases, and a new analyze can change the choice
+type planKey struct {
+	db      string
+	version uint64
+	query   string
+}
+
+func newPlanKey(q *Query, stats *storage.Stats) planKey {
+	key := planKey{db: q.coll.Database().Dir(), query: q.String()}
+	if stats != nil {
+		key.version = stats.Version
+	}
+	return key
+}
+
+// chosenAccess is the index choose picked for a query of a script, or
+// the primary key, with the statistics and indexes it picked from
+type chosenAccess struct {
+	index   string
+	stats   *storage.Stats
+	indexes string
+}
+
+// reuse bounds a scan of the chosen index by the conditions of another
+// run, ok is false if the collection changed since or the index is no use
+func (c *chosenAccess) reuse(stats *storage.Stats, indexes []storage.IndexInfo, sargs []sarg, encrypted map[string]bool, fields []string, desc, ordered bool) (access, bool) {
+	if c.stats != stats || c.indexes != indexNames(indexes) {
+		return access{}, false
+	}
+	if c.index == "" {
+		return primaryAccess(sargs, fields, desc, ordered), true
+	}
+	for _, index := range indexes {
+		if index.Name == c.index {
+			return indexAccess(index, sargs, encrypted, fields, desc, ordered)
+		}
+	}
+	return access{}, false
+}
+
+func indexNames(indexes []storage.IndexInfo) string {
+	names := make([]string, len(indexes))
+	for i, index := range indexes {
+		names[i] = index.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func encryptedFields(coll *storage.Collection) map[string]bool {
+	encrypted := make(map[string]bool)
+	for _, f := range coll.EncryptedFields() {
+		encrypted[f.Field] = true
+	}
+	return encrypted
+}
+
+func primaryAccess(sargs []sarg, fields []string, desc, ordered bool) access {
+	for _, a := range sargs {
+		if a.field == "id" && a.op == lexer.TokenEqual {
+			opts := storage.ScanOptions{Prefix: []types.Object{a.value}}
+			return access{opts: opts, bounds: []sarg{a}, eq: 1, single: true, sorted: ordered}
+		}
+	}
+	var a access
+	if start, end, bounds := rangeOf(sargs, "id"); bounds != nil {
+		a.opts.Start, a.opts.End = []types.Object{start}, []types.Object{end}
+		a.bounds, a.ranged = bounds, true
+	}
+	if ordered && len(fields) == 1 && fields[0] == "id" {
+		a.opts.Reverse, a.sorted = desc, true
+	}
+	return a
+}
+
+// indexAccess bounds a scan of index by equalities on its first fields
+// and a range on the next one, ok is false if the index is no use
+func indexAccess(index storage.IndexInfo, sargs []sarg, encrypted map[string]bool, fields []string, desc, ordered bool) (a access, ok bool) {
+	a.opts.Index = index.Name
+	for _, field := range index.Fields {
+		i := findEqual(sargs, field)
+		if i < 0 {
+			break
+		}
+		a.opts.Prefix = append(a.opts.Prefix, sargs[i].value)
+		a.bounds = append(a.bounds, sargs[i])
+		a.eq++
+	}
+	a.single = index.Unique && a.eq == len(index.Fields)
+	// folded or encrypted values are not in the order of the values
+	inOrder := func(field string) bool {
+		return !index.CaseInsensitive && !encrypted[field]
+	}
+	if a.eq < len(index.Fields) && inOrder(index.Fields[a.eq]) {
+		if start, end, bounds := rangeOf(sargs, index.Fields[a.eq]); bounds != nil {
+			a.opts.Start, a.opts.End = []types.Object{start}, []types.Object{end}
+			a.bounds = append(a.bounds, bounds...)
+			a.ranged = true
+		}
+	}
+	if ordered {
+		// the entries of equal values are in the order of the ids
+		rest := append(append([]string{}, index.Fields[a.eq:]...), "id")
+		a.sorted = a.single || len(rest) >= len(fields)
+		for i := 0; a.sorted && i < len(fields); i++ {
+			a.sorted = rest[i] == fields[i] && inOrder(fields[i])
+		}
+		if a.sorted {
+			a.opts.Reverse = desc
+		}
+	}
+	return a, a.eq > 0 || a.ranged || a.sorted
+}
+
+func findEqual(sargs []sarg, field string) int {
+	for i, a := range sargs {
+		if a.field == field && a.op == lexer.TokenEqual {
+			return i
+		}
+	}
+	return -1
+}
+
+// run pushes the rows of the plan to out
+func (p *plan) run(s *storage.Snapshot, out sink) error {
+	ex := &execution{s: s}
+	defer func() {
+		for _, cleanup := range ex.cleanup {
+			cleanup()
+		}
+	}()
+	next := out
+	for i := len(p.stages) - 1; i >= 0; i-- {
+		var err error
+		if next, err = p.stages[i].open(ex, p.count(next, i+2)); err != nil {
+			return err
+		}
+	}
+	err := p.scan(s, p.count(next, 1))
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func (p *plan) scan(s *storage.Snapshot, next sink) error {
+	it, err := s.Scan(p.q.coll, p.opts)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() {
+		if p.actual != nil {
+			p.actual[0]++
+		}
+		doc := it.Document()
+		ok, err := p.match(doc)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := next.push(doc); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return next.done()
+}
+
+func (p *plan) match(doc types.Document) (bool, error) {
+	for _, filter := range p.filters {
+		ok, err := filter.match(doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// count counts the rows pushed to next in actual[i] when explaining
+func (p *plan) count(next sink, i int) sink {
+	if p.actual == nil {
+		return next
+	}
+	return &countSink{n: &p.actual[i], next: next}
+}
+
+type countSink struct {
+	n    *int64
+	next sink
+}
+
+func (c *countSink) push(row types.Document) error {
+	*c.n++
+	return c.next.push(row)
+}
+
+func (c *countSink) done() error {
+	return c.next.done()
+}
+
+// discard drops the rows pushed to it
+type discard struct{}
+
+func (discard) push(row types.Document) error { return nil }
+func (discard) done() error                   { return nil }
+
+// explain describes the plan after it ran, a line for the collection,
+// the scan, the filters and every stage with the rows it was expected to
+// produce and the rows it did
+func (p *plan) explain(e *estimator) string {
+	line := func(step string, est float64, actual int64) string {
+		rows := int64(math.Round(est))
+		if rows == 0 && est > 0 {
+			rows = 1
+		}
+		return fmt.Sprintf("%s (estimated %d, actual %d)", step, rows, actual)
+	}
+	lines := []string{fmt.Sprintf("collection %s: %d documents, never analyzed", p.q.coll.Name(), int64(e.n))}
+	if e.stats != nil {
+		lines[0] = fmt.Sprintf("collection %s: %d documents at version %d when analyzed", p.q.coll.Name(), e.stats.Documents, e.stats.Version)
+	}
+	est := e.access(&p.access)
+	lines = append(lines, line(p.describeScan(), est, p.actual[0]))
+	if len(p.filters) > 0 {
+		conds := make([]string, len(p.filters))
+		for i, filter := range p.filters {
+			conds[i] = filter.expr.String()
+		}
+		est *= e.residual(p.filters, p.bounds)
+		lines = append(lines, line("filter "+strings.Join(conds, " && "), est, p.actual[1]))
+	}
+	for i, st := range p.stages {
+		est = e.stage(st, est)
+		lines = append(lines, line(st.String(), est, p.actual[i+2]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *plan) describeScan() string {
+	s := "scan " + p.q.coll.Name()
+	switch {
+	case p.opts.Index != "":
+		s += " by index " + p.opts.Index
+	case len(p.bounds) > 0:
+		s += " by id"
+	}
+	if len(p.bounds) > 0 {
+		conds := make([]string, len(p.bounds))
+		for i, a := range p.bounds {
+			conds[i] = a.expr.String()
+		}
+		s += " where " + strings.Join(conds, " && ")
+	}
+	if p.q.asOf > 0 {
+		s += fmt.Sprintf(" as of %d", p.q.asOf)
+	}
+	if p.sorted {
+		s += " for " + p.q.stages[0].String()
+	}
+	if len(p.opts.Fields) > 0 {
+		s += " reading id, " + strings.Join(p.opts.Fields, ", ")
+	}
+	return s
+}
+
+// explain(q) runs a query and returns how it was run, a line for the
+// scan, the filters and every stage with the rows it was expected to
+// produce and the rows it did. an aggregate of a whole query like
+// explain(collection::t.filter(...).sum(amount)) is shown as a group_by()
+func builtinExplain(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("explain expects 1 argument, got %d", len(args))
+	}
+	value, err := explained(sc, args[0])
+	if err != nil {
+		return nil, err
+	}
+	q, err := toQuery("explain", value)
+	if err != nil {
+		return nil, errorfAt(args[0], "explain expects a query, got %s", typeName(value))
+	}
+	if q.none {
+		return types.String("nothing to read, " + q.String() + " is before the first commit"), nil
+	}
+	var text string
+	err = q.view(func(s *storage.Snapshot) error {
+		stats := q.coll.Stats()
+		var n int64
+		if stats != nil {
+			n = stats.Documents
+		} else {
+			var err error
+			if n, err = countDocuments(s, q.coll); err != nil {
+				return err
+			}
+		}
+		p := q.plan(s)
+		p.actual = make([]int64, len(p.stages)+2)
+		if err := p.run(s, discard{}); err != nil {
+			return err
+		}
+		text = p.explain(newEstimator(q.coll, stats, float64(n)))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return types.String(text), nil
+}
+
+// explained evaluates the argument of explain, an aggregate of a whole
+// query is added to a group_by() so the query is returned instead of run
+func explained(sc *scope, expr parser.Expr) (types.Object, error) {
+	call, ok := expr.(*parser.MethodCall)
+	if !ok {
+		return sc.eval(expr)
+	}
+	if _, agg := aggregateFuncs[call.Name]; !agg && call.Name != "aggregate" {
+		return sc.eval(expr)
+	}
+	recv, err := sc.eval(call.Recv)
+	if err != nil {
+		return nil, err
+	}
+	switch r := recv.(type) {
+	case *storage.Collection:
+		recv, err = methodGroupBy(sc, r, nil)
+	case *Query:
+		if r.lastGroup() == nil {
+			recv, err = methodGroupBy(sc, r, nil)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := methods[call.Name](sc, recv, call.Args)
+	if err != nil {
+		return nil, errorAt(call, err)
+	}
+	return value, nil
+}
+
+// countDocuments counts the documents of coll in s
+func countDocuments(s *storage.Snapshot, coll *storage.Collection) (int64, error) {
+	it, err := s.Scan(coll, storage.ScanOptions{KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	var n int64
+	for it.Next() {
+		n++
+	}
+	return n, it.Err()
+}
@@ -0,0 +1,413 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// Query is a read of a collection built by chaining methods like
+// collection::x.as_of(v).filter(...), nothing is read until the result is
+// needed, at the end of the script it is turned into an array
+type Query struct {
+	coll *storage.Collection
+	// version to read at, 0 for the latest
+	asOf uint64
+	// as_of a time before the first commit, nothing existed then
+	none    bool
+	filters []queryFilter
+	// what happens to the matching documents after the scan, like joins
+	stages []stage
+}
+
+// a filter keeps the scope it was written in so it can use the variables
+type queryFilter struct {
+	sc   *scope
+	expr parser.Expr
+}
+
+func (q *Query) Type() byte {
+	return types.CollectionType
+}
+
+func (q *Query) Value() interface{} {
+	return q
+}
+
+func (q *Query) String() string {
+	s := q.coll.String()
+	if q.asOf > 0 {
+		s += fmt.Sprintf(".as_of(%d)", q.asOf)
+	}
+	for _, filter := range q.filters {
+		s += ".filter(" + filter.expr.String() + ")"
+	}
+	for _, stage := range q.stages {
+		s += "." + stage.String()
+	}
+	return s
+}
+
+// a sink receives the rows of a query one at a time, done is called
+// after the last one
+type sink interface {
+	push(row types.Document) error
+	done() error
+}
+
+// a stage is a step of a query after the scan, rows are pushed through
+// the stages so they don't have to be in memory all at once
+type stage interface {
+	// open returns the sink of the stage for a run, the rows it produces
+	// go to next
+	open(ex *execution, next sink) (sink, error)
+	String() string
+}
+
+// execution is the state of a single run of a query
+type execution struct {
+	s *storage.Snapshot
+	// removes the temporary files of the run
+	cleanup []func()
+}
+
+// spill creates a temporary file that is removed at the end of the run
+func (ex *execution) spill(opts Options) (*spill, error) {
+	sp, err := newSpill(opts.TempDir)
+	if err != nil {
+		return nil, err
+	}
+	ex.cleanup = append(ex.cleanup, sp.remove)
+	return sp, nil
+}
+
+// rows collects the rows pushed to it
+type rows struct {
+	rows types.Array
+}
+
+func (r *rows) push(row types.Document) error {
+	r.rows = append(r.rows, row)
+	return nil
+}
+
+func (r *rows) done() error {
+	return nil
+}
+
+// toQuery starts a query on a collection or copies one, so every method
+// call makes a new query and the receiver can be reused
+func toQuery(name string, recv types.Object) (*Query, error) {
+	switch recv := recv.(type) {
+	case *storage.Collection:
+		return &Query{coll: recv}, nil
+	case *Query:
+		q := *recv
+		q.filters = append([]queryFilter{}, recv.filters...)
+		q.stages = append([]stage{}, recv.stages...)
+		return &q, nil
+	}
+	return nil, fmt.Errorf("%s can only be called on a collection, got %s", name, typeName(recv))
+}
+
+// program returns the compiled script the filters of the query were
+// written in, nil if there is none
+func (q *Query) program() *program {
+	for _, filter := range q.filters {
+		if filter.sc.prog != nil {
+			return filter.sc.prog
+		}
+	}
+	return nil
+}
+
+// view runs fn in a read transaction at the version of the query
+func (q *Query) view(fn func(s *storage.Snapshot) error) error {
+	return q.coll.Database().ViewAt(q.asOf, fn)
+}
+
+// run reads the documents the query selects
+func (q *Query) run() (types.Array, error) {
+	result := &rows{rows: make(types.Array, 0)}
+	if q.none {
+		return result.rows, nil
+	}
+	err := q.view(func(s *storage.Snapshot) error {
+		return q.plan(s).run(s, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.rows, nil
+}
+
+func (q *Query) match(doc types.Document) (bool, error) {
+	for _, filter := range q.filters {
+		ok, err := filter.match(doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (f queryFilter) match(row types.Document) (bool, error) {
+	value, err := f.sc.withDocument(row).evalCode(f.expr)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+// filterStage is a filter after another stage, it sees the rows that
+// stage produced
+type filterStage struct {
+	filter queryFilter
+}
+
+func (f *filterStage) open(ex *execution, next sink) (sink, error) {
+	return &filterSink{filter: f.filter, next: next}, nil
+}
+
+func (f *filterStage) String() string {
+	return "filter(" + f.filter.expr.String() + ")"
+}
+
+type filterSink struct {
+	filter queryFilter
+	next   sink
+}
+
+func (f *filterSink) push(row types.Document) error {
+	ok, err := f.filter.match(row)
+	if err != nil || !ok {
+		return err
+	}
+	return f.next.push(row)
+}
+
+func (f *filterSink) done() error {
+	return f.next.done()
+}
+
+// selectStage keeps only some fields of the rows
+type selectStage struct {
+	fields []string
+}
+
+func (sel *selectStage) String() string {
+	fields := make([]string, len(sel.fields))
+	for i, field := range sel.fields {
+		fields[i] = (&parser.StringLit{Value: field}).String()
+	}
+	return "select(" + strings.Join(fields, ", ") + ")"
+}
+
+func (sel *selectStage) open(ex *execution, next sink) (sink, error) {
+	return &selectSink{selectStage: sel, next: next}, nil
+}
+
+type selectSink struct {
+	*selectStage
+	next sink
+}
+
+func (ss *selectSink) push(row types.Document) error {
+	selected := make(types.Map, len(ss.fields))
+	for _, field := range ss.fields {
+		value, err := types.GetPath(row, field)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if err := types.SetPath(selected, field, value); err != nil {
+			return err
+		}
+	}
+	return ss.next.push(selected)
+}
+
+func (ss *selectSink) done() error {
+	return ss.next.done()
+}
+
+// resolve runs the value if it is a query, other values are returned as they are
+func resolve(value types.Object) (types.Object, error) {
+	if q, ok := value.(*Query); ok {
+		return q.run()
+	}
+	return value, nil
+}
+
+// x.as_of(v) reads the collection as it was at a version, v is a version
+// number like the ones version() returns or an RFC 3339 time
+func methodAsOf(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("as_of", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("as_of expects 1 argument, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	db := q.coll.Database()
+	if value.Type() == types.StringType {
+		t, err := time.Parse(time.RFC3339Nano, value.String())
+		if err != nil {
+			return nil, fmt.Errorf("as_of expects a version or an RFC 3339 time, got %s", value.String())
+		}
+		if q.asOf, err = db.VersionAt(t); err != nil {
+			return nil, err
+		}
+		q.none = q.asOf == 0
+		return q, nil
+	}
+	version, ok := types.ToInt64(value)
+	if !ok || version <= 0 {
+		return nil, fmt.Errorf("as_of expects a version or an RFC 3339 time, got %s", value.String())
+	}
+	if uint64(version) < db.OldestVersion() {
+		return nil, storage.ErrVersionNotRetained
+	}
+	q.asOf = uint64(version)
+	return q, nil
+}
+
+// x.filter(cond) keeps the documents cond is true for, the fields of the
+// document can be used as bare names in cond. after a join it filters the
+// joined rows
+func methodFilter(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("filter", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("filter expects 1 argument, got %d", len(args))
+	}
+	filter := queryFilter{sc: sc, expr: args[0]}
+	if len(q.stages) > 0 {
+		q.stages = append(q.stages, &filterStage{filter: filter})
+		return q, nil
+	}
+	q.filters = append(q.filters, filter)
+	return q, nil
+}
+
+// x.select('a', b.c, ...) keeps only these fields of the rows, the ones
+// a row doesn't have are left out. when it comes right after the filters
+// only these fields and the ones the filters use are read
+func methodSelect(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("select", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("select expects at least 1 argument")
+	}
+	sel := &selectStage{fields: make([]string, len(args))}
+	for i, arg := range args {
+		e := newRowExpr(sc, arg)
+		if e.field == "" {
+			return nil, errorfAt(arg, "select expects field names, got %s", arg.String())
+		}
+		sel.fields[i] = e.field
+	}
+	q.stages = append(q.stages, sel)
+	return q, nil
+}
+
+// x.get(id) returns the document with that id or null, filters of the
+// query apply to it too
+func methodGet(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	q, err := toQuery("get", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("get expects 1 argument, got %d", len(args))
+	}
+	if len(q.stages) > 0 {
+		return nil, fmt.Errorf("get can't be used after %s", q.stages[0].String())
+	}
+	id, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var result types.Object = types.Null{}
+	if q.none {
+		return result, nil
+	}
+	err = q.view(func(s *storage.Snapshot) error {
+		doc, err := s.Get(q.coll, id)
+		if err == storage.ErrDocumentNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ok, err := q.match(doc)
+		if ok {
+			result = doc
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// collection::x.history(id) lists the stored versions of a document from
+// the newest, as [{'version': v, 'deleted': bool, 'document': {...}}, ...].
+// how far back it goes depends on the retention of the database
+func methodHistory(sc *scope, recv types.Object, args []parser.Expr) (types.Object, error) {
+	coll, err := toCollection("history", recv)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) != 1 {
+		return nil, fmt.Errorf("history expects 1 argument, got %d", len(args))
+	}
+	id, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	entries, err := coll.History(id)
+	if err != nil {
+		return nil, err
+	}
+	result := make(types.Array, len(entries))
+	for i, entry := range entries {
+		doc := newDocument()
+		doc.Set([]byte("version"), types.Int64(entry.Version))
+		doc.Set([]byte("deleted"), types.Bool(entry.Deleted))
+		if entry.Document != nil {
+			doc.Set([]byte("document"), entry.Document)
+		} else {
+			doc.Set([]byte("document"), types.Null{})
+		}
+		result[i] = doc
+	}
+	return result, nil
+}
+
+// version() returns the current version of the selected database, it can
+// be given to as_of later on
+func builtinVersion(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("version expects no arguments, got %d", len(args))
+	}
+	if sc.session.db == nil {
+		return nil, ErrNoDatabase
+	}
+	return types.Int64(sc.session.db.CurrentVersion()), nil
+}
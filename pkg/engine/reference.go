@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// ref(collection::users, id) or ref('users', id) makes a reference to the
+// document with that id, the document doesn't have to exist yet
+func builtinRef(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("ref expects 2 arguments, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	switch v := value.(type) {
+	case *storage.Collection:
+		name = v.Name()
+	case types.String:
+		name = string(v)
+	default:
+		return nil, fmt.Errorf("ref expects a collection or its name, got %s", typeName(value))
+	}
+	id, err := sc.eval(args[1])
+	if err != nil {
+		return nil, err
+	}
+	return types.Reference{Collection: name, ID: id}, nil
+}
+
+// deref(r) returns the document a reference points to, or null if it
+// is null or the document doesn't exist
+func builtinDeref(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("deref expects 1 argument, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if value.Type() == types.NullType {
+		return value, nil
+	}
+	ref, ok := value.(types.Reference)
+	if !ok {
+		return nil, fmt.Errorf("deref expects a reference, got %s", typeName(value))
+	}
+	if sc.session.db == nil {
+		return nil, ErrNoDatabase
+	}
+	coll, err := sc.session.db.Collection(ref.Collection)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := coll.Get(ref.ID)
+	if err == storage.ErrDocumentNotFound {
+		return types.Null{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
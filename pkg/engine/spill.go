@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// spill is a temporary file of rows that didn't fit in the memory budget,
+// rows are written one after the other then read back in the same order
+type spill struct {
+	f *os.File
+	w *bufio.Writer
+	r *bufio.Reader
+	n int
+}
+
+func newSpill(dir string) (*spill, error) {
+	f, err := os.CreateTemp(dir, "terara-spill-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spill{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// each row is its marshaled length followed by the row
+func (s *spill) write(row types.Document) error {
+	b, err := types.MarshalObject(row)
+	if err != nil {
+		return err
+	}
+	var n [binary.MaxVarintLen64]byte
+	if _, err := s.w.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+// rewind ends the writes, the rows can be read from the first one
+func (s *spill) rewind() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.r = bufio.NewReader(s.f)
+	return nil
+}
+
+// read returns the next row, io.EOF after the last one. rows come back as
+// types.Map
+func (s *spill) read() (types.Document, error) {
+	size, err := binary.ReadUvarint(s.r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(s.r, b); err != nil {
+		return nil, err
+	}
+	row, _, err := types.UnmarshalMap(b)
+	return row, err
+}
+
+func (s *spill) remove() {
+	s.f.Close()
+	os.Remove(s.f.Name())
+}
+
+// objectSize is about how much memory a value takes, it is used to keep
+// track of the memory budget
+func objectSize(o types.Object) int64 {
+	switch v := o.(type) {
+	case types.String:
+		return 16 + int64(len(v))
+	case types.Email:
+		return 16 + int64(len(v))
+	case types.Phone:
+		return 16 + int64(len(v))
+	case types.Binary:
+		return 24 + int64(len(v))
+	case types.Reference:
+		return 32 + int64(len(v.Collection)) + objectSize(v.ID)
+	case types.Array:
+		size := int64(24)
+		for _, value := range v {
+			size += objectSize(value)
+		}
+		return size
+	case types.Document:
+		size := int64(48)
+		for _, key := range v.Keys() {
+			value, _ := v.Get(key)
+			size += 16 + int64(len(key))
+			if value != nil {
+				size += objectSize(value)
+			}
+		}
+		return size
+	}
+	return 16
+}
@@ -0,0 +1,76 @@
+package engine
+
+import (
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// run runs code in sc, the value left on the stack is the result
+func (sc *scope) run(c *code) (types.Object, error) {
+	stack := make([]types.Object, 0, c.depth)
+	for pc := 0; pc < len(c.instrs); pc++ {
+		in, node := c.instrs[pc], c.nodes[pc]
+		top := len(stack) - 1
+		var err error
+		switch in.op {
+		case opConst:
+			stack = append(stack, c.consts[in.arg])
+		case opParam, opEval, opLoad, opExec:
+			var value types.Object
+			switch in.op {
+			case opLoad:
+				value, err = sc.lookup(node.(*parser.Ident))
+			case opExec:
+				value, err = sc.exec(node.(parser.Stmt))
+			default:
+				value, err = sc.eval(node.(parser.Expr))
+			}
+			stack = append(stack, value)
+		case opLet:
+			sc.vars[node.(*parser.LetStmt).Name] = stack[top]
+		case opPop:
+			stack = stack[:top]
+		case opUnary:
+			stack[top], err = unaryOp(node.(*parser.Unary), stack[top])
+		case opBinary:
+			stack[top-1], err = binaryOp(in.arg, stack[top-1], stack[top])
+			if err != nil {
+				err = errorAt(node, err)
+			}
+			stack = stack[:top]
+		case opJumpFalse, opJumpTrue:
+			if truthy(stack[top]) == (in.op == opJumpTrue) {
+				stack[top] = types.Bool(in.op == opJumpTrue)
+				pc = in.arg - 1
+			} else {
+				stack = stack[:top]
+			}
+		case opTruthy:
+			stack[top] = types.Bool(truthy(stack[top]))
+		case opArray:
+			arr := make(types.Array, in.arg)
+			copy(arr, stack[len(stack)-in.arg:])
+			stack = append(stack[:len(stack)-in.arg], arr)
+		case opObject:
+			doc := newDocument()
+			values := stack[len(stack)-in.arg:]
+			for i, field := range node.(*parser.ObjectLit).Fields {
+				doc.Set([]byte(field.Key), values[i])
+			}
+			stack = append(stack[:len(stack)-in.arg], doc)
+		case opMember:
+			stack[top], err = member(node, stack[top], node.(*parser.Member).Name)
+		case opIndex:
+			stack[top-1], err = indexValue(node.(*parser.Index), stack[top-1], stack[top])
+			stack = stack[:top]
+		case opMethod:
+			stack[top], err = sc.callMethod(node.(*parser.MethodCall), stack[top])
+		case opPipe:
+			stack[top], err = sc.pipe(node.(*parser.Pipe), stack[top])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stack[len(stack)-1], nil
+}
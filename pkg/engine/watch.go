@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/noahmern/terara/pkg/parser"
+	"github.com/noahmern/terara/pkg/storage"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var changeKinds = map[int]string{
+	storage.ChangeInsert: "insert",
+	storage.ChangeUpdate: "update",
+	storage.ChangeDelete: "delete",
+}
+
+// Watch is the value of watch(...), the caller of the script reads the
+// changes from it with Next and Change and must close it
+type Watch struct {
+	stream *storage.ChangeStream
+	query  *Query
+	change types.Object
+	err    error
+}
+
+func (w *Watch) Type() byte {
+	return types.CollectionType
+}
+
+func (w *Watch) Value() interface{} {
+	return w
+}
+
+func (w *Watch) String() string {
+	return "watch(" + w.query.String() + ")"
+}
+
+// Next waits for the next change that matches the filters, a change
+// matches if the document matches before or after it
+func (w *Watch) Next() bool {
+	for w.err == nil && w.stream.Next() {
+		change := w.stream.Change()
+		ok, err := w.matches(change)
+		if err != nil {
+			w.err = err
+			return false
+		}
+		if ok {
+			w.change = changeDocument(change)
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watch) matches(change storage.Change) (bool, error) {
+	for _, doc := range []*storage.Document{change.After, change.Before} {
+		if doc == nil {
+			continue
+		}
+		ok, err := w.query.match(doc)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// Change returns the current change as
+// {'op': 'insert'|'update'|'delete', 'id': id, 'version': v, 'before': doc,
+// 'after': doc, 'token': '...'}, before and after can be null
+func (w *Watch) Change() types.Object {
+	return w.change
+}
+
+func (w *Watch) Err() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.stream.Err()
+}
+
+func (w *Watch) Close() {
+	w.stream.Close()
+}
+
+func changeDocument(change storage.Change) types.Object {
+	doc := newDocument()
+	doc.Set([]byte("op"), types.String(changeKinds[change.Kind]))
+	doc.Set([]byte("id"), change.ID)
+	doc.Set([]byte("version"), types.Int64(change.Version))
+	for name, value := range map[string]*storage.Document{"before": change.Before, "after": change.After} {
+		if value != nil {
+			doc.Set([]byte(name), value)
+		} else {
+			doc.Set([]byte(name), types.Null{})
+		}
+	}
+	doc.Set([]byte("token"), types.String(change.Token))
+	return doc
+}
+
+// watch(collection::x.filter(...)) follows the changes to a collection
+// from now on, watch(q, token) resumes after the change the token came
+// with. the changes are read from the returned value by the caller
+func builtinWatch(sc *scope, args []parser.Expr) (types.Object, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("watch expects 1 or 2 arguments, got %d", len(args))
+	}
+	value, err := sc.eval(args[0])
+	if err != nil {
+		return nil, err
+	}
+	q, err := toQuery("watch", value)
+	if err != nil {
+		return nil, err
+	}
+	if q.asOf > 0 || q.none {
+		return nil, fmt.Errorf("watch can't follow a query with as_of")
+	}
+	if len(q.stages) > 0 {
+		return nil, fmt.Errorf("watch can't follow a query with %s", q.stages[0].String())
+	}
+	token := ""
+	if len(args) == 2 {
+		value, err := sc.eval(args[1])
+		if err != nil {
+			return nil, err
+		}
+		if value.Type() != types.StringType {
+			return nil, fmt.Errorf("watch expects a token string, got %s", typeName(value))
+		}
+		token = value.String()
+	}
+	stream, err := q.coll.Watch(context.Background(), token)
+	if err != nil {
+		return nil, err
+	}
+	return &Watch{stream: stream, query: q}, nil
+}
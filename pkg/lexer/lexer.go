@@ -102,6 +102,11 @@ func (t Token) String() string {
 	return tokenNames[t.Type]
 }
 
+// returns the name of a token type
+func TokenName(typ int) string {
+	return tokenNames[typ]
+}
+
 func NewToken(typ int, value string, pos int) *Token {
 	return &Token{typ, value, pos}
 }
@@ -115,6 +120,11 @@ func NewLexer(input string) *Lexer {
 	return &Lexer{input, 0}
 }
 
+// returns the current offset in the input
+func (l *Lexer) Pos() int {
+	return l.pos
+}
+
 func (l *Lexer) NextToken() (*Token, error) {
 	l.consumeWhitespace()
 	if l.pos >= len(l.input) {
@@ -224,8 +234,12 @@ func (l *Lexer) consumeWhitespace() {
 	}
 }
 
+// returns the byte after the current one, or 0 at the end of the input
 func (l *Lexer) peek() byte {
-	return l.input[l.pos]
+	if l.pos+1 >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos+1]
 }
 
 func (l *Lexer) consume() byte {
@@ -0,0 +1,290 @@
+package parser
+
+import "strings"
+
+// Node is implemented by every node of the syntax tree
+type Node interface {
+	// returns the position of the node in the source
+	Position() int
+	String() string
+}
+
+// Expr is a node that produces a value
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Stmt is a node that is executed for its effect
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// Program is the root of a parsed script
+type Program struct {
+	Statements []Stmt
+}
+
+func (p *Program) String() string {
+	s := ""
+	for _, stmt := range p.Statements {
+		s += stmt.String() + ";\n"
+	}
+	return s
+}
+
+// let name = value
+type LetStmt struct {
+	Pos   int
+	Name  string
+	Value Expr
+}
+
+func (s *LetStmt) Position() int { return s.Pos }
+func (s *LetStmt) String() string {
+	return "let " + s.Name + " = " + s.Value.String()
+}
+func (s *LetStmt) stmtNode() {}
+
+// an expression evaluated for its side effects
+type ExprStmt struct {
+	Expr Expr
+}
+
+func (s *ExprStmt) Position() int  { return s.Expr.Position() }
+func (s *ExprStmt) String() string { return s.Expr.String() }
+func (s *ExprStmt) stmtNode()      {}
+
+// a number literal, the raw text is kept so the evaluator can pick the type
+type NumberLit struct {
+	Pos   int
+	Value string
+}
+
+func (e *NumberLit) Position() int  { return e.Pos }
+func (e *NumberLit) String() string { return e.Value }
+func (e *NumberLit) exprNode()      {}
+
+type StringLit struct {
+	Pos   int
+	Value string
+}
+
+func (e *StringLit) Position() int { return e.Pos }
+func (e *StringLit) String() string {
+	return "'" + strings.ReplaceAll(e.Value, "'", "\\'") + "'"
+}
+func (e *StringLit) exprNode() {}
+
+type BoolLit struct {
+	Pos   int
+	Value bool
+}
+
+func (e *BoolLit) Position() int { return e.Pos }
+func (e *BoolLit) String() string {
+	if e.Value {
+		return "true"
+	}
+	return "false"
+}
+func (e *BoolLit) exprNode() {}
+
+type NullLit struct {
+	Pos int
+}
+
+func (e *NullLit) Position() int  { return e.Pos }
+func (e *NullLit) String() string { return "null" }
+func (e *NullLit) exprNode()      {}
+
+// $name, or $name: type where param(...) declares it
+type Param struct {
+	Pos  int
+	Name string
+	// the declared type, empty if there is none
+	Type string
+}
+
+func (e *Param) Position() int { return e.Pos }
+func (e *Param) String() string {
+	if e.Type != "" {
+		return "$" + e.Name + ": " + e.Type
+	}
+	return "$" + e.Name
+}
+func (e *Param) exprNode() {}
+
+type Ident struct {
+	Pos  int
+	Name string
+}
+
+func (e *Ident) Position() int  { return e.Pos }
+func (e *Ident) String() string { return e.Name }
+func (e *Ident) exprNode()      {}
+
+// namespace::name, for example collection::transfers or document::new
+type Path struct {
+	Pos       int
+	Namespace string
+	Name      string
+}
+
+func (e *Path) Position() int  { return e.Pos }
+func (e *Path) String() string { return e.Namespace + "::" + e.Name }
+func (e *Path) exprNode()      {}
+
+// fn(args...)
+type Call struct {
+	Pos  int
+	Func Expr
+	Args []Expr
+}
+
+func (e *Call) Position() int { return e.Pos }
+func (e *Call) String() string {
+	return e.Func.String() + "(" + joinExprs(e.Args) + ")"
+}
+func (e *Call) exprNode() {}
+
+// recv.name(args...)
+type MethodCall struct {
+	Pos  int
+	Recv Expr
+	Name string
+	Args []Expr
+}
+
+func (e *MethodCall) Position() int { return e.Pos }
+func (e *MethodCall) String() string {
+	return e.Recv.String() + "." + e.Name + "(" + joinExprs(e.Args) + ")"
+}
+func (e *MethodCall) exprNode() {}
+
+// recv.name
+type Member struct {
+	Pos  int
+	Recv Expr
+	Name string
+}
+
+func (e *Member) Position() int  { return e.Pos }
+func (e *Member) String() string { return e.Recv.String() + "." + e.Name }
+func (e *Member) exprNode()      {}
+
+// recv[index]
+type Index struct {
+	Pos   int
+	Recv  Expr
+	Index Expr
+}
+
+func (e *Index) Position() int  { return e.Pos }
+func (e *Index) String() string { return e.Recv.String() + "[" + e.Index.String() + "]" }
+func (e *Index) exprNode()      {}
+
+// Op holds one of the lexer token types
+type Binary struct {
+	Pos   int
+	Op    int
+	Left  Expr
+	Right Expr
+}
+
+func (e *Binary) Position() int { return e.Pos }
+func (e *Binary) String() string {
+	return "(" + e.Left.String() + " " + opString(e.Op) + " " + e.Right.String() + ")"
+}
+func (e *Binary) exprNode() {}
+
+type Unary struct {
+	Pos     int
+	Op      int
+	Operand Expr
+}
+
+func (e *Unary) Position() int  { return e.Pos }
+func (e *Unary) String() string { return opString(e.Op) + e.Operand.String() }
+func (e *Unary) exprNode()      {}
+
+// operand++ or operand--
+type Postfix struct {
+	Pos     int
+	Op      int
+	Operand Expr
+}
+
+func (e *Postfix) Position() int  { return e.Pos }
+func (e *Postfix) String() string { return e.Operand.String() + opString(e.Op) }
+func (e *Postfix) exprNode()      {}
+
+// value | fn(args...) calls fn with value as its receiver or first
+// argument, Call is a *Call or an *Ident for fn without arguments
+type Pipe struct {
+	Pos   int
+	Value Expr
+	Call  Expr
+}
+
+func (e *Pipe) Position() int  { return e.Pos }
+func (e *Pipe) String() string { return e.Value.String() + " | " + e.Call.String() }
+func (e *Pipe) exprNode()      {}
+
+// expr asc or expr desc, only in the arguments of a call like order_by
+type Order struct {
+	Pos  int
+	Expr Expr
+	Desc bool
+}
+
+func (e *Order) Position() int { return e.Pos }
+func (e *Order) String() string {
+	if e.Desc {
+		return e.Expr.String() + " desc"
+	}
+	return e.Expr.String() + " asc"
+}
+func (e *Order) exprNode() {}
+
+type ArrayLit struct {
+	Pos      int
+	Elements []Expr
+}
+
+func (e *ArrayLit) Position() int  { return e.Pos }
+func (e *ArrayLit) String() string { return "[" + joinExprs(e.Elements) + "]" }
+func (e *ArrayLit) exprNode()      {}
+
+type Field struct {
+	Key   string
+	Value Expr
+}
+
+// {'key': value, ...}, fields keep their source order
+type ObjectLit struct {
+	Pos    int
+	Fields []Field
+}
+
+func (e *ObjectLit) Position() int { return e.Pos }
+func (e *ObjectLit) String() string {
+	s := "{"
+	for i, field := range e.Fields {
+		if i > 0 {
+			s += ", "
+		}
+		s += (&StringLit{Value: field.Key}).String() + ": " + field.Value.String()
+	}
+	return s + "}"
+}
+func (e *ObjectLit) exprNode() {}
+
+func joinExprs(exprs []Expr) string {
+	s := make([]string, len(exprs))
+	for i, expr := range exprs {
+		s[i] = expr.String()
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,436 @@
+package parser
+
+import (
+	"fmt"
+
+	"github.com/noahmern/terara/pkg/lexer"
+)
+
+var opStrings = map[int]string{
+	lexer.TokenPlus:             "+",
+	lexer.TokenMinus:            "-",
+	lexer.TokenAsterisk:         "*",
+	lexer.TokenSlash:            "/",
+	lexer.TokenDoubleSlash:      "//",
+	lexer.TokenDoubleAsterisk:   "**",
+	lexer.TokenPercent:          "%",
+	lexer.TokenBang:             "!",
+	lexer.TokenAnd:              "&&",
+	lexer.TokenOr:               "||",
+	lexer.TokenEqual:            "=",
+	lexer.TokenNotEqual:         "!=",
+	lexer.TokenLessThan:         "<",
+	lexer.TokenLessThanEqual:    "<=",
+	lexer.TokenGreaterThan:      ">",
+	lexer.TokenGreaterThanEqual: ">=",
+	lexer.TokenInc:              "++",
+	lexer.TokenDec:              "--",
+}
+
+func opString(op int) string {
+	return opStrings[op]
+}
+
+// Error is returned for any syntax error, Pos is the offset in the source
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+type Parser struct {
+	lexer *lexer.Lexer
+	tok   *lexer.Token
+}
+
+func NewParser(input string) *Parser {
+	return &Parser{lexer: lexer.NewLexer(input)}
+}
+
+// Parse parses a whole script
+func Parse(input string) (*Program, error) {
+	return NewParser(input).ParseProgram()
+}
+
+func (p *Parser) ParseProgram() (*Program, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	program := &Program{}
+	for p.tok.Type != lexer.TokenEOF {
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		program.Statements = append(program.Statements, stmt)
+		// the last statement doesn't need a semicolon
+		if p.tok.Type == lexer.TokenEOF {
+			break
+		}
+		if err := p.expect(lexer.TokenSemicolon); err != nil {
+			return nil, err
+		}
+	}
+	return program, nil
+}
+
+func (p *Parser) advance() error {
+	tok, err := p.lexer.NextToken()
+	if err != nil {
+		return &Error{p.lexer.Pos(), err.Error()}
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *Parser) errorf(format string, args ...interface{}) error {
+	return &Error{p.tok.Pos, fmt.Sprintf(format, args...)}
+}
+
+func (p *Parser) expect(typ int) error {
+	if p.tok.Type != typ {
+		return p.errorf("Expected %s, got %s", lexer.TokenName(typ), p.describe())
+	}
+	return p.advance()
+}
+
+func (p *Parser) describe() string {
+	if p.tok.Type == lexer.TokenEOF {
+		return "end of input"
+	}
+	return p.tok.String() + " '" + p.tok.Value + "'"
+}
+
+func (p *Parser) parseStatement() (Stmt, error) {
+	if p.tok.Type == lexer.TokenLet {
+		pos := p.tok.Pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.Type != lexer.TokenIdent {
+			return nil, p.errorf("Expected identifier after let, got %s", p.describe())
+		}
+		name := p.tok.Value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.Type != lexer.TokenEqual || p.tok.Value != "=" {
+			return nil, p.errorf("Expected = after let %s, got %s", name, p.describe())
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		value, err := p.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &LetStmt{Pos: pos, Name: name, Value: value}, nil
+	}
+	expr, err := p.ParseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &ExprStmt{Expr: expr}, nil
+}
+
+// binary operators from the lowest to the highest precedence
+var precedences = [][]int{
+	{lexer.TokenOr},
+	{lexer.TokenAnd},
+	{lexer.TokenEqual, lexer.TokenNotEqual, lexer.TokenLessThan, lexer.TokenLessThanEqual,
+		lexer.TokenGreaterThan, lexer.TokenGreaterThanEqual},
+	{lexer.TokenPlus, lexer.TokenMinus},
+	{lexer.TokenAsterisk, lexer.TokenSlash, lexer.TokenDoubleSlash, lexer.TokenPercent},
+}
+
+func (p *Parser) ParseExpr() (Expr, error) {
+	return p.parsePipe()
+}
+
+// | binds the loosest, a || b | f(x) is (a || b) | f(x)
+func (p *Parser) parsePipe() (Expr, error) {
+	left, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.Type == lexer.TokenPipe {
+		pos := p.tok.Pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		start := p.tok.Pos
+		call, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		switch fn := call.(type) {
+		case *Call:
+			if _, ok := fn.Func.(*Ident); !ok {
+				return nil, &Error{start, "Expected a function after |, got " + call.String()}
+			}
+		case *Ident:
+		default:
+			return nil, &Error{start, "Expected a function after |, got " + call.String()}
+		}
+		left = &Pipe{Pos: pos, Value: left, Call: call}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseBinary(level int) (Expr, error) {
+	if level == len(precedences) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for contains(precedences[level], p.tok.Type) {
+		op, pos := p.tok.Type, p.tok.Pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &Binary{Pos: pos, Op: op, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *Parser) parseUnary() (Expr, error) {
+	switch p.tok.Type {
+	case lexer.TokenBang, lexer.TokenMinus:
+		op, pos := p.tok.Type, p.tok.Pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Unary{Pos: pos, Op: op, Operand: operand}, nil
+	}
+	return p.parsePower()
+}
+
+// ** is right associative and binds tighter than unary minus on its left
+func (p *Parser) parsePower() (Expr, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.Type == lexer.TokenDoubleAsterisk {
+		pos := p.tok.Pos
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Binary{Pos: pos, Op: lexer.TokenDoubleAsterisk, Left: left, Right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *Parser) parsePostfix() (Expr, error) {
+	expr, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.tok.Type {
+		case lexer.TokenDot:
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.tok.Type != lexer.TokenIdent {
+				return nil, p.errorf("Expected name after ., got %s", p.describe())
+			}
+			name, pos := p.tok.Value, p.tok.Pos
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if p.tok.Type == lexer.TokenOpenParen {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				expr = &MethodCall{Pos: pos, Recv: expr, Name: name, Args: args}
+			} else {
+				expr = &Member{Pos: pos, Recv: expr, Name: name}
+			}
+		case lexer.TokenOpenParen:
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			expr = &Call{Pos: expr.Position(), Func: expr, Args: args}
+		case lexer.TokenOpenBracket:
+			pos := p.tok.Pos
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			index, err := p.ParseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(lexer.TokenCloseBracket); err != nil {
+				return nil, err
+			}
+			expr = &Index{Pos: pos, Recv: expr, Index: index}
+		case lexer.TokenInc, lexer.TokenDec:
+			expr = &Postfix{Pos: p.tok.Pos, Op: p.tok.Type, Operand: expr}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// parses (a, b, c), the current token must be the open paren. an
+// argument can be followed by asc or desc
+func (p *Parser) parseArgs() ([]Expr, error) {
+	return p.parseList(lexer.TokenOpenParen, lexer.TokenCloseParen)
+}
+
+func (p *Parser) parseList(open, close int) ([]Expr, error) {
+	if err := p.expect(open); err != nil {
+		return nil, err
+	}
+	exprs := make([]Expr, 0)
+	for p.tok.Type != close {
+		expr, err := p.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if close == lexer.TokenCloseParen && p.tok.Type == lexer.TokenIdent && (p.tok.Value == "asc" || p.tok.Value == "desc") {
+			expr = &Order{Pos: p.tok.Pos, Expr: expr, Desc: p.tok.Value == "desc"}
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		exprs = append(exprs, expr)
+		if p.tok.Type != lexer.TokenComma {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(close); err != nil {
+		return nil, err
+	}
+	return exprs, nil
+}
+
+func (p *Parser) parsePrimary() (Expr, error) {
+	tok := p.tok
+	switch tok.Type {
+	case lexer.TokenNumber:
+		return &NumberLit{Pos: tok.Pos, Value: tok.Value}, p.advance()
+	case lexer.TokenString:
+		return &StringLit{Pos: tok.Pos, Value: tok.Value}, p.advance()
+	case lexer.TokenBool:
+		return &BoolLit{Pos: tok.Pos, Value: tok.Value == "true"}, p.advance()
+	case lexer.TokenNull:
+		return &NullLit{Pos: tok.Pos}, p.advance()
+	case lexer.TokenParam:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		param := &Param{Pos: tok.Pos, Name: tok.Value}
+		if p.tok.Type != lexer.TokenColon {
+			return param, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.Type != lexer.TokenIdent {
+			return nil, p.errorf("Expected type after $%s:, got %s", tok.Value, p.describe())
+		}
+		param.Type = p.tok.Value
+		return param, p.advance()
+	case lexer.TokenIdent:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.Type != lexer.TokenDoubleColon {
+			return &Ident{Pos: tok.Pos, Name: tok.Value}, nil
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.Type != lexer.TokenIdent {
+			return nil, p.errorf("Expected name after %s::, got %s", tok.Value, p.describe())
+		}
+		name := p.tok.Value
+		return &Path{Pos: tok.Pos, Namespace: tok.Value, Name: name}, p.advance()
+	case lexer.TokenOpenParen:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		expr, err := p.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(lexer.TokenCloseParen)
+	case lexer.TokenOpenBracket:
+		elements, err := p.parseList(lexer.TokenOpenBracket, lexer.TokenCloseBracket)
+		if err != nil {
+			return nil, err
+		}
+		return &ArrayLit{Pos: tok.Pos, Elements: elements}, nil
+	case lexer.TokenOpenBrace:
+		return p.parseObject()
+	}
+	return nil, p.errorf("Unexpected %s", p.describe())
+}
+
+func (p *Parser) parseObject() (Expr, error) {
+	obj := &ObjectLit{Pos: p.tok.Pos}
+	if err := p.expect(lexer.TokenOpenBrace); err != nil {
+		return nil, err
+	}
+	for p.tok.Type != lexer.TokenCloseBrace {
+		// keys are strings or bare identifiers
+		if p.tok.Type != lexer.TokenString && p.tok.Type != lexer.TokenIdent {
+			return nil, p.errorf("Expected field name, got %s", p.describe())
+		}
+		key := p.tok.Value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(lexer.TokenColon); err != nil {
+			return nil, err
+		}
+		value, err := p.ParseExpr()
+		if err != nil {
+			return nil, err
+		}
+		obj.Fields = append(obj.Fields, Field{Key: key, Value: value})
+		if p.tok.Type != lexer.TokenComma {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	return obj, p.expect(lexer.TokenCloseBrace)
+}
+
+func contains(types []int, typ int) bool {
+	for _, t := range types {
+		if t == typ {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package parser
+
+// Walk calls fn for expr and, as long as fn returns true for an
+// expression, for the expressions inside it in source order
+func Walk(expr Expr, fn func(Expr) bool) {
+	if expr == nil || !fn(expr) {
+		return
+	}
+	switch e := expr.(type) {
+	case *Call:
+		Walk(e.Func, fn)
+		walkAll(e.Args, fn)
+	case *MethodCall:
+		Walk(e.Recv, fn)
+		walkAll(e.Args, fn)
+	case *Member:
+		Walk(e.Recv, fn)
+	case *Index:
+		Walk(e.Recv, fn)
+		Walk(e.Index, fn)
+	case *Binary:
+		Walk(e.Left, fn)
+		Walk(e.Right, fn)
+	case *Unary:
+		Walk(e.Operand, fn)
+	case *Postfix:
+		Walk(e.Operand, fn)
+	case *Pipe:
+		Walk(e.Value, fn)
+		Walk(e.Call, fn)
+	case *Order:
+		Walk(e.Expr, fn)
+	case *ArrayLit:
+		walkAll(e.Elements, fn)
+	case *ObjectLit:
+		for _, field := range e.Fields {
+			Walk(field.Value, fn)
+		}
+	}
+}
+
+func walkAll(exprs []Expr, fn func(Expr) bool) {
+	for _, expr := range exprs {
+		Walk(expr, fn)
+	}
+}
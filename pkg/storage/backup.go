@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ErrInvalidBackup    = errors.New("invalid backup")
+	ErrBackupChecksum   = errors.New("backup checksum mismatch")
+	ErrBackupOutOfOrder = errors.New("incremental backup doesn't follow the last restored backup, restore the previous backups first")
+	ErrDatabaseNotEmpty = errors.New("full backup must be restored in an empty database")
+)
+
+// a backup is a header, the badger backup stream of every key of the
+// database, catalog and indexes included, and a footer with the last
+// version in the backup and a sha256 of everything before it
+//
+//	"TRBK" format uvarint(since) stream... version(8) sha256(32)
+var backupMagic = []byte("TRBK")
+
+const (
+	backupFormat = 1
+	backupFooter = 8 + sha256.Size
+)
+
+// holds the last version of the last restored backup, an incremental
+// backup is only restored if its since is that version. it is a file next
+// to the database, a commit would move the version of the database the
+// change log is replayed from
+const restoredFile = "RESTORED"
+
+// Backup writes every version newer than since, 0 for a full backup. it
+// runs on a snapshot so the database can be used meanwhile. it returns the
+// last version written, the since of the next incremental backup
+func (d *Database) Backup(w io.Writer, since uint64) (uint64, error) {
+	if !d.IsOpen() {
+		return 0, ErrDatabaseClosed
+	}
+	sum := sha256.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, sum)
+	header := append([]byte{}, backupMagic...)
+	header = append(header, backupFormat)
+	header = binary.AppendUvarint(header, since)
+	if _, err := out.Write(header); err != nil {
+		return 0, err
+	}
+	stream := d.db.NewStream()
+	stream.LogPrefix = "Backup"
+	stream.SinceTs = since
+	// the probes of the change streams are not data
+	stream.ChooseKey = func(item *badger.Item) bool {
+		return !bytes.HasPrefix(item.Key(), []byte(probePrefix))
+	}
+	version, err := stream.Backup(out, since)
+	if err != nil {
+		return 0, err
+	}
+	// badger reads the versions after since even if its doc says from
+	// since on, the version it returns is the since of the next backup
+	if version < since {
+		// nothing changed since the last backup
+		version = since
+	}
+	footer := binary.BigEndian.AppendUint64(nil, version)
+	if _, err := out.Write(footer); err != nil {
+		return 0, err
+	}
+	if _, err := bw.Write(sum.Sum(nil)); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Restore loads a backup made by Backup, a full backup is restored in an
+// empty database and incremental ones after it in the order they were
+// made. the backup is verified before anything is written. it waits for
+// the running transactions and stops the background work of the database
+// while it loads, see exclusive. collections must be looked up again
+// after a restore
+func (d *Database) Restore(r io.Reader) error {
+	if !d.IsOpen() {
+		return ErrDatabaseClosed
+	}
+	// the checksum is at the end, keep the backup aside until it is verified
+	f, err := os.CreateTemp(d.path, ".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	since, version, start, err := verifyBackup(f, size)
+	if err != nil {
+		return err
+	}
+	return d.exclusive(func() error {
+		if err := d.checkRestore(since); err != nil {
+			return err
+		}
+		stream := io.NewSectionReader(f, start, size-start-backupFooter)
+		if err := d.db.Load(stream, 256); err != nil {
+			return err
+		}
+		if err := writeRestored(d.path, version); err != nil {
+			return err
+		}
+		return d.catalog.Init()
+	})
+}
+
+// checkRestore checks that a full backup goes in an empty database and an
+// incremental one right after the last restored backup
+func (d *Database) checkRestore(since uint64) error {
+	if since > 0 {
+		restored, err := os.ReadFile(filepath.Join(d.path, restoredFile))
+		if os.IsNotExist(err) {
+			return ErrBackupOutOfOrder
+		}
+		if err != nil {
+			return err
+		}
+		if len(restored) != 8 || binary.BigEndian.Uint64(restored) != since {
+			return ErrBackupOutOfOrder
+		}
+		return nil
+	}
+	return d.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !bytes.HasPrefix(it.Item().Key(), []byte(probePrefix)) {
+				return ErrDatabaseNotEmpty
+			}
+		}
+		return nil
+	})
+}
+
+// writeRestored records the version of a restored backup through a synced
+// temporary file, like writeKeyCheck
+func writeRestored(dir string, version uint64) error {
+	tmp := filepath.Join(dir, restoredFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(binary.BigEndian.AppendUint64(nil, version))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, restoredFile))
+}
+
+// verifyBackup checks the checksum of a backup and returns its since, its
+// last version and where the badger stream starts
+func verifyBackup(f *os.File, size int64) (uint64, uint64, int64, error) {
+	if size < int64(len(backupMagic))+2+backupFooter {
+		return 0, 0, 0, ErrInvalidBackup
+	}
+	header := make([]byte, len(backupMagic)+1+binary.MaxVarintLen64)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0, 0, 0, err
+	}
+	if !bytes.Equal(header[:len(backupMagic)], backupMagic) || header[len(backupMagic)] != backupFormat {
+		return 0, 0, 0, ErrInvalidBackup
+	}
+	since, n := binary.Uvarint(header[len(backupMagic)+1:])
+	if n <= 0 {
+		return 0, 0, 0, ErrInvalidBackup
+	}
+	start := int64(len(backupMagic) + 1 + n)
+	if start > size-backupFooter {
+		return 0, 0, 0, ErrInvalidBackup
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, io.NewSectionReader(f, 0, size-sha256.Size)); err != nil {
+		return 0, 0, 0, err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := f.ReadAt(expected, size-sha256.Size); err != nil {
+		return 0, 0, 0, err
+	}
+	if !bytes.Equal(sum.Sum(nil), expected) {
+		return 0, 0, 0, ErrBackupChecksum
+	}
+	footer := make([]byte, 8)
+	if _, err := f.ReadAt(footer, size-backupFooter); err != nil {
+		return 0, 0, 0, err
+	}
+	return since, binary.BigEndian.Uint64(footer), start, nil
+}
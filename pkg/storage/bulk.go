@@ -0,0 +1,290 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrBulkLoaderDone = errors.New("bulk loader already flushed or cancelled")
+)
+
+// BulkError is a document a bulk load rejected
+type BulkError struct {
+	// position of the document in the input
+	Index int
+	ID    types.Object
+	Err   error
+}
+
+func (e BulkError) Error() string {
+	if e.ID == nil {
+		return fmt.Sprintf("document %d: %s", e.Index, e.Err.Error())
+	}
+	return fmt.Sprintf("document %d (id %s): %s", e.Index, e.ID.String(), e.Err.Error())
+}
+
+func (e BulkError) Unwrap() error {
+	return e.Err
+}
+
+type BulkResult struct {
+	Inserted int
+	Errors   []BulkError
+}
+
+// BulkLoader inserts many documents through a badger WriteBatch, the index
+// entries are written in the same batch. writes are not transactional: a
+// document is rejected if its id is already stored or was already added,
+// but concurrent writers to the same ids are not detected. foreign keys
+// are checked against the stored documents only.
+//
+// badger's StreamWriter is not used because preparing it drops the whole
+// database, not only the collection
+type BulkLoader struct {
+	coll    *Collection
+	wb      *badger.WriteBatch
+	indexes []IndexInfo
+	// encrypted fields when the load started
+	encrypted []*EncryptedField
+
+	// the collection was empty when the load started, so only the ids
+	// added by this load can collide
+	empty bool
+	seen  map[string]struct{}
+	// the unique index entries added by this load and their ids
+	unique map[string][]byte
+
+	// every document of the load gets the same creation time
+	now time.Time
+
+	count  int
+	result BulkResult
+	done   bool
+}
+
+func (c *Collection) NewBulkLoader() (*BulkLoader, error) {
+	if _, ok := c.Capped(); ok {
+		return nil, ErrCappedCollection
+	}
+	empty, err := c.isEmpty()
+	if err != nil {
+		return nil, err
+	}
+	// a restore waits for the load to be flushed or cancelled. the reads
+	// of the loader go to badger directly, entering again would fail
+	// while a restore waits and fail documents instead of the load
+	if err := c.db.enter(); err != nil {
+		return nil, err
+	}
+	return &BulkLoader{
+		coll:      c,
+		wb:        c.db.db.NewWriteBatch(),
+		indexes:   c.Indexes(),
+		encrypted: c.encryptedFields(),
+		empty:     empty,
+		seen:      make(map[string]struct{}),
+		unique:    make(map[string][]byte),
+		now:       time.Now(),
+	}, nil
+}
+
+func (c *Collection) isEmpty() (bool, error) {
+	empty := true
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = documentKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// Add queues a document. a document that can't be inserted is recorded in
+// the result and doesn't stop the load, the returned error means the
+// batch itself failed
+func (l *BulkLoader) Add(doc *Document) error {
+	if l.done {
+		return ErrBulkLoaderDone
+	}
+	index := l.count
+	l.count++
+	if err := l.add(doc); err != nil {
+		if err := l.wb.Error(); err != nil {
+			return err
+		}
+		l.result.Errors = append(l.result.Errors, BulkError{Index: index, ID: doc.ID(), Err: err})
+		return nil
+	}
+	l.result.Inserted++
+	return nil
+}
+
+func (l *BulkLoader) add(doc *Document) error {
+	if doc.ID() == nil {
+		return types.ErrInvalidDocument
+	}
+	key, err := l.coll.key(doc.ID())
+	if err != nil {
+		return err
+	}
+	if _, ok := l.seen[string(key)]; ok {
+		return ErrDocumentExists
+	}
+	if !l.empty {
+		exists, err := l.exists(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrDocumentExists
+		}
+	}
+	markers, err := l.checkReferences(doc)
+	if err != nil {
+		return err
+	}
+	b, err := l.coll.encode(doc, nextMeta(nil, l.now), l.encrypted)
+	if err != nil {
+		return err
+	}
+	expires, err := l.coll.expiry(doc, l.now)
+	if err != nil {
+		return err
+	}
+	ttl := expiresAt(expires)
+	id := key[len(documentKeyPrefix(l.coll.name)):]
+	// build every entry before writing so a bad document writes nothing
+	entries := make([][]byte, 0, len(l.indexes))
+	for i := range l.indexes {
+		entry, unique, err := l.coll.indexKey(&l.indexes[i], l.encrypted, doc)
+		if err != nil {
+			return err
+		}
+		if unique {
+			if err := l.checkUnique(&l.indexes[i], entry); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for i, entry := range entries {
+		if l.indexes[i].Unique {
+			l.unique[string(entry)] = id
+		}
+		if err := l.wb.SetEntry(newEntry(entry, id, ttl)); err != nil {
+			return err
+		}
+	}
+	if err := l.wb.SetEntry(newEntry(key, b, ttl)); err != nil {
+		return err
+	}
+	l.coll.db.expiries.add(ttl)
+	for _, marker := range markers {
+		if err := l.wb.Set(marker, nil); err != nil {
+			return err
+		}
+	}
+	l.seen[string(key)] = struct{}{}
+	return nil
+}
+
+// checkUnique looks for the entry of a unique index among the documents of
+// the load and, like exists, the stored ones
+func (l *BulkLoader) checkUnique(index *IndexInfo, entry []byte) error {
+	if id, ok := l.unique[string(entry)]; ok {
+		return uniqueViolation(l.coll.name, index, entry, id)
+	}
+	if l.empty {
+		return nil
+	}
+	return l.coll.db.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(entry)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		id, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		return uniqueViolation(l.coll.name, index, entry, id)
+	})
+}
+
+// checkReferences checks the foreign keys of doc against the stored
+// documents, the documents of the load are not written yet so they can't
+// be referenced
+func (l *BulkLoader) checkReferences(doc *Document) ([][]byte, error) {
+	if len(l.coll.ForeignKeys()) == 0 {
+		return nil, nil
+	}
+	var markers [][]byte
+	err := l.coll.db.db.View(func(txn *badger.Txn) error {
+		var err error
+		markers, err = l.coll.checkReferences(txn, nil, doc)
+		return err
+	})
+	return markers, err
+}
+
+func (l *BulkLoader) exists(key []byte) (bool, error) {
+	exists := false
+	err := l.coll.db.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	return exists, err
+}
+
+// Flush writes everything that was added and returns the result
+func (l *BulkLoader) Flush() (*BulkResult, error) {
+	if l.done {
+		return nil, ErrBulkLoaderDone
+	}
+	l.done = true
+	defer l.coll.db.leave()
+	if err := l.wb.Flush(); err != nil {
+		return nil, err
+	}
+	return &l.result, nil
+}
+
+// Cancel drops the documents that were not written yet
+func (l *BulkLoader) Cancel() {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.wb.Cancel()
+	l.coll.db.leave()
+}
+
+// BulkInsert inserts all the documents with a BulkLoader
+func (c *Collection) BulkInsert(docs []*Document) (*BulkResult, error) {
+	l, err := c.NewBulkLoader()
+	if err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		if err := l.Add(doc); err != nil {
+			l.Cancel()
+			return nil, err
+		}
+	}
+	return l.Flush()
+}
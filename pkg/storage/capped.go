@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrInvalidCap       = errors.New("a capped collection needs a maximum document count or size")
+	ErrDocumentTooLarge = errors.New("document is larger than the capped collection")
+	ErrCappedCollection = errors.New("not supported on capped collections")
+	ErrNotCapped        = errors.New("collection is not capped")
+)
+
+// Capped limits a collection to a number of documents or a size in bytes
+// of the stored documents, indexes not counted. when a write goes over a
+// limit the oldest documents in insertion order are deleted in the same
+// transaction, so the change streams see them as deletes
+type Capped struct {
+	MaxDocs  int64 `json:"max_docs,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+func (c Capped) over(count, bytes int64) bool {
+	return c.MaxDocs > 0 && count > c.MaxDocs || c.MaxBytes > 0 && bytes > c.MaxBytes
+}
+
+// prefixes of the entries of capped collections
+const (
+	// q/<collection>/<seq> is the insertion order, the value is the id
+	orderPrefix = "q/"
+	// n/<collection> holds the next sequence, the count and the size
+	cappedStatePrefix = "n/"
+)
+
+func orderKeyPrefix(coll string) []byte {
+	return []byte(orderPrefix + coll + "/")
+}
+
+func cappedStateKey(coll string) []byte {
+	return []byte(cappedStatePrefix + coll)
+}
+
+// the state is a single key so concurrent writers to a capped collection
+// conflict and one of them retries, like appends to a log
+type cappedState struct {
+	next  uint64
+	count int64
+	bytes int64
+}
+
+// CreateCapped creates a collection that keeps at most capped.MaxDocs
+// documents and capped.MaxBytes bytes, 0 for no limit
+func (c *Catalog) CreateCapped(name string, capped Capped) (*Collection, error) {
+	if capped.MaxDocs < 0 || capped.MaxBytes < 0 || capped.MaxDocs == 0 && capped.MaxBytes == 0 {
+		return nil, ErrInvalidCap
+	}
+	return c.create(&CollectionInfo{Name: name, Capped: &capped})
+}
+
+func (d *Database) CreateCappedCollection(name string, capped Capped) (*Collection, error) {
+	if !d.IsOpen() {
+		return nil, ErrDatabaseClosed
+	}
+	return d.catalog.CreateCapped(name, capped)
+}
+
+// Capped returns the limits of a capped collection, ok is false if the
+// collection is not capped
+func (c *Collection) Capped() (Capped, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.info.Capped == nil {
+		return Capped{}, false
+	}
+	return *c.info.Capped, true
+}
+
+// Usage returns how many documents a capped collection holds and their
+// size in bytes
+func (c *Collection) Usage() (count, size int64, err error) {
+	if _, ok := c.Capped(); !ok {
+		return 0, 0, ErrNotCapped
+	}
+	err = c.db.View(func(txn *badger.Txn) error {
+		st, err := c.cappedState(txn)
+		count, size = st.count, st.bytes
+		return err
+	})
+	return count, size, err
+}
+
+func (c *Collection) cappedState(txn *badger.Txn) (cappedState, error) {
+	st := cappedState{next: 1}
+	item, err := txn.Get(cappedStateKey(c.name))
+	if err == badger.ErrKeyNotFound {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = item.Value(func(val []byte) error {
+		var n [3]int
+		st.next, n[0] = binary.Uvarint(val)
+		if n[0] > 0 {
+			st.count, n[1] = binary.Varint(val[n[0]:])
+		}
+		if n[0] > 0 && n[1] > 0 {
+			st.bytes, n[2] = binary.Varint(val[n[0]+n[1]:])
+		}
+		if n[0] <= 0 || n[1] <= 0 || n[2] <= 0 {
+			return ErrInvalidKey
+		}
+		return nil
+	})
+	return st, err
+}
+
+func (c *Collection) saveCappedState(txn *badger.Txn, st cappedState) error {
+	b := binary.AppendUvarint(nil, st.next)
+	b = binary.AppendVarint(b, st.count)
+	b = binary.AppendVarint(b, st.bytes)
+	return txn.Set(cappedStateKey(c.name), b)
+}
+
+func (c *Collection) orderKey(seq uint64) ([]byte, error) {
+	return EncodeKey(orderKeyPrefix(c.name), types.Int64(seq))
+}
+
+// capInsert gives a new document of a capped collection its place in the
+// insertion order, replaced documents keep theirs
+func (c *Collection) capInsert(txn *badger.Txn, old *Document, meta *Meta) (*cappedState, error) {
+	st, err := c.cappedState(txn)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		meta.Seq = st.next
+		st.next++
+		st.count++
+	}
+	return &st, nil
+}
+
+// capWrite accounts for a document of size bytes saved under key and
+// evicts the oldest documents while the collection is over its limits
+func (c *Collection) capWrite(txn *badger.Txn, capped Capped, st *cappedState, key []byte, old *Document, meta Meta, size int) error {
+	if capped.MaxBytes > 0 && int64(size) > capped.MaxBytes {
+		return ErrDocumentTooLarge
+	}
+	st.bytes += int64(size)
+	if old != nil {
+		st.bytes -= int64(old.size)
+	} else {
+		order, err := c.orderKey(meta.Seq)
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(order, key[len(documentKeyPrefix(c.name)):]); err != nil {
+			return err
+		}
+	}
+	if capped.over(st.count, st.bytes) {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = orderKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		// the deletes below are pending writes of txn, collect the keys
+		// first so the iterator doesn't walk over its own changes
+		evict := make([][]byte, 0)
+		count, bytes := st.count, st.bytes
+		for it.Rewind(); it.Valid() && capped.over(count, bytes); it.Next() {
+			id, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			docKey := append(documentKeyPrefix(c.name), id...)
+			// a replaced document can be the oldest, it stays
+			if string(docKey) == string(key) {
+				continue
+			}
+			doc, err := c.load(txn, docKey)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if doc == nil {
+				continue
+			}
+			evict = append(evict, docKey)
+			count--
+			bytes -= int64(doc.size)
+		}
+		it.Close()
+		for _, docKey := range evict {
+			doc, err := c.load(txn, docKey)
+			if err != nil {
+				return err
+			}
+			if err := c.remove(txn, docKey, doc, st); err != nil {
+				return err
+			}
+		}
+	}
+	return c.saveCappedState(txn, *st)
+}
+
+// capDelete removes a document from the insertion order
+func (c *Collection) capDelete(txn *badger.Txn, old *Document, st *cappedState) error {
+	order, err := c.orderKey(old.meta.Seq)
+	if err != nil {
+		return err
+	}
+	st.count--
+	st.bytes -= int64(old.size)
+	return txn.Delete(order)
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var (
+	ErrCollectionNotFound = errors.New("collection not found")
+	ErrCollectionExists   = errors.New("collection already exists")
+	ErrIndexNotFound      = errors.New("index not found")
+	ErrIndexExists        = errors.New("index already exists")
+	ErrDatabaseClosed     = errors.New("database closed")
+	ErrDatabaseBusy       = errors.New("database is being restored")
+)
+
+// CollectionInfo is what the catalog stores about a collection
+type CollectionInfo struct {
+	Name    string       `json:"name"`
+	Indexes []*IndexInfo `json:"indexes,omitempty"`
+	// fields stored encrypted, see Collection.EncryptField
+	Encrypted []*EncryptedField `json:"encrypted,omitempty"`
+	// how long documents live after they are saved, 0 to keep them
+	TTL time.Duration `json:"ttl,omitempty"`
+	// limits of a capped collection, nil if it is not capped
+	Capped *Capped `json:"capped,omitempty"`
+	// fields that reference other collections
+	ForeignKeys []*ForeignKey `json:"foreign_keys,omitempty"`
+	// what the last Analyze found, nil if it never ran
+	Stats *Stats `json:"stats,omitempty"`
+}
+
+// IndexInfo describes a secondary index over one or more fields
+type IndexInfo struct {
+	Name            string   `json:"name"`
+	Fields          []string `json:"fields"`
+	Unique          bool     `json:"unique,omitempty"`
+	CaseInsensitive bool     `json:"case_insensitive,omitempty"`
+}
+
+// Catalog keeps track of the collections of a database and their indexes,
+// everything is loaded in memory when the database is opened
+type Catalog struct {
+	db *Database
+
+	mu    sync.RWMutex
+	colls map[string]*Collection
+}
+
+func NewCatalog(db *Database) *Catalog {
+	return &Catalog{
+		db:    db,
+		colls: make(map[string]*Collection),
+	}
+}
+
+// Init loads the catalog from the database
+func (c *Catalog) Init() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.colls = make(map[string]*Collection)
+	return c.db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(catalogPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var info CollectionInfo
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &info)
+			})
+			if err != nil {
+				return err
+			}
+			c.colls[info.Name] = newCollection(&info, c.db)
+		}
+		return nil
+	})
+}
+
+func (c *Catalog) Get(name string) (*Collection, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	coll, ok := c.colls[name]
+	if !ok {
+		return nil, ErrCollectionNotFound
+	}
+	return coll, nil
+}
+
+// Names returns the sorted names of all the collections
+func (c *Catalog) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.colls))
+	for name := range c.colls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Catalog) Create(name string) (*Collection, error) {
+	return c.create(&CollectionInfo{Name: name})
+}
+
+func (c *Catalog) create(info *CollectionInfo) (*Collection, error) {
+	name := info.Name
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.colls[name]; ok {
+		return nil, ErrCollectionExists
+	}
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	coll := newCollection(info, c.db)
+	c.colls[name] = coll
+	return coll, nil
+}
+
+// Drop deletes a collection with all its documents and indexes
+func (c *Catalog) Drop(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.colls[name]; !ok {
+		return ErrCollectionNotFound
+	}
+	for other, coll := range c.colls {
+		for _, fk := range coll.ForeignKeys() {
+			if fk.Collection == name && other != name {
+				return fmt.Errorf("%w: %s has a foreign key %s to %s", ErrReferenced, other, fk.Field, name)
+			}
+		}
+	}
+	// the drop and the catalog delete both run under the gate, so a
+	// restore can't swap the database in between
+	if err := c.db.enter(); err != nil {
+		return err
+	}
+	defer c.db.leave()
+	err := c.db.dropPrefix(documentKeyPrefix(name), []byte(indexPrefix+name+"/"), orderKeyPrefix(name), referenceKeyPrefix(name))
+	if err != nil {
+		return err
+	}
+	err = c.db.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(cappedStateKey(name)); err != nil {
+			return err
+		}
+		return txn.Delete(catalogKey(name))
+	})
+	if err != nil {
+		return err
+	}
+	delete(c.colls, name)
+	return nil
+}
+
+func saveCollectionInfo(txn *badger.Txn, info *CollectionInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return txn.Set(catalogKey(info.Name), b)
+}
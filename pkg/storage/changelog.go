@@ -0,0 +1,790 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+)
+
+var (
+	ErrInvalidChangeLog = errors.New("invalid change log")
+	ErrChangeLogGap     = errors.New("the change log starts after the version of the database")
+	ErrRecoveryTime     = errors.New("the commit time at the recovery target is not known, recover to a version")
+)
+
+// the change log records every commit of a database, documents with their
+// index entries and the catalog, in segment files kept outside of the
+// database. replayed over a backup it brings the database to any commit
+// made after the backup. a segment is
+//
+//	"TRCL" format base(8) record...
+//
+// where base is the last version logged before the segment and a record
+// is a length(4), the record and a crc32(4) of it
+var changeLogMagic = []byte("TRCL")
+
+const (
+	changeLogFormat = 1
+	// a new segment is started when the current one grows past this
+	changeLogSegmentSize = 64 << 20
+	changeLogHeader      = 4 + 1 + 8
+)
+
+// kinds of records
+const (
+	logCommit byte = iota + 1
+	// the drop of key prefixes, made when a collection or an index is
+	// dropped, it happens after the commit with the same version
+	logDrop
+	// the commits that follow up to its version were read back from the
+	// stored versions, they were made after its time but are stamped with
+	// the time they were logged
+	logCatchUp
+)
+
+// the delete bit of badger's value meta, the backup stream uses it for
+// deletions and Load expects it. the subscription doesn't have it, the
+// meta of its entries is the user meta, see receive
+const badgerBitDelete byte = 1
+
+type logRecord struct {
+	kind    byte
+	version uint64
+	time    time.Time
+	// for a commit
+	entries []logEntry
+	// for a drop
+	prefixes [][]byte
+}
+
+type logEntry struct {
+	key       []byte
+	value     []byte
+	deleted   bool
+	expiresAt uint64
+}
+
+// changeLog writes the change log of an open database. the commits come
+// from a badger subscription, the ones it misses while it starts are read
+// back from the stored versions. the subscription only queues them,
+// badger holds the writes back while it runs, a writer logs the queue and
+// syncs the file once for everything it took
+type changeLog struct {
+	db  *Database
+	dir string
+
+	qmu    sync.Mutex
+	queue  []*pb.KV
+	signal chan struct{}
+	stop   chan struct{}
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	// last version logged and the time of the last record
+	last     uint64
+	lastTime time.Time
+	// the log stops at the first write error
+	err error
+
+	cancel     context.CancelFunc
+	subscribed sync.WaitGroup
+	wg         sync.WaitGroup
+}
+
+func openChangeLog(db *Database, dir string) (*changeLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	l := &changeLog{db: db, dir: dir, signal: make(chan struct{}, 1), stop: make(chan struct{})}
+	segments, err := changeLogSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		// the log starts now, a backup made from here on can be rolled forward
+		if err := l.startSegment(db.db.MaxVersion()); err != nil {
+			return nil, err
+		}
+	} else if err := l.reopen(segments[len(segments)-1]); err != nil {
+		return nil, err
+	}
+	if err := l.sync(); err != nil {
+		l.f.Close()
+		return nil, err
+	}
+	var ctx context.Context
+	ctx, l.cancel = context.WithCancel(context.Background())
+	l.subscribed.Add(1)
+	go func() {
+		defer l.subscribed.Done()
+		db.db.Subscribe(ctx, l.receive, []pb.Match{{Prefix: []byte{}}})
+	}()
+	l.wg.Add(1)
+	go l.run()
+	return l, nil
+}
+
+func changeLogSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".log") {
+			segments = append(segments, filepath.Join(dir, entry.Name()))
+		}
+	}
+	// the names are the zero padded base versions
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// reopen continues the last segment, a record cut by a crash is dropped
+func (l *changeLog) reopen(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	base, end, err := readSegment(f, func(rec *logRecord) error {
+		if rec.kind != logCatchUp {
+			l.last = rec.version
+		}
+		l.lastTime = rec.time
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if base > l.last {
+		l.last = base
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size = f, bufio.NewWriter(f), end
+	return nil
+}
+
+// must be called with the lock held, or while opening
+func (l *changeLog) startSegment(base uint64) error {
+	if l.f != nil {
+		if err := l.flush(); err != nil {
+			return err
+		}
+		if err := l.f.Close(); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d.log", base))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	header := append([]byte{}, changeLogMagic...)
+	header = append(header, changeLogFormat)
+	header = binary.BigEndian.AppendUint64(header, base)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.w, l.size, l.last = f, bufio.NewWriter(f), int64(len(header)), base
+	return nil
+}
+
+// receive is the subscription callback, it queues the commits for run
+func (l *changeLog) receive(kvs *badger.KVList) error {
+	l.qmu.Lock()
+	for _, kv := range kvs.Kv {
+		// the probes of the change streams are not data
+		if !bytes.HasPrefix(kv.Key, []byte(probePrefix)) {
+			l.queue = append(l.queue, kv)
+		}
+	}
+	l.qmu.Unlock()
+	select {
+	case l.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run logs the queue until close, what is queued when it stops is logged
+// before it returns
+func (l *changeLog) run() {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.signal:
+			l.logQueue()
+		case <-l.stop:
+			l.logQueue()
+			return
+		}
+	}
+}
+
+// logQueue logs the queued commits and flushes the log
+func (l *changeLog) logQueue() {
+	l.qmu.Lock()
+	list := l.queue
+	l.queue = nil
+	l.qmu.Unlock()
+	if len(list) == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	err := l.db.db.View(func(txn *badger.Txn) error {
+		for len(list) > 0 {
+			n := 1
+			for n < len(list) && list[n].Version == list[0].Version {
+				n++
+			}
+			version := list[0].Version
+			if version > l.last {
+				// commits were made before the subscription started
+				if version > l.last+1 {
+					if err := l.catchUp(version - 1); err != nil {
+						return err
+					}
+				}
+				entries := make([]logEntry, n)
+				for i, kv := range list[:n] {
+					deleted, err := isDeleted(txn, kv)
+					if err != nil {
+						return err
+					}
+					entries[i] = logEntry{key: kv.Key, value: kv.Value, deleted: deleted, expiresAt: kv.ExpiresAt}
+				}
+				if err := l.write(&logRecord{kind: logCommit, version: version, time: time.Now(), entries: entries}); err != nil {
+					return err
+				}
+			}
+			list = list[n:]
+		}
+		return nil
+	})
+	if err == nil {
+		err = l.flush()
+	}
+	l.err = err
+}
+
+// isDeleted reports if the entry of the subscription is a delete. the
+// subscription doesn't pass badger's meta, a delete has no value but so
+// does a set of an empty value, the stored version tells them apart. a
+// version compacted away is taken for a delete, a set of it would only be
+// dropped once a newer version hides it
+func isDeleted(txn *badger.Txn, kv *pb.KV) (bool, error) {
+	if len(kv.Value) > 0 {
+		return false, nil
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.PrefetchValues = false
+	opts.Prefix = kv.Key
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	// the versions of a key come from the newest
+	for it.Seek(kv.Key); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.Equal(item.Key(), kv.Key) || item.Version() < kv.Version {
+			break
+		}
+		if item.Version() == kv.Version {
+			return item.IsDeletedOrExpired(), nil
+		}
+	}
+	return true, nil
+}
+
+// catchUp logs the stored versions after the last logged one up to upTo,
+// must be called with the lock held
+func (l *changeLog) catchUp(upTo uint64) error {
+	commits := make(map[uint64][]logEntry)
+	err := l.db.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.SinceTs = l.last
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.Version() <= l.last || item.Version() > upTo || bytes.HasPrefix(item.Key(), []byte(probePrefix)) {
+				continue
+			}
+			entry := logEntry{key: item.KeyCopy(nil), deleted: item.IsDeletedOrExpired(), expiresAt: item.ExpiresAt()}
+			if !entry.deleted {
+				var err error
+				if entry.value, err = item.ValueCopy(nil); err != nil {
+					return err
+				}
+			}
+			commits[item.Version()] = append(commits[item.Version()], entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	versions := make([]uint64, 0, len(commits))
+	for version := range commits {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) > 0 {
+		// badger doesn't keep when they were committed, only that it was
+		// after the last record
+		if err := l.write(&logRecord{kind: logCatchUp, version: versions[len(versions)-1], time: l.lastTime}); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, version := range versions {
+		if err := l.write(&logRecord{kind: logCommit, version: version, time: now, entries: commits[version]}); err != nil {
+			return err
+		}
+	}
+	// the versions without anything stored left nothing to log
+	l.last = upTo
+	return nil
+}
+
+// sync logs every commit made so far and flushes the log to disk
+func (l *changeLog) sync() error {
+	if l.err != nil {
+		return l.err
+	}
+	if version := l.db.db.MaxVersion(); version > l.last {
+		l.err = l.catchUp(version)
+	}
+	if l.err == nil {
+		l.err = l.flush()
+	}
+	return l.err
+}
+
+// drop logs the drop of key prefixes, it is called before they are
+// dropped so the log never misses one
+func (l *changeLog) drop(prefixes ...[]byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.sync(); err != nil {
+		return err
+	}
+	l.err = l.write(&logRecord{kind: logDrop, version: l.last, time: time.Now(), prefixes: prefixes})
+	if l.err == nil {
+		l.err = l.flush()
+	}
+	return l.err
+}
+
+// must be called with the lock held
+func (l *changeLog) write(rec *logRecord) error {
+	if l.size > changeLogSegmentSize {
+		if err := l.startSegment(l.last); err != nil {
+			return err
+		}
+	}
+	payload := rec.encode()
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+	if _, err := l.w.Write(frame); err != nil {
+		return err
+	}
+	l.size += int64(len(frame))
+	if rec.kind == logCommit {
+		l.last = rec.version
+	}
+	if rec.kind != logCatchUp {
+		l.lastTime = rec.time
+	}
+	return nil
+}
+
+func (l *changeLog) flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// ChangeLogErr returns the error that stopped the change log of the
+// database, nothing is logged after it until the database is opened again.
+// it is nil while the log runs and when the database has none
+func (d *Database) ChangeLogErr() error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if d.changelog == nil {
+		return nil
+	}
+	d.changelog.mu.Lock()
+	defer d.changelog.mu.Unlock()
+	return d.changelog.err
+}
+
+// close stops following the commits and logs the ones left, it is called
+// before the database is closed
+func (l *changeLog) close() error {
+	l.cancel()
+	l.subscribed.Wait()
+	close(l.stop)
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.sync()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (rec *logRecord) encode() []byte {
+	b := []byte{rec.kind}
+	b = binary.AppendUvarint(b, rec.version)
+	b = binary.BigEndian.AppendUint64(b, uint64(rec.time.UnixNano()))
+	switch rec.kind {
+	case logCommit:
+		b = binary.AppendUvarint(b, uint64(len(rec.entries)))
+		for _, entry := range rec.entries {
+			b = append(b, boolToByte(entry.deleted))
+			b = binary.AppendUvarint(b, entry.expiresAt)
+			b = appendBytes(b, entry.key)
+			b = appendBytes(b, entry.value)
+		}
+	case logDrop:
+		b = binary.AppendUvarint(b, uint64(len(rec.prefixes)))
+		for _, prefix := range rec.prefixes {
+			b = appendBytes(b, prefix)
+		}
+	case logCatchUp:
+		b = binary.AppendUvarint(b, 0)
+	}
+	return b
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// logReader reads the fields of a record
+type logReader struct {
+	b   []byte
+	err error
+}
+
+func (r *logReader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = ErrInvalidChangeLog
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *logReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = ErrInvalidChangeLog
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *logReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil || uint64(len(r.b)) < n {
+		r.err = ErrInvalidChangeLog
+		return nil
+	}
+	data := r.b[:n]
+	r.b = r.b[n:]
+	return data
+}
+
+func decodeLogRecord(b []byte) (*logRecord, error) {
+	r := &logReader{b: b}
+	rec := &logRecord{kind: r.byte(), version: r.uvarint()}
+	if r.err == nil && len(r.b) >= 8 {
+		rec.time = time.Unix(0, int64(binary.BigEndian.Uint64(r.b)))
+		r.b = r.b[8:]
+	} else {
+		r.err = ErrInvalidChangeLog
+	}
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		switch rec.kind {
+		case logCommit:
+			entry := logEntry{deleted: r.byte() == 1, expiresAt: r.uvarint()}
+			entry.key = r.bytes()
+			entry.value = r.bytes()
+			rec.entries = append(rec.entries, entry)
+		case logDrop:
+			rec.prefixes = append(rec.prefixes, r.bytes())
+		default:
+			r.err = ErrInvalidChangeLog
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return rec, nil
+}
+
+func segmentBase(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, changeLogHeader)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, ErrInvalidChangeLog
+	}
+	return parseSegmentHeader(header)
+}
+
+func parseSegmentHeader(header []byte) (uint64, error) {
+	if !bytes.Equal(header[:4], changeLogMagic) || header[4] != changeLogFormat {
+		return 0, ErrInvalidChangeLog
+	}
+	return binary.BigEndian.Uint64(header[5:]), nil
+}
+
+// readSegment calls fn with every record of a segment, it returns the base
+// version of the segment and where its last complete record ends
+func readSegment(f *os.File, fn func(rec *logRecord) error) (uint64, int64, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	header := make([]byte, changeLogHeader)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, 0, ErrInvalidChangeLog
+	}
+	base, err := parseSegmentHeader(header)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := int64(changeLogHeader)
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			// the end or a record cut while it was written
+			return base, end, nil
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(size[:])+4)
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return base, end, nil
+		}
+		payload := frame[:len(frame)-4]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[len(frame)-4:]) {
+			return base, end, nil
+		}
+		rec, err := decodeLogRecord(payload)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := fn(rec); err != nil {
+			return 0, 0, err
+		}
+		end += int64(4 + len(frame))
+	}
+}
+
+// RecoveryTarget is where Replay stops, the zero value replays everything
+type RecoveryTarget struct {
+	// the last commit to replay
+	Version uint64
+	// replay the commits logged until then
+	Time time.Time
+}
+
+func (t RecoveryTarget) reached(rec *logRecord) bool {
+	if !t.Time.IsZero() && rec.time.After(t.Time) {
+		return true
+	}
+	if t.Version == 0 {
+		return false
+	}
+	if rec.kind == logDrop {
+		// the drop came after the commit of its version
+		return rec.version >= t.Version
+	}
+	return rec.version > t.Version
+}
+
+// inCatchUp reports if the target time falls between the commits before
+// a catch up and rec, a commit it caught up
+func (t RecoveryTarget) inCatchUp(catchUp, rec *logRecord) bool {
+	return !t.Time.IsZero() && !t.Time.Before(catchUp.time) && t.Time.Before(rec.time)
+}
+
+var errTargetReached = errors.New("target reached")
+
+// Replay rolls the database forward with the change log in dir, from its
+// current version to the target. it is used after restoring a backup into
+// a new database to bring it back to right before an operator error. a
+// time target fails with ErrRecoveryTime when it falls among commits the
+// log only caught up with, their time is not known. it
+// returns the version of the last commit replayed. like Restore it runs
+// alone. collections must be looked up again after a replay
+func (d *Database) Replay(dir string, target RecoveryTarget) (uint64, error) {
+	if !d.IsOpen() {
+		return 0, ErrDatabaseClosed
+	}
+	segments, err := changeLogSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, ErrInvalidChangeLog
+	}
+	var applied uint64
+	err = d.exclusive(func() error {
+		applied, err = d.replay(segments, target)
+		return err
+	})
+	return applied, err
+}
+
+// replay applies the commits of the segments after the current version
+func (d *Database) replay(segments []string, target RecoveryTarget) (uint64, error) {
+	start := d.db.MaxVersion()
+	base, err := segmentBase(segments[0])
+	if err != nil {
+		return 0, err
+	}
+	if base > start {
+		return 0, ErrChangeLogGap
+	}
+	applied := start
+	// the catch up the commits being read belong to, if any
+	var catchUp *logRecord
+	pending := make([]*pb.KV, 0)
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		err := d.load(pending)
+		pending = pending[:0]
+		return err
+	}
+	for _, path := range segments {
+		f, err := os.Open(path)
+		if err != nil {
+			return applied, err
+		}
+		_, _, err = readSegment(f, func(rec *logRecord) error {
+			if rec.kind == logCatchUp {
+				catchUp = rec
+				return nil
+			}
+			if catchUp != nil && (rec.version > catchUp.version || rec.kind != logCommit) {
+				catchUp = nil
+			}
+			if catchUp != nil && target.inCatchUp(catchUp, rec) {
+				return ErrRecoveryTime
+			}
+			if target.reached(rec) {
+				return errTargetReached
+			}
+			switch {
+			case rec.kind == logCommit && rec.version > start:
+				for _, entry := range rec.entries {
+					kv := &pb.KV{Key: entry.key, Value: entry.value, Version: rec.version, ExpiresAt: entry.expiresAt}
+					if entry.deleted {
+						kv.Meta = []byte{badgerBitDelete}
+					}
+					pending = append(pending, kv)
+				}
+				applied = rec.version
+				if len(pending) >= 10000 {
+					return flush()
+				}
+			case rec.kind == logDrop && rec.version >= start:
+				if err := flush(); err != nil {
+					return err
+				}
+				return d.dropPrefix(rec.prefixes...)
+			}
+			return nil
+		})
+		f.Close()
+		if err == errTargetReached {
+			break
+		}
+		if err == ErrRecoveryTime {
+			// what was read before the catch up is replayed
+			if ferr := flush(); ferr != nil {
+				return applied, ferr
+			}
+		}
+		if err != nil {
+			return applied, err
+		}
+	}
+	if err := flush(); err != nil {
+		return applied, err
+	}
+	return applied, d.catalog.Init()
+}
+
+// load writes entries with their versions through badger's backup loader,
+// it moves the version of the database past them
+func (d *Database) load(kvs []*pb.KV) error {
+	data, err := (&pb.KVList{Kv: kvs}).Marshal()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint64(len(data)))
+	buf.Write(data)
+	return d.db.Load(&buf, 256)
+}
+
+// dropPrefix drops every key under the prefixes, it is recorded in the
+// change log first if there is one
+func (d *Database) dropPrefix(prefixes ...[]byte) error {
+	if d.changelog != nil {
+		if err := d.changelog.drop(prefixes...); err != nil {
+			return err
+		}
+	}
+	return d.db.DropPrefix(prefixes...)
+}
@@ -0,0 +1,450 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrChangeStreamClosed = errors.New("change stream closed")
+	ErrChangeStreamBehind = errors.New("change stream fell behind, resume it from the last token")
+)
+
+// kinds of changes
+const (
+	ChangeInsert = iota + 1
+	ChangeUpdate
+	ChangeDelete
+)
+
+// Change is a write to a document of a collection
+type Change struct {
+	Kind    int
+	ID      types.Object
+	Version uint64
+	// nil for an insert, and when the previous version is not stored anymore
+	Before *Document
+	// nil for a delete
+	After *Document
+	// resumes the stream right after this change
+	Token string
+
+	key []byte
+}
+
+// how many unread changes a stream keeps before it gives up on the reader,
+// badger stops writes while a subscriber doesn't take its updates so they
+// can't be left waiting there
+const changeBacklog = 10000
+
+// badger doesn't tell when a subscription starts, a stream deletes a key
+// of its own under w/<collection>/ and waits for the subscription to get
+// the delete. the subscription is usually running by then, the delete is
+// made again with a growing interval when it wasn't. a delete of a key
+// that never existed is all a probe leaves, compactions discard it, and
+// the change log and backups skip the prefix
+const (
+	probePrefix      = "w/"
+	probeInterval    = 10 * time.Millisecond
+	probeMaxInterval = time.Second
+)
+
+// ChangeStream follows the writes to a collection in commit order, it is
+// used like an iterator but Next blocks until there is a change
+type ChangeStream struct {
+	coll   *Collection
+	prefix []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	probe []byte
+	// closed when the subscription got the probe, at version confirmed
+	started   chan struct{}
+	confirmed uint64
+
+	// filled by the subscriber
+	mu      sync.Mutex
+	live    []*pb.KV
+	behind  bool
+	done    bool
+	doneErr error
+	signal  chan struct{}
+
+	// the changes at or before this position were returned already
+	version uint64
+	key     []byte
+
+	queue  []Change
+	change Change
+	err    error
+}
+
+// Watch streams the changes made to the collection after the position of
+// token, or after it returns if token is empty. it returns once the
+// stream follows the commits, then the changes that were made while no
+// stream was running are read back from the stored versions, the ones
+// older than the retention of the database can be merged into the latest
+func (c *Collection) Watch(ctx context.Context, token string) (*ChangeStream, error) {
+	if !c.db.IsOpen() {
+		return nil, ErrDatabaseClosed
+	}
+	s := &ChangeStream{
+		coll:    c,
+		prefix:  documentKeyPrefix(c.name),
+		signal:  make(chan struct{}, 1),
+		started: make(chan struct{}),
+	}
+	if token != "" {
+		var err error
+		if s.version, s.key, err = s.decodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s.probe = append([]byte(probePrefix+c.name+"/"), nonce...)
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go s.subscribe()
+	if err := s.start(token); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// start waits for the subscription and catches up with the commits after
+// token, the ones after the subscription started come from it
+func (s *ChangeStream) start(token string) error {
+	interval := probeInterval
+	for {
+		err := s.coll.db.Update(func(txn *badger.Txn) error {
+			return txn.Delete(s.probe)
+		})
+		if err != nil {
+			return err
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-s.started:
+			timer.Stop()
+			if token == "" {
+				s.version = s.confirmed
+				return nil
+			}
+			return s.catchUp()
+		case <-timer.C:
+		case <-s.ctx.Done():
+			timer.Stop()
+			return s.closedErr(s.ctx.Err())
+		}
+		if interval *= 2; interval > probeMaxInterval {
+			interval = probeMaxInterval
+		}
+		s.mu.Lock()
+		done, doneErr := s.done, s.doneErr
+		s.mu.Unlock()
+		if done {
+			return s.closedErr(doneErr)
+		}
+	}
+}
+
+func (s *ChangeStream) subscribe() {
+	defer s.wg.Done()
+	err := s.coll.db.db.Subscribe(s.ctx, func(kvs *badger.KVList) error {
+		s.mu.Lock()
+		kvs.Kv = s.confirm(kvs.Kv)
+		if len(s.live)+len(kvs.Kv) > changeBacklog {
+			s.behind = true
+			s.mu.Unlock()
+			s.notify()
+			return ErrChangeStreamBehind
+		}
+		s.live = append(s.live, kvs.Kv...)
+		s.mu.Unlock()
+		s.notify()
+		return nil
+	}, []pb.Match{{Prefix: s.prefix}, {Prefix: s.probe}})
+	s.mu.Lock()
+	s.done = true
+	s.doneErr = err
+	s.mu.Unlock()
+	s.notify()
+}
+
+// confirm takes the deletes of the probe out of kvs, the first one starts
+// the stream. must be called with the lock held
+func (s *ChangeStream) confirm(kvs []*pb.KV) []*pb.KV {
+	n := 0
+	for _, kv := range kvs {
+		if !bytes.Equal(kv.Key, s.probe) {
+			kvs[n] = kv
+			n++
+			continue
+		}
+		if s.confirmed == 0 {
+			s.confirmed = kv.Version
+			close(s.started)
+		}
+	}
+	return kvs[:n]
+}
+
+func (s *ChangeStream) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Next waits for the next change, it returns false when the stream is
+// closed, its context is done or on error
+func (s *ChangeStream) Next() bool {
+	for s.err == nil && len(s.queue) == 0 {
+		s.err = s.fill()
+	}
+	if s.err != nil {
+		return false
+	}
+	s.change = s.queue[0]
+	s.queue = s.queue[1:]
+	s.version, s.key = s.change.Version, s.change.key
+	return true
+}
+
+// fill queues the next changes, it can queue none
+func (s *ChangeStream) fill() error {
+	s.mu.Lock()
+	live, behind, done, doneErr := s.live, s.behind, s.done, s.doneErr
+	s.live = nil
+	s.mu.Unlock()
+	if behind {
+		return ErrChangeStreamBehind
+	}
+	if len(live) == 0 {
+		if done {
+			return s.closedErr(doneErr)
+		}
+		select {
+		case <-s.signal:
+			return nil
+		case <-s.ctx.Done():
+			return s.closedErr(s.ctx.Err())
+		}
+	}
+	return s.apply(live)
+}
+
+func (s *ChangeStream) closedErr(err error) error {
+	switch {
+	case err == nil:
+		// badger ends the subscriptions when it closes
+		return ErrDatabaseClosed
+	case errors.Is(err, context.Canceled) && s.ctx.Err() != nil:
+		return ErrChangeStreamClosed
+	}
+	return err
+}
+
+// after reports if a change at version to key was not returned yet
+func (s *ChangeStream) after(version uint64, key []byte) bool {
+	return version > s.version || version == s.version && bytes.Compare(key, s.key) > 0
+}
+
+// last returns the position of the last change returned or queued
+func (s *ChangeStream) last() (uint64, []byte) {
+	if len(s.queue) == 0 {
+		return s.version, s.key
+	}
+	change := s.queue[len(s.queue)-1]
+	return change.Version, change.key
+}
+
+// apply queues the changes the subscriber got
+func (s *ChangeStream) apply(kvs []*pb.KV) error {
+	sort.SliceStable(kvs, func(i, j int) bool {
+		if kvs[i].Version != kvs[j].Version {
+			return kvs[i].Version < kvs[j].Version
+		}
+		return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+	})
+	version, key := s.last()
+	return s.coll.db.View(func(txn *badger.Txn) error {
+		for _, kv := range kvs {
+			if kv.Version < version || kv.Version == version && bytes.Compare(kv.Key, key) <= 0 {
+				continue
+			}
+			var after *Document
+			if len(kv.Value) > 0 {
+				after = s.coll.NewDocument(nil)
+				if err := s.coll.decode(after, kv.Value); err != nil {
+					return err
+				}
+				after.key = kv.Key
+				after.meta.Version = kv.Version
+				after.meta.Expires = expiresTime(kv.ExpiresAt)
+			}
+			before, err := s.coll.loadAt(txn, kv.Key, kv.Version-1)
+			if err != nil {
+				return err
+			}
+			if err := s.push(kv.Key, kv.Version, before, after); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// catchUp queues the changes after the current position that are still
+// stored, every version of every document is read so it is only done
+// when a stream resumes from a token
+func (s *ChangeStream) catchUp() error {
+	changes := make([]Change, 0)
+	err := s.coll.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.Prefix = s.prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// the versions of a key come from the newest, each one is the
+		// before of the change made by the previous one
+		var key []byte
+		var pending *Change
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) {
+				key = item.KeyCopy(nil)
+				pending = nil
+			} else if pending == nil {
+				continue
+			}
+			var doc *Document
+			if !item.IsDeletedOrExpired() {
+				var err error
+				if doc, err = s.coll.decodeItem(nil, item, key); err != nil {
+					return err
+				}
+			}
+			if pending != nil {
+				pending.Before = doc
+				pending = nil
+			}
+			if !s.after(item.Version(), key) {
+				continue
+			}
+			changes = append(changes, Change{Version: item.Version(), After: doc, key: key})
+			pending = &changes[len(changes)-1]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Version != changes[j].Version {
+			return changes[i].Version < changes[j].Version
+		}
+		return bytes.Compare(changes[i].key, changes[j].key) < 0
+	})
+	for _, change := range changes {
+		if err := s.push(change.key, change.Version, change.Before, change.After); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push queues a change if it is one, deleting a missing document is not
+func (s *ChangeStream) push(key []byte, version uint64, before, after *Document) error {
+	change := Change{Version: version, Before: before, After: after, key: key}
+	switch {
+	case after == nil && before == nil:
+		return nil
+	case after == nil:
+		change.Kind = ChangeDelete
+	case before == nil && after.meta.Revision <= 1:
+		change.Kind = ChangeInsert
+	default:
+		change.Kind = ChangeUpdate
+	}
+	id, _, err := DecodeKey(key[len(s.prefix):])
+	if err != nil {
+		return err
+	}
+	change.ID = id
+	if before != nil {
+		before.tnx = nil
+	}
+	change.Token = s.token(version, key)
+	s.queue = append(s.queue, change)
+	return nil
+}
+
+// Change returns the current change
+func (s *ChangeStream) Change() Change {
+	return s.change
+}
+
+// Token resumes a new stream right after the current change
+func (s *ChangeStream) Token() string {
+	return s.token(s.version, s.key)
+}
+
+func (s *ChangeStream) Err() error {
+	if s.err == ErrChangeStreamClosed {
+		return nil
+	}
+	return s.err
+}
+
+// Close stops the stream, a Next blocked in another goroutine returns false
+func (s *ChangeStream) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *ChangeStream) token(version uint64, key []byte) string {
+	b := []byte{tokenVersion}
+	b = binary.AppendUvarint(b, version)
+	b = append(b, key...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *ChangeStream) decodeToken(token string) (uint64, []byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < 6 {
+		return 0, nil, ErrInvalidToken
+	}
+	data, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(data) != sum || data[0] != tokenVersion {
+		return 0, nil, ErrInvalidToken
+	}
+	version, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return 0, nil, ErrInvalidToken
+	}
+	key := data[1+n:]
+	// the token of a stream that didn't return anything yet has no key
+	if len(key) > 0 && !bytes.HasPrefix(key, s.prefix) {
+		return 0, nil, ErrInvalidToken
+	}
+	return version, key, nil
+}
@@ -0,0 +1,450 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrDocumentNotFound = errors.New("document not found")
+	ErrDocumentExists   = errors.New("document already exists")
+)
+
+type Collection struct {
+	name string
+	db   *Database
+
+	// guards info, the indexes can change while the collection is used
+	mu   sync.RWMutex
+	info *CollectionInfo
+
+	isSecondary bool
+}
+
+// NewCollection creates a collection that is not in the catalog,
+// use Database.CreateCollection to create a stored collection
+func NewCollection(name string, db *Database) *Collection {
+	// create a new collection
+	return newCollection(&CollectionInfo{Name: name}, db)
+}
+
+func newCollection(info *CollectionInfo, db *Database) *Collection {
+	return &Collection{
+		name: info.Name,
+		db:   db,
+		info: info,
+	}
+}
+
+func (c *Collection) Name() string {
+	// get the name
+	return c.name
+}
+
+func (c *Collection) Database() *Database {
+	return c.db
+}
+
+// Indexes returns a copy of the indexes of the collection
+func (c *Collection) Indexes() []IndexInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	indexes := make([]IndexInfo, len(c.info.Indexes))
+	for i, index := range c.info.Indexes {
+		indexes[i] = *index
+	}
+	return indexes
+}
+
+// Index returns the index with the given name
+func (c *Collection) Index(name string) (IndexInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, index := range c.info.Indexes {
+		if index.Name == name {
+			return *index, nil
+		}
+	}
+	return IndexInfo{}, ErrIndexNotFound
+}
+
+// NewDocument creates an empty document bound to this collection
+func (c *Collection) NewDocument(txn *badger.Txn) *Document {
+	return NewDocument(c.db, c, txn)
+}
+
+// returns the badger key of the document with the given id
+func (c *Collection) key(id types.Object) ([]byte, error) {
+	return EncodeKey(documentKeyPrefix(c.name), id)
+}
+
+func (c *Collection) Get(id types.Object) (*Document, error) {
+	var doc *Document
+	err := c.db.View(func(txn *badger.Txn) error {
+		var err error
+		doc, err = c.GetTxn(txn, id)
+		return err
+	})
+	return doc, err
+}
+
+// GetTxn loads a document inside a transaction
+func (c *Collection) GetTxn(txn *badger.Txn, id types.Object) (*Document, error) {
+	key, err := c.key(id)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := c.load(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrDocumentNotFound
+	}
+	return doc, nil
+}
+
+// load returns nil if there is no document with that key, it reads only
+// the given fields when there are some
+func (c *Collection) load(txn *badger.Txn, key []byte, fields ...[]byte) (*Document, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeItem(txn, item, key, fields...)
+}
+
+func (c *Collection) decodeItem(txn *badger.Txn, item *badger.Item, key []byte, fields ...[]byte) (*Document, error) {
+	doc := c.NewDocument(txn)
+	err := item.Value(func(val []byte) error {
+		return c.decode(doc, val, fields...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	doc.key = append([]byte{}, key...)
+	doc.meta.Version = item.Version()
+	doc.meta.Expires = expiresTime(item.ExpiresAt())
+	doc.size = int(item.ValueSize())
+	return doc, nil
+}
+
+// Set inserts the document or replaces the one with the same id
+func (c *Collection) Set(doc *Document) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return c.SetTxn(txn, doc)
+	})
+}
+
+// SetTxn saves a document and updates the indexes inside a transaction.
+// a document that was loaded from this collection can only be saved if
+// nobody saved it since, otherwise ErrStaleDocument is returned
+func (c *Collection) SetTxn(txn *badger.Txn, doc *Document) error {
+	if doc.ID() == nil {
+		return types.ErrInvalidDocument
+	}
+	key, err := c.key(doc.ID())
+	if err != nil {
+		return err
+	}
+	old, err := c.load(txn, key)
+	if err != nil {
+		return err
+	}
+	var current *Meta
+	if old != nil {
+		current = &old.meta
+	}
+	if doc.coll == c && doc.meta.Revision > 0 && (current == nil || current.Revision != doc.meta.Revision) {
+		return ErrStaleDocument
+	}
+	now := time.Now()
+	meta := nextMeta(current, now)
+	expires, err := c.expiry(doc, now)
+	if err != nil {
+		return err
+	}
+	markers, err := c.checkReferences(txn, old, doc)
+	if err != nil {
+		return err
+	}
+	for _, marker := range markers {
+		if err := txn.Set(marker, nil); err != nil {
+			return err
+		}
+	}
+	capped, isCapped := c.Capped()
+	var st *cappedState
+	if isCapped {
+		if st, err = c.capInsert(txn, old, &meta); err != nil {
+			return err
+		}
+	}
+	b, err := c.encode(doc, meta, c.encryptedFields())
+	if err != nil {
+		return err
+	}
+	ttl := expiresAt(expires)
+	if err := c.updateIndexes(txn, old, doc, ttl); err != nil {
+		return err
+	}
+	if err := txn.SetEntry(newEntry(key, b, ttl)); err != nil {
+		return err
+	}
+	c.db.expiries.add(ttl)
+	if isCapped {
+		if err := c.capWrite(txn, capped, st, key, old, meta, len(b)); err != nil {
+			return err
+		}
+	}
+	meta.Expires = expiresTime(ttl)
+	doc.db = c.db
+	doc.coll = c
+	doc.tnx = txn
+	doc.key = key
+	doc.meta = meta
+	doc.size = len(b)
+	doc.modified = false
+	return nil
+}
+
+func (c *Collection) Del(id types.Object) error {
+	return c.db.Update(func(txn *badger.Txn) error {
+		return c.DelTxn(txn, id)
+	})
+}
+
+// DelTxn deletes a document and its index entries inside a transaction
+func (c *Collection) DelTxn(txn *badger.Txn, id types.Object) error {
+	key, err := c.key(id)
+	if err != nil {
+		return err
+	}
+	old, err := c.load(txn, key)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return ErrDocumentNotFound
+	}
+	if _, ok := c.Capped(); !ok {
+		return c.remove(txn, key, old, nil)
+	}
+	st, err := c.cappedState(txn)
+	if err != nil {
+		return err
+	}
+	if err := c.remove(txn, key, old, &st); err != nil {
+		return err
+	}
+	return c.saveCappedState(txn, st)
+}
+
+// remove deletes the stored document old and its index entries, st is
+// the state of a capped collection and nil for other collections
+func (c *Collection) remove(txn *badger.Txn, key []byte, old *Document, st *cappedState) error {
+	if err := c.updateIndexes(txn, old, nil, 0); err != nil {
+		return err
+	}
+	if st != nil {
+		if err := c.capDelete(txn, old, st); err != nil {
+			return err
+		}
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	// after the delete so cycles of references end at this document
+	return c.onDelete(txn, old)
+}
+
+// indexKey returns the entry of doc in the index, missing fields are
+// indexed as null and encrypted fields by their ciphertext. unique is true
+// if the entry is the unique one of its values, see IndexOptions
+func (c *Collection) indexKey(index *IndexInfo, encrypted []*EncryptedField, doc *Document) (key []byte, unique bool, err error) {
+	key = indexKeyPrefix(c.name, index.Name)
+	unique = index.Unique
+	for _, field := range index.Fields {
+		value, _ := doc.Get([]byte(field))
+		if value == nil {
+			value = types.Null{}
+		}
+		if value.Type() == types.NullType {
+			unique = false
+		}
+		if index.CaseInsensitive {
+			value = foldCase(value)
+		}
+		if f := findEncrypted(encrypted, field); f != nil {
+			if value, err = c.seal(f, value, doc); err != nil {
+				return nil, false, err
+			}
+		}
+		if key, err = EncodeKey(key, value); err != nil {
+			return nil, false, err
+		}
+	}
+	if unique {
+		return key, true, nil
+	}
+	key, err = EncodeKey(key, doc.ID())
+	return key, false, err
+}
+
+// updateIndexes replaces the index entries of old with the ones of doc,
+// old or doc can be nil when inserting or deleting. the entries of doc
+// expire with it at ttl, see newEntry
+func (c *Collection) updateIndexes(txn *badger.Txn, old, doc *Document, ttl uint64) error {
+	// an entry that is kept must still be written again if the expiry changed
+	rewrite := old != nil && ttl != expiresAt(old.meta.Expires)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, index := range c.info.Indexes {
+		var oldKey, newKey []byte
+		var unique bool
+		var err error
+		if old != nil {
+			if oldKey, _, err = c.indexKey(index, c.info.Encrypted, old); err != nil {
+				return err
+			}
+		}
+		if doc != nil {
+			if newKey, unique, err = c.indexKey(index, c.info.Encrypted, doc); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(oldKey, newKey) && (newKey == nil || !rewrite) {
+			continue
+		}
+		if oldKey != nil && !bytes.Equal(oldKey, newKey) {
+			if err := txn.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+		if newKey != nil {
+			id, err := EncodeKey(nil, doc.ID())
+			if err != nil {
+				return err
+			}
+			if unique {
+				if err := c.checkUnique(txn, index, newKey, id); err != nil {
+					return err
+				}
+			}
+			// the value is the id so index scans don't have to decode the key
+			if err := txn.SetEntry(newEntry(newKey, id, ttl)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CreateIndex adds an index over the fields and builds it from the
+// documents already in the collection
+func (c *Collection) CreateIndex(name string, fields ...string) error {
+	return c.CreateIndexWith(name, IndexOptions{}, fields...)
+}
+
+func (c *Collection) buildIndex(index *IndexInfo) error {
+	wb := c.db.db.NewWriteBatch()
+	defer wb.Cancel()
+	encrypted := c.encryptedFields()
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = documentKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			doc := c.NewDocument(nil)
+			err := it.Item().Value(func(val []byte) error {
+				return c.decode(doc, val)
+			})
+			if err != nil {
+				return err
+			}
+			key, _, err := c.indexKey(index, encrypted, doc)
+			if err != nil {
+				return err
+			}
+			id, err := EncodeKey(nil, doc.ID())
+			if err != nil {
+				return err
+			}
+			// the entry expires with the document
+			if err := wb.SetEntry(newEntry(key, id, it.Item().ExpiresAt())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return wb.Flush()
+}
+
+// DropIndex removes an index and all its entries
+func (c *Collection) DropIndex(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fk := range c.info.ForeignKeys {
+		if foreignKeyIndex(fk.Field) == name {
+			return ErrIndexInUse
+		}
+	}
+	info := c.copyInfo()
+	found := false
+	for i, index := range info.Indexes {
+		if index.Name == name {
+			info.Indexes = append(info.Indexes[:i], info.Indexes[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrIndexNotFound
+	}
+	info.Stats = info.Stats.withoutIndex(name)
+	if err := c.db.enter(); err != nil {
+		return err
+	}
+	defer c.db.leave()
+	err := c.db.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return err
+	}
+	c.info = info
+	return c.db.dropPrefix(indexKeyPrefix(c.name, name))
+}
+
+// must be called with the lock held
+func (c *Collection) copyInfo() *CollectionInfo {
+	info := *c.info
+	info.Indexes = append([]*IndexInfo{}, c.info.Indexes...)
+	info.Encrypted = append([]*EncryptedField{}, c.info.Encrypted...)
+	info.ForeignKeys = append([]*ForeignKey{}, c.info.ForeignKeys...)
+	return &info
+}
+
+func (c *Collection) Type() byte {
+	return types.CollectionType
+}
+
+func (c *Collection) Value() interface{} {
+	return c
+}
+
+func (c *Collection) String() string {
+	return "collection::" + c.name
+}
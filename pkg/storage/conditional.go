@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrVersionMismatch = errors.New("document version does not match")
+	ErrConditionFailed = errors.New("write condition failed")
+)
+
+// SetIf saves the document only if the stored one is still at
+// expectedVersion, see Document.Version. an expectedVersion of 0 means the
+// document must not exist yet. a concurrent write to the same document
+// makes it fail with ErrVersionMismatch. doc gets the version it was
+// committed at so it can be passed to the next SetIf
+func (c *Collection) SetIf(doc *Document, expectedVersion uint64) error {
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return c.SetIfTxn(txn, doc, expectedVersion)
+	})
+	if err == badger.ErrConflict {
+		return ErrVersionMismatch
+	}
+	if err != nil {
+		return err
+	}
+	return c.committed(doc)
+}
+
+// SetIfTxn is SetIf inside a transaction, the check is only safe against
+// concurrent writers if the transaction commits successfully
+func (c *Collection) SetIfTxn(txn *badger.Txn, doc *Document, expectedVersion uint64) error {
+	return c.SetIfMatchTxn(txn, doc, func(current *Document) bool {
+		if current == nil {
+			return expectedVersion == 0
+		}
+		return current.meta.Version == expectedVersion
+	}, ErrVersionMismatch)
+}
+
+// SetIfMatch saves the document only if cond returns true for the stored
+// document, which is nil if there is none. like SetIf doc gets the
+// version it was committed at
+func (c *Collection) SetIfMatch(doc *Document, cond func(current *Document) bool) error {
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return c.SetIfMatchTxn(txn, doc, cond, ErrConditionFailed)
+	})
+	if err == badger.ErrConflict {
+		return ErrConditionFailed
+	}
+	if err != nil {
+		return err
+	}
+	return c.committed(doc)
+}
+
+// committed sets the version a saved document was committed at, badger
+// only tells it to the readers after the commit. it stays 0 if the
+// document was saved again or deleted since
+func (c *Collection) committed(doc *Document) error {
+	return c.db.View(func(txn *badger.Txn) error {
+		stored, err := c.load(txn, doc.key, []byte("id"))
+		if err != nil || stored == nil {
+			return err
+		}
+		// the revision and the time of the save tell it apart from later ones
+		if stored.meta.Revision == doc.meta.Revision && stored.meta.Updated.Equal(doc.meta.Updated) {
+			doc.meta.Version = stored.meta.Version
+		}
+		return nil
+	})
+}
+
+// SetIfMatchTxn checks cond against the stored document and saves doc,
+// failErr is returned when cond is false
+func (c *Collection) SetIfMatchTxn(txn *badger.Txn, doc *Document, cond func(current *Document) bool, failErr error) error {
+	if doc.ID() == nil {
+		return types.ErrInvalidDocument
+	}
+	key, err := c.key(doc.ID())
+	if err != nil {
+		return err
+	}
+	current, err := c.load(txn, key)
+	if err != nil {
+		return err
+	}
+	if !cond(current) {
+		return failErr
+	}
+	return c.SetTxn(txn, doc)
+}
+
+// Upsert inserts doc if there is no document with its id. otherwise the
+// operators are applied to the stored document, or it is replaced by doc
+// when there are no operators. on insert the operators are applied to doc
+// before it is saved. it returns the saved document, with the version it
+// was committed at, and if it was inserted
+func (c *Collection) Upsert(doc *Document, ops ...UpdateOp) (*Document, bool, error) {
+	var saved *Document
+	var inserted bool
+	err := c.db.Update(func(txn *badger.Txn) error {
+		var err error
+		saved, inserted, err = c.UpsertTxn(txn, doc, ops...)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return saved, inserted, c.committed(saved)
+}
+
+func (c *Collection) UpsertTxn(txn *badger.Txn, doc *Document, ops ...UpdateOp) (*Document, bool, error) {
+	if doc.ID() == nil {
+		return nil, false, types.ErrInvalidDocument
+	}
+	key, err := c.key(doc.ID())
+	if err != nil {
+		return nil, false, err
+	}
+	current, err := c.load(txn, key)
+	if err != nil {
+		return nil, false, err
+	}
+	target := doc
+	if current != nil && len(ops) > 0 {
+		target = current
+	}
+	if err := ApplyUpdate(target, ops...); err != nil {
+		return nil, false, err
+	}
+	if err := c.SetTxn(txn, target); err != nil {
+		return nil, false, err
+	}
+	return target, current == nil, nil
+}
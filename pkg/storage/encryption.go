@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/y"
+)
+
+var (
+	ErrInvalidEncryptionKey  = errors.New("encryption key must be 16, 24 or 32 bytes")
+	ErrEncryptionKeyRequired = errors.New("database is encrypted, an encryption key is required")
+	ErrWrongEncryptionKey    = errors.New("wrong encryption key")
+	ErrNotEncrypted          = errors.New("database is not encrypted")
+	ErrCorrupted             = errors.New("database files are corrupted")
+)
+
+// badger encrypts every file with data keys that it rotates on its own,
+// the data keys are stored encrypted with the master key in its key
+// registry. badger can't tell a wrong master key from a damaged registry,
+// so next to it we keep a file that only says which key is the right one
+//
+//	"TRKC" hmac-sha256(key, "terara") crc32
+//
+// a rotation writes the check of the new key to KEYCHECK.next before the
+// registry and renames it into place after, in between either key opens
+// the database
+const (
+	keyCheckFile     = "KEYCHECK"
+	keyCheckNextFile = keyCheckFile + ".next"
+)
+
+var keyCheckMagic = []byte("TRKC")
+
+// ParseEncryptionKey reads a master key written in hex, in base64 or as
+// the raw bytes, surrounding whitespace is ignored
+func ParseEncryptionKey(text []byte) ([]byte, error) {
+	text = bytes.TrimSpace(text)
+	if key, err := hex.DecodeString(string(text)); err == nil && validKeySize(key) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(text)); err == nil && validKeySize(key) {
+		return key, nil
+	}
+	if validKeySize(text) {
+		return text, nil
+	}
+	return nil, ErrInvalidEncryptionKey
+}
+
+// LoadEncryptionKey reads the master key from a file, or from an
+// environment variable if file is empty. it returns nil if both are empty
+func LoadEncryptionKey(file, env string) ([]byte, error) {
+	switch {
+	case file != "":
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseEncryptionKey(text)
+	case env != "":
+		text, ok := os.LookupEnv(env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", env)
+		}
+		return ParseEncryptionKey([]byte(text))
+	}
+	return nil, nil
+}
+
+func validKeySize(key []byte) bool {
+	return len(key) == 16 || len(key) == 24 || len(key) == 32
+}
+
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("terara"))
+	b := append([]byte{}, keyCheckMagic...)
+	b = mac.Sum(b)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+}
+
+// checkEncryptionKey tells if key can open the database in dir before
+// badger tries to, it returns if the key check still has to be written
+func checkEncryptionKey(dir string, key []byte) (bool, error) {
+	if len(key) > 0 && !validKeySize(key) {
+		return false, ErrInvalidEncryptionKey
+	}
+	stored, err := readKeyCheck(dir, keyCheckFile)
+	if os.IsNotExist(err) {
+		if len(key) == 0 {
+			return false, nil
+		}
+		// badger can't encrypt a database that already has data
+		if _, err := os.Stat(filepath.Join(dir, badger.ManifestFilename)); err == nil {
+			return false, ErrNotEncrypted
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(key) == 0 {
+		return false, ErrEncryptionKeyRequired
+	}
+	next, err := readKeyCheck(dir, keyCheckNextFile)
+	if os.IsNotExist(err) {
+		if !hmac.Equal(stored, keyCheck(key)) {
+			return false, ErrWrongEncryptionKey
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, finishRotation(dir, key, stored, next)
+}
+
+// finishRotation settles a rotation that stopped before its key check was
+// renamed into place. the key of either check is right if the registry
+// opens with it, the rotation is then completed or dropped
+func finishRotation(dir string, key, stored, next []byte) error {
+	check := keyCheck(key)
+	if !hmac.Equal(stored, check) && !hmac.Equal(next, check) {
+		return ErrWrongEncryptionKey
+	}
+	kr, err := badger.OpenKeyRegistry(badger.KeyRegistryOptions{Dir: dir, ReadOnly: true, EncryptionKey: key})
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return ErrWrongEncryptionKey
+	}
+	if err != nil {
+		return openError(err)
+	}
+	kr.Close()
+	if hmac.Equal(next, check) {
+		return os.Rename(filepath.Join(dir, keyCheckNextFile), filepath.Join(dir, keyCheckFile))
+	}
+	return os.Remove(filepath.Join(dir, keyCheckNextFile))
+}
+
+func readKeyCheck(dir, file string) ([]byte, error) {
+	stored, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	n := len(stored)
+	if n != len(keyCheckMagic)+sha256.Size+4 || !bytes.Equal(stored[:len(keyCheckMagic)], keyCheckMagic) ||
+		crc32.ChecksumIEEE(stored[:n-4]) != binary.BigEndian.Uint32(stored[n-4:]) {
+		return nil, fmt.Errorf("%w: %s is damaged", ErrCorrupted, file)
+	}
+	return stored, nil
+}
+
+// writeKeyCheck writes the check of key to file through a synced temporary
+// file, so it is either whole or missing
+func writeKeyCheck(dir, file string, key []byte) error {
+	tmp := filepath.Join(dir, file+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(keyCheck(key))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, file))
+}
+
+// openError tells corruption apart from the other errors of badger.Open,
+// a wrong key was ruled out by the key check already
+func openError(err error) error {
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) || errors.Is(err, y.ErrChecksumMismatch) {
+		return fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return err
+}
+
+// RotateKey encrypts the data keys of a database with a new master key,
+// the documents don't have to be rewritten. the database is closed while
+// the keys are rotated, the registry opens it again with its own key so it
+// has to be created again with the new one. if it stops halfway the
+// database opens with the key its registry was written with
+func (r *Registry) RotateKey(name string, oldKey, newKey []byte) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	if !validKeySize(newKey) {
+		return ErrInvalidEncryptionKey
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	if !r.Exists(name) {
+		return ErrDatabaseNotFound
+	}
+	if db, ok := r.dbs[name]; ok {
+		if err := db.Close(); err != nil {
+			return err
+		}
+		delete(r.dbs, name)
+	}
+	dir := filepath.Join(r.path, name)
+	if _, err := checkEncryptionKey(dir, oldKey); err != nil {
+		return err
+	}
+	if len(oldKey) == 0 {
+		return ErrNotEncrypted
+	}
+	opts := badger.KeyRegistryOptions{
+		Dir:           dir,
+		ReadOnly:      true,
+		EncryptionKey: oldKey,
+	}
+	kr, err := badger.OpenKeyRegistry(opts)
+	if err != nil {
+		return openError(err)
+	}
+	defer kr.Close()
+	if err := writeKeyCheck(dir, keyCheckNextFile, newKey); err != nil {
+		return err
+	}
+	opts.EncryptionKey = newKey
+	if err := badger.WriteKeyRegistry(kr, opts); err != nil {
+		// the registry may be written already, the next open settles it
+		return err
+	}
+	return os.Rename(filepath.Join(dir, keyCheckNextFile), filepath.Join(dir, keyCheckFile))
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrFieldKeyRequired    = errors.New("collection has encrypted fields, a field key is required to write them")
+	ErrFieldDecrypt        = errors.New("encrypted field can't be decrypted, wrong field key or damaged value")
+	ErrFieldEncrypted      = errors.New("field is already encrypted")
+	ErrCollectionNotEmpty  = errors.New("collection must be empty")
+	ErrEncryptedIndex      = errors.New("only fields encrypted deterministically can be indexed")
+	ErrEncryptedFieldRange = errors.New("encrypted fields can only be scanned by equality")
+)
+
+// EncryptedField is a field of the collection schema that is stored
+// encrypted with AES-GCM. deterministic encryption gives the same
+// ciphertext for the same value so the field can be indexed and looked up
+// by equality, at the cost of showing which documents share a value
+type EncryptedField struct {
+	Field         string `json:"field"`
+	Deterministic bool   `json:"deterministic,omitempty"`
+}
+
+// an encrypted value is stored as a types.Binary
+//
+//	0xfd mode nonce(12) aes-gcm(types.MarshalObject(value))
+//
+// the collection and field are authenticated with it so a value can't be
+// moved to another field. null values are not encrypted
+const (
+	fieldCipherMagic         = 0xfd
+	fieldCipherRandom        = 0
+	fieldCipherDeterministic = 1
+	fieldNonceSize           = 12
+	fieldOverhead            = 2 + fieldNonceSize + 16
+)
+
+// EncryptField declares a top level field as encrypted, the collection must
+// be empty so no document has the field in the clear
+func (c *Collection) EncryptField(field string, deterministic bool) error {
+	if field == "" || field == "id" || strings.Contains(field, ".") {
+		return ErrInvalidName
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, existing := range c.info.Encrypted {
+		if existing.Field == field {
+			return ErrFieldEncrypted
+		}
+	}
+	if !deterministic && c.indexed(field) {
+		return ErrEncryptedIndex
+	}
+	info := c.copyInfo()
+	info.Encrypted = append(info.Encrypted, &EncryptedField{Field: field, Deterministic: deterministic})
+	err := c.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = documentKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		it.Rewind()
+		empty := !it.Valid()
+		it.Close()
+		if !empty {
+			return ErrCollectionNotEmpty
+		}
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return err
+	}
+	c.info = info
+	return nil
+}
+
+// EncryptedFields returns a copy of the encrypted fields of the collection
+func (c *Collection) EncryptedFields() []EncryptedField {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fields := make([]EncryptedField, len(c.info.Encrypted))
+	for i, field := range c.info.Encrypted {
+		fields[i] = *field
+	}
+	return fields
+}
+
+// must be called with the lock held
+func (c *Collection) indexed(field string) bool {
+	for _, index := range c.info.Indexes {
+		for _, f := range index.Fields {
+			if f == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *Collection) encryptedFields() []*EncryptedField {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.info.Encrypted
+}
+
+func findEncrypted(fields []*EncryptedField, name string) *EncryptedField {
+	for _, field := range fields {
+		if field.Field == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// fieldCipher derives the keys of a field from the field key of the
+// database, every field of every collection gets its own keys
+func (c *Collection) fieldCipher(field string) (cipher.AEAD, []byte, error) {
+	master := c.db.opts.FieldKey
+	if len(master) == 0 {
+		return nil, nil, ErrFieldKeyRequired
+	}
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte("terara " + purpose + "/" + c.name + "/" + field))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("field"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, derive("nonce"), nil
+}
+
+// isSealed reports if value has the form of a ciphertext, anyone can
+// make one so it proves nothing
+func isSealed(value types.Object) bool {
+	b, ok := value.(types.Binary)
+	return ok && len(b) >= fieldOverhead && b[0] == fieldCipherMagic &&
+		(b[1] == fieldCipherRandom || b[1] == fieldCipherDeterministic)
+}
+
+// seal encrypts a value of an encrypted field of doc, doc is nil for the
+// values a scan is bounded by. a value that looks sealed is only kept if
+// it is the ciphertext doc was read with by a reader without the field
+// key, or if it opens with the key of the field, anything else a client
+// sends is encrypted
+func (c *Collection) seal(field *EncryptedField, value types.Object, doc *Document) (types.Object, error) {
+	if value.Type() == types.NullType || doc != nil && doc.readSealed(field.Field, value) {
+		return value, nil
+	}
+	aead, nonceKey, err := c.fieldCipher(field.Field)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := value.(types.Binary); ok && isSealed(b) {
+		if _, err := c.unseal(aead, field.Field, b); err == nil {
+			return value, nil
+		}
+	}
+	plain, err := types.MarshalObject(value)
+	if err != nil {
+		return nil, err
+	}
+	mode := byte(fieldCipherRandom)
+	nonce := make([]byte, fieldNonceSize)
+	if field.Deterministic {
+		mode = fieldCipherDeterministic
+		mac := hmac.New(sha256.New, nonceKey)
+		mac.Write(plain)
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	b := append([]byte{fieldCipherMagic, mode}, nonce...)
+	return types.Binary(aead.Seal(b, nonce, plain, c.fieldAAD(field.Field, mode))), nil
+}
+
+// open decrypts a sealed value, without the field key the value is
+// returned sealed
+func (c *Collection) open(field string, value types.Object) (types.Object, error) {
+	if !isSealed(value) || len(c.db.opts.FieldKey) == 0 {
+		return value, nil
+	}
+	aead, _, err := c.fieldCipher(field)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := c.unseal(aead, field, value.(types.Binary))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFieldDecrypt, field)
+	}
+	return decoded, nil
+}
+
+// unseal decrypts a ciphertext of field, it fails if it was not sealed
+// with the key of the field
+func (c *Collection) unseal(aead cipher.AEAD, field string, b types.Binary) (types.Object, error) {
+	plain, err := aead.Open(nil, b[2:2+fieldNonceSize], b[2+fieldNonceSize:], c.fieldAAD(field, b[1]))
+	if err != nil {
+		return nil, err
+	}
+	decoded, _, err := types.UnmarshalObject(plain)
+	return decoded, err
+}
+
+func (c *Collection) fieldAAD(field string, mode byte) []byte {
+	return append([]byte(c.name+"/"+field+"/"), mode)
+}
+
+// sealDocument returns what is stored for doc, a copy with the encrypted
+// fields sealed. documents in memory always hold the clear values
+func (c *Collection) sealDocument(doc *Document, fields []*EncryptedField) (*Document, error) {
+	if len(fields) == 0 {
+		return doc, nil
+	}
+	sealed := *doc
+	sealed.kv = make(map[string]types.Object, len(doc.kv))
+	for name, value := range doc.kv {
+		sealed.kv[name] = value
+	}
+	for _, field := range fields {
+		value, ok := doc.kv[field.Field]
+		if !ok {
+			continue
+		}
+		var err error
+		if sealed.kv[field.Field], err = c.seal(field, value, doc); err != nil {
+			return nil, err
+		}
+	}
+	return &sealed, nil
+}
+
+// openDocument decrypts the encrypted fields of a document just read,
+// without the field key they stay sealed and are remembered so the
+// document can be written back
+func (c *Collection) openDocument(doc *Document) error {
+	for _, field := range c.encryptedFields() {
+		value, ok := doc.kv[field.Field]
+		if !ok {
+			continue
+		}
+		if b, ok := value.(types.Binary); ok && isSealed(b) && len(c.db.opts.FieldKey) == 0 {
+			if doc.sealed == nil {
+				doc.sealed = make(map[string]types.Binary)
+			}
+			doc.sealed[field.Field] = b
+			continue
+		}
+		var err error
+		if doc.kv[field.Field], err = c.open(field.Field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode returns the value stored in badger for a document
+func (c *Collection) encode(doc *Document, meta Meta, fields []*EncryptedField) ([]byte, error) {
+	sealed, err := c.sealDocument(doc, fields)
+	if err != nil {
+		return nil, err
+	}
+	return encodeStored(sealed, meta)
+}
+
+// decode reads a stored value into doc and decrypts its encrypted fields,
+// only the given fields when there are some
+func (c *Collection) decode(doc *Document, val []byte, fields ...[]byte) error {
+	if err := decodeStored(doc, val, fields...); err != nil {
+		return err
+	}
+	return c.openDocument(doc)
+}
+
+// sealScanValues encrypts the values a scan of an index is bounded by,
+// first is the position of the first value among the fields of the index
+func (c *Collection) sealScanValues(index *IndexInfo, first int, values []types.Object, exact bool) ([]types.Object, error) {
+	fields := c.encryptedFields()
+	if len(fields) == 0 {
+		return values, nil
+	}
+	sealed := make([]types.Object, len(values))
+	for i, value := range values {
+		sealed[i] = value
+		if first+i >= len(index.Fields) {
+			continue
+		}
+		field := findEncrypted(fields, index.Fields[first+i])
+		if field == nil {
+			continue
+		}
+		if !exact {
+			return nil, ErrEncryptedFieldRange
+		}
+		var err error
+		if sealed[i], err = c.seal(field, value, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sealed, nil
+}
+
+// readSealed reports if value is the ciphertext of field the document was
+// read with and couldn't open
+func (d *Document) readSealed(field string, value types.Object) bool {
+	b, ok := value.(types.Binary)
+	return ok && d.sealed[field] != nil && bytes.Equal(d.sealed[field], b)
+}
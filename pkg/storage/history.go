@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrVersionNotRetained = errors.New("version is older than the retention window")
+	ErrRetentionTooLong   = errors.New("retention is longer than the maximum")
+)
+
+// MaxRetention is the longest retention window. nothing written during
+// the window can be dropped, neither the old versions on disk nor what
+// badger keeps in memory to run the transactions pinning them, so the
+// cost grows with the window times the rate of writes
+const MaxRetention = 24 * time.Hour
+
+// badger only drops an old version of a key when no running transaction
+// can read it, so the retention keeps a read transaction open every
+// interval and discards the ones older than the window. everything that
+// was visible since the oldest of them stays readable.
+//
+// the transactions only live in memory, after a restart the history
+// starts again from the moment the database was opened. the window is
+// capped at MaxRetention because of what it costs to keep
+type retention struct {
+	db       *Database
+	window   time.Duration
+	interval time.Duration
+
+	mu   sync.Mutex
+	pins []pin
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type pin struct {
+	at  time.Time
+	txn *badger.Txn
+}
+
+// the retention window is covered by this many pins
+const retentionPins = 16
+
+func newRetention(db *Database, window time.Duration) *retention {
+	interval := window / retentionPins
+	if interval < time.Second {
+		interval = time.Second
+	}
+	r := &retention{
+		db:       db,
+		window:   window,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	r.tick(time.Now())
+	r.wg.Add(1)
+	go r.run()
+	return r
+}
+
+func (r *retention) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.tick(now)
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// tick pins the current version and releases the pins that are not
+// needed to cover the window anymore
+func (r *retention) tick(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pins = append(r.pins, pin{at: now, txn: r.db.db.NewTransaction(false)})
+	// keep the newest pin that is older than the window, it holds the
+	// versions that were current at the start of the window
+	boundary := now.Add(-r.window)
+	drop := 0
+	for drop+1 < len(r.pins) && !r.pins[drop+1].at.After(boundary) {
+		drop++
+	}
+	for _, p := range r.pins[:drop] {
+		p.txn.Discard()
+	}
+	r.pins = append([]pin{}, r.pins[drop:]...)
+}
+
+func (r *retention) stop() {
+	close(r.done)
+	r.wg.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.pins {
+		p.txn.Discard()
+	}
+	r.pins = nil
+}
+
+// oldest returns the oldest retained version
+func (r *retention) oldest() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pins[0].txn.ReadTs()
+}
+
+// versionAt returns the version pinned last at or before t
+func (r *retention) versionAt(t time.Time) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.pins) - 1; i >= 0; i-- {
+		if !r.pins[i].at.After(t) {
+			return r.pins[i].txn.ReadTs(), true
+		}
+	}
+	return 0, false
+}
+
+// CurrentVersion returns the version of the last commit
+func (d *Database) CurrentVersion() uint64 {
+	return d.db.MaxVersion()
+}
+
+// OldestVersion returns the oldest version that can be read with ViewAt
+func (d *Database) OldestVersion() uint64 {
+	if d.retention == nil {
+		return d.db.MaxVersion()
+	}
+	return d.retention.oldest()
+}
+
+// VersionAt returns the version that was current at t. versions are only
+// known at the retention interval, so the result can be up to one interval
+// older than t. it is 0 if nothing was committed yet at t
+func (d *Database) VersionAt(t time.Time) (uint64, error) {
+	if !d.IsOpen() {
+		return 0, ErrDatabaseClosed
+	}
+	if !t.Before(time.Now()) {
+		return d.db.MaxVersion(), nil
+	}
+	if d.retention == nil {
+		return 0, ErrVersionNotRetained
+	}
+	version, ok := d.retention.versionAt(t)
+	if !ok {
+		return 0, ErrVersionNotRetained
+	}
+	return version, nil
+}
+
+// Snapshot reads the database as it was at a version
+type Snapshot struct {
+	db      *Database
+	txn     *badger.Txn
+	version uint64
+}
+
+// ViewAt runs fn with a snapshot of the database at version, the version
+// must not be older than OldestVersion. a version of 0 reads the latest
+func (d *Database) ViewAt(version uint64, fn func(s *Snapshot) error) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	if version > 0 && version < d.OldestVersion() {
+		return ErrVersionNotRetained
+	}
+	return d.db.View(func(txn *badger.Txn) error {
+		return fn(&Snapshot{db: d, txn: txn, version: version})
+	})
+}
+
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+func (s *Snapshot) Get(coll *Collection, id types.Object) (*Document, error) {
+	key, err := coll.key(id)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := coll.loadAt(s.txn, key, s.version)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, ErrDocumentNotFound
+	}
+	return doc, nil
+}
+
+// Scan iterates over the collection as it was at the snapshot version,
+// indexes created after that version return nothing
+func (s *Snapshot) Scan(coll *Collection, opts ScanOptions) (*Iterator, error) {
+	opts.AsOf = s.version
+	return coll.ScanTxn(s.txn, opts)
+}
+
+// loadAt returns the newest version of a document that is not newer than
+// version, or nil if it didn't exist then. a version of 0 loads the latest
+func (c *Collection) loadAt(txn *badger.Txn, key []byte, version uint64, fields ...[]byte) (*Document, error) {
+	if version == 0 {
+		return c.load(txn, key, fields...)
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	opts.Prefix = key
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	// versions of a key come from the newest to the oldest
+	for it.Seek(key); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.Equal(item.Key(), key) {
+			break
+		}
+		if item.Version() > version {
+			continue
+		}
+		if item.IsDeletedOrExpired() {
+			return nil, nil
+		}
+		return c.decodeItem(txn, item, key, fields...)
+	}
+	return nil, nil
+}
+
+// HistoryEntry is one stored version of a document
+type HistoryEntry struct {
+	Version uint64
+	Deleted bool
+	// nil if the version is a deletion
+	Document *Document
+}
+
+// History lists the versions of a document that are still stored, from
+// the newest to the oldest
+func (c *Collection) History(id types.Object) ([]HistoryEntry, error) {
+	key, err := c.key(id)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]HistoryEntry, 0)
+	err = c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		opts.Prefix = key
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(key); it.Valid(); it.Next() {
+			item := it.Item()
+			if !bytes.Equal(item.Key(), key) {
+				break
+			}
+			entry := HistoryEntry{Version: item.Version(), Deleted: item.IsDeletedOrExpired()}
+			if !entry.Deleted {
+				if entry.Document, err = c.decodeItem(nil, item, key); err != nil {
+					return err
+				}
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
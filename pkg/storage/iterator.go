@@ -0,0 +1,493 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid continuation token")
+)
+
+const tokenVersion = 1
+
+// ScanOptions controls what a scan returns and in which order
+type ScanOptions struct {
+	// name of the index to scan, empty to scan by primary key
+	Index string
+	// scan a capped collection from the oldest document to the newest, the
+	// key of the entries is the insertion sequence
+	InsertionOrder bool
+	// iterate from the biggest key to the smallest
+	Reverse bool
+	// only return keys starting with these values, for an index they are
+	// matched against the first fields
+	Prefix []types.Object
+	// inclusive lower and exclusive upper bounds, they continue the prefix
+	// so with a prefix they apply to the fields after it
+	Start []types.Object
+	End   []types.Object
+	// don't load the documents, only the keys
+	KeysOnly bool
+	// only decode these fields of the documents, all of them when empty.
+	// the id is always decoded, saving such a document drops the others
+	Fields []string
+	// stop after this many entries, 0 means no limit
+	Limit int
+	// resume right after the entry a previous scan returned this token for
+	Token string
+	// read the collection as it was at this version, 0 reads the latest.
+	// the transaction must be able to see the version, see Database.ViewAt
+	AsOf uint64
+}
+
+// Entry is a single result of a scan
+type Entry struct {
+	// the values of the index fields, or the id when scanning by primary key
+	Key []types.Object
+	ID  types.Object
+	// nil when scanning keys only
+	Document *Document
+}
+
+// Iterator walks over the documents of a collection. it keeps a read
+// transaction open until it is closed, use Collection.Page for long scans
+// that should not hold a transaction between pages
+type Iterator struct {
+	coll  *Collection
+	opts  ScanOptions
+	index *IndexInfo
+
+	txn    *badger.Txn
+	ownTxn bool
+	it     *badger.Iterator
+
+	// the part of the key before the encoded values
+	base []byte
+	// the fields to decode with the id, nil for all
+	fields [][]byte
+	// every key returned starts with prefix and is in [lower, upper)
+	prefix []byte
+	lower  []byte
+	upper  []byte
+	resume []byte
+
+	started bool
+	count   int
+	key     []byte
+	val     []byte
+	version uint64
+	expires uint64
+	entry   Entry
+	err     error
+}
+
+// Scan starts an iterator in its own read transaction, it must be closed
+func (c *Collection) Scan(opts ScanOptions) (*Iterator, error) {
+	if err := c.db.enter(); err != nil {
+		return nil, err
+	}
+	txn := c.db.db.NewTransaction(false)
+	it, err := c.ScanTxn(txn, opts)
+	if err != nil {
+		txn.Discard()
+		c.db.leave()
+		return nil, err
+	}
+	it.ownTxn = true
+	return it, nil
+}
+
+// ScanTxn starts an iterator inside a transaction, it must be closed
+// before the transaction is committed or discarded
+func (c *Collection) ScanTxn(txn *badger.Txn, opts ScanOptions) (*Iterator, error) {
+	it := &Iterator{
+		coll: c,
+		opts: opts,
+		txn:  txn,
+	}
+	if opts.InsertionOrder {
+		if _, ok := c.Capped(); !ok || opts.Index != "" {
+			return nil, ErrNotCapped
+		}
+		// the insertion order is read like an index over the sequence
+		it.index = &IndexInfo{Fields: []string{"$seq"}}
+		it.base = orderKeyPrefix(c.name)
+	} else if opts.Index != "" {
+		index, err := c.Index(opts.Index)
+		if err != nil {
+			return nil, err
+		}
+		it.index = &index
+		it.base = indexKeyPrefix(c.name, index.Name)
+		if err := it.sealBounds(); err != nil {
+			return nil, err
+		}
+	} else {
+		it.base = documentKeyPrefix(c.name)
+	}
+	if len(opts.Fields) > 0 {
+		it.fields = [][]byte{[]byte("id")}
+		for _, field := range opts.Fields {
+			it.fields = append(it.fields, []byte(field))
+		}
+	}
+	var err error
+	if it.prefix, err = EncodeKeys(append([]byte{}, it.base...), it.opts.Prefix...); err != nil {
+		return nil, err
+	}
+	it.lower = it.prefix
+	if len(it.opts.Start) > 0 {
+		if it.lower, err = EncodeKeys(append([]byte{}, it.prefix...), it.opts.Start...); err != nil {
+			return nil, err
+		}
+	}
+	it.upper = prefixEnd(it.prefix)
+	if len(it.opts.End) > 0 {
+		if it.upper, err = EncodeKeys(append([]byte{}, it.prefix...), it.opts.End...); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Token != "" {
+		if it.resume, err = it.decodeToken(opts.Token); err != nil {
+			return nil, err
+		}
+	}
+	iopts := badger.DefaultIteratorOptions
+	iopts.Reverse = opts.Reverse
+	// index entries hold the id in the value so they are always read
+	iopts.PrefetchValues = !opts.KeysOnly && it.index == nil
+	iopts.AllVersions = opts.AsOf > 0
+	it.it = txn.NewIterator(iopts)
+	return it, nil
+}
+
+// sealBounds encrypts the values of the bounds that are matched against
+// encrypted fields, they can only be matched by equality. the bounds of a
+// case insensitive index are folded first
+func (it *Iterator) sealBounds() error {
+	var err error
+	n := len(it.opts.Prefix)
+	if it.opts.Prefix, err = it.coll.keyValues(it.index, 0, it.opts.Prefix, true); err != nil {
+		return err
+	}
+	if it.opts.Start, err = it.coll.keyValues(it.index, n, it.opts.Start, false); err != nil {
+		return err
+	}
+	it.opts.End, err = it.coll.keyValues(it.index, n, it.opts.End, false)
+	return err
+}
+
+// keyValues returns values as the entries of index hold them, folded if it
+// is case insensitive and sealed for encrypted fields. first is the
+// position of the first value among the fields of the index
+func (c *Collection) keyValues(index *IndexInfo, first int, values []types.Object, exact bool) ([]types.Object, error) {
+	if index.CaseInsensitive {
+		folded := make([]types.Object, len(values))
+		for i, value := range values {
+			folded[i] = foldCase(value)
+		}
+		values = folded
+	}
+	return c.sealScanValues(index, first, values, exact)
+}
+
+// IndexValues returns the values of the first fields of an index as its
+// entries hold them, like the bounds of a scan, so they can be compared
+// with its statistics. exact is false for the bounds of a range, values
+// of encrypted fields can't be one
+func (c *Collection) IndexValues(index string, exact bool, values ...types.Object) ([]types.Object, error) {
+	if index == "" {
+		return values, nil
+	}
+	info, err := c.Index(index)
+	if err != nil {
+		return nil, err
+	}
+	return c.keyValues(&info, 0, values, exact)
+}
+
+// Next moves to the next entry, it returns false at the end or on error
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.it == nil {
+		return false
+	}
+	if it.opts.Limit > 0 && it.count >= it.opts.Limit {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.seek()
+	}
+	for it.it.Valid() {
+		key := it.it.Item().Key()
+		if !it.inRange(key) {
+			break
+		}
+		it.key = it.it.Item().KeyCopy(it.key[:0])
+		// skip the entry the token was made for
+		if it.resume != nil && bytes.Equal(it.key, it.resume) {
+			if _, err := it.consume(false); err != nil {
+				it.err = err
+				return false
+			}
+			continue
+		}
+		ok, err := it.consume(it.index != nil || !it.opts.KeysOnly)
+		if err == nil && ok {
+			err = it.load()
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !ok || (it.entry.Document == nil && !it.opts.KeysOnly) {
+			// the key didn't exist at AsOf or the index points to a
+			// document that is gone
+			continue
+		}
+		it.count++
+		return true
+	}
+	it.key = nil
+	return false
+}
+
+// consume reads the value of the current key and moves past it. with AsOf
+// every version of the key is read and ok is false if the key didn't
+// exist at that version
+func (it *Iterator) consume(value bool) (ok bool, err error) {
+	it.val = nil
+	if it.opts.AsOf == 0 {
+		item := it.it.Item()
+		it.version = item.Version()
+		it.expires = item.ExpiresAt()
+		if value {
+			if it.val, err = item.ValueCopy(nil); err != nil {
+				return false, err
+			}
+		}
+		it.it.Next()
+		return true, nil
+	}
+	// the versions of a key come newest first, or oldest first in reverse,
+	// so going forward the first version up to AsOf wins and in reverse
+	// the last one
+	decided := false
+	for ; it.it.Valid(); it.it.Next() {
+		item := it.it.Item()
+		if !bytes.Equal(item.Key(), it.key) {
+			break
+		}
+		if decided || item.Version() > it.opts.AsOf {
+			continue
+		}
+		decided = !it.opts.Reverse
+		ok = !item.IsDeletedOrExpired()
+		it.version = item.Version()
+		it.expires = item.ExpiresAt()
+		it.val = nil
+		if ok && value {
+			if it.val, err = item.ValueCopy(nil); err != nil {
+				return false, err
+			}
+		}
+	}
+	return ok, nil
+}
+
+func (it *Iterator) seek() {
+	if !it.opts.Reverse {
+		key := it.lower
+		if it.resume != nil && bytes.Compare(it.resume, key) >= 0 {
+			key = it.resume
+		}
+		it.it.Seek(key)
+		return
+	}
+	key := it.upper
+	if it.resume != nil && (key == nil || bytes.Compare(it.resume, key) < 0) {
+		key = it.resume
+	}
+	if key == nil {
+		it.it.Rewind()
+	} else {
+		it.it.Seek(key)
+	}
+	// the upper bound is exclusive, reverse seek stops at or before it
+	for it.it.Valid() && it.upper != nil && bytes.Compare(it.it.Item().Key(), it.upper) >= 0 {
+		it.it.Next()
+	}
+}
+
+func (it *Iterator) inRange(key []byte) bool {
+	if !bytes.HasPrefix(key, it.prefix) {
+		return false
+	}
+	if it.opts.Reverse {
+		return bytes.Compare(key, it.lower) >= 0
+	}
+	return it.upper == nil || bytes.Compare(key, it.upper) < 0
+}
+
+// load decodes the current entry from the key and the value consume read
+func (it *Iterator) load() error {
+	rest := it.key[len(it.base):]
+	it.entry = Entry{}
+	if it.index == nil {
+		id, _, err := DecodeKey(rest)
+		if err != nil {
+			return err
+		}
+		it.entry.Key = []types.Object{id}
+		it.entry.ID = id
+		if it.opts.KeysOnly {
+			return nil
+		}
+		doc := it.coll.NewDocument(it.txn)
+		if err := it.coll.decode(doc, it.val, it.fields...); err != nil {
+			return err
+		}
+		doc.key = append([]byte{}, it.key...)
+		doc.meta.Version = it.version
+		doc.meta.Expires = expiresTime(it.expires)
+		it.entry.Document = doc
+		return nil
+	}
+	values, _, err := DecodeKeys(rest, len(it.index.Fields))
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		if values[i], err = it.coll.open(it.index.Fields[i], value); err != nil {
+			return err
+		}
+	}
+	it.entry.Key = values
+	id, _, err := DecodeKey(it.val)
+	if err != nil {
+		return err
+	}
+	it.entry.ID = id
+	if it.opts.KeysOnly {
+		return nil
+	}
+	docKey := append(documentKeyPrefix(it.coll.name), it.val...)
+	it.entry.Document, err = it.coll.loadAt(it.txn, docKey, it.opts.AsOf, it.fields...)
+	return err
+}
+
+// Entry returns the current entry
+func (it *Iterator) Entry() Entry {
+	return it.entry
+}
+
+// Document returns the current document, nil when scanning keys only
+func (it *Iterator) Document() *Document {
+	return it.entry.Document
+}
+
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Token returns an opaque token that resumes the scan right after the
+// current entry, when passed back with the same index and direction
+func (it *Iterator) Token() string {
+	if it.key == nil {
+		return ""
+	}
+	b := []byte{tokenVersion, boolToByte(it.opts.Reverse)}
+	b = binary.AppendUvarint(b, uint64(len(it.opts.Index)))
+	b = append(b, it.opts.Index...)
+	b = append(b, it.key...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b))
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeToken returns the key a token was made for
+func (it *Iterator) decodeToken(token string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) < 7 {
+		return nil, ErrInvalidToken
+	}
+	data, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(data) != sum || data[0] != tokenVersion {
+		return nil, ErrInvalidToken
+	}
+	// a token only makes sense for the same index and direction
+	if data[1] != boolToByte(it.opts.Reverse) {
+		return nil, ErrInvalidToken
+	}
+	n, c := binary.Uvarint(data[2:])
+	if c <= 0 || uint64(len(data)-2-c) < n {
+		return nil, ErrInvalidToken
+	}
+	index := string(data[2+c : 2+c+int(n)])
+	key := data[2+c+int(n):]
+	if index != it.opts.Index || !bytes.HasPrefix(key, it.base) {
+		return nil, ErrInvalidToken
+	}
+	return key, nil
+}
+
+// Close releases the iterator and the transaction if the scan owns it
+func (it *Iterator) Close() {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	if it.ownTxn {
+		it.txn.Discard()
+		it.ownTxn = false
+		it.coll.db.leave()
+	}
+}
+
+// Page is one page of a paginated scan
+type Page struct {
+	Entries []Entry
+	// resumes the scan after the last entry, empty if there are no more
+	Token string
+}
+
+// Page returns up to opts.Limit entries in a short read transaction.
+// pass the returned token back in opts.Token to get the next page
+func (c *Collection) Page(opts ScanOptions) (*Page, error) {
+	limit := opts.Limit
+	opts.Limit = 0
+	page := &Page{Entries: make([]Entry, 0)}
+	err := c.db.View(func(txn *badger.Txn) error {
+		it, err := c.ScanTxn(txn, opts)
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		token := ""
+		for it.Next() {
+			if limit > 0 && len(page.Entries) == limit {
+				// there is at least one more entry
+				page.Token = token
+				break
+			}
+			entry := it.Entry()
+			if entry.Document != nil {
+				// the transaction ends with the page
+				entry.Document.tnx = nil
+			}
+			page.Entries = append(page.Entries, entry)
+			token = it.Token()
+		}
+		return it.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("value can't be used in a key")
+	ErrInvalidKey     = errors.New("invalid key")
+)
+
+// prefixes of the different kinds of entries we keep in badger
+const (
+	// c/<collection> holds the catalog entry of a collection
+	catalogPrefix = "c/"
+	// d/<collection>/<id> holds a document
+	documentPrefix = "d/"
+	// i/<collection>/<index>/<values><id> holds an index entry
+	indexPrefix = "i/"
+)
+
+// tags of the key encoding, they are ordered like types.Compare orders types
+const (
+	keyEnd byte = iota
+	keyNull
+	keyBool
+	keyNumber
+	keyString
+	keyArray
+	keyBinary
+	keyReference
+)
+
+func catalogKey(coll string) []byte {
+	return []byte(catalogPrefix + coll)
+}
+
+func documentKeyPrefix(coll string) []byte {
+	return []byte(documentPrefix + coll + "/")
+}
+
+func indexKeyPrefix(coll, index string) []byte {
+	return []byte(indexPrefix + coll + "/" + index + "/")
+}
+
+// EncodeKey appends the encoding of o to dst. the encoding keeps the
+// order of types.Compare so encoded keys can be compared as bytes, and
+// values that are types.Equal have the same encoding
+func EncodeKey(dst []byte, o types.Object) ([]byte, error) {
+	switch v := o.(type) {
+	case types.Null:
+		return append(dst, keyNull), nil
+	case types.Bool:
+		return append(dst, keyBool, boolToByte(bool(v))), nil
+	case types.Int64, types.Int32, types.Float:
+		return encodeNumber(dst, o), nil
+	case types.String:
+		return encodeString(dst, string(v)), nil
+	case types.Char:
+		return encodeString(dst, string(v)), nil
+	case types.Email:
+		return encodeString(dst, string(v)), nil
+	case types.Phone:
+		return encodeString(dst, string(v)), nil
+	case types.Binary:
+		return encodeBytes(dst, keyBinary, string(v)), nil
+	case types.Reference:
+		// the collection like a string, then the id
+		dst = encodeBytes(dst, keyReference, v.Collection)
+		return EncodeKey(dst, v.ID)
+	case types.Array:
+		dst = append(dst, keyArray)
+		for _, value := range v {
+			var err error
+			dst, err = EncodeKey(dst, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return append(dst, keyEnd), nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// EncodeKeys encodes a tuple of values one after the other
+func EncodeKeys(dst []byte, values ...types.Object) ([]byte, error) {
+	for _, value := range values {
+		var err error
+		dst, err = EncodeKey(dst, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// numbers are encoded as a sortable float followed by the exact integer
+// so big integers that round to the same float still sort correctly
+func encodeNumber(dst []byte, o types.Object) []byte {
+	f, _ := types.ToFloat(o)
+	i, ok := types.ToInt64(o)
+	if !ok && f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64 {
+		i = int64(f)
+	}
+	b := make([]byte, 17)
+	b[0] = keyNumber
+	bits := math.Float64bits(f)
+	if f < 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	binary.BigEndian.PutUint64(b[1:9], bits)
+	binary.BigEndian.PutUint64(b[9:17], uint64(i)^(1<<63))
+	return append(dst, b...)
+}
+
+// strings are terminated by 0x00 0x01 and 0x00 inside the string is
+// escaped as 0x00 0xff so shorter strings sort first
+func encodeString(dst []byte, s string) []byte {
+	return encodeBytes(dst, keyString, s)
+}
+
+// encodeBytes escapes s like a string under another tag
+func encodeBytes(dst []byte, tag byte, s string) []byte {
+	dst = append(dst, tag)
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0 {
+			dst = append(dst, 0, 0xff)
+			continue
+		}
+		dst = append(dst, s[i])
+	}
+	return append(dst, 0, 1)
+}
+
+// DecodeKey decodes a value encoded by EncodeKey, numbers with an integer
+// value are returned as types.Int64. it returns the number of bytes read
+func DecodeKey(b []byte) (types.Object, int, error) {
+	if len(b) < 1 {
+		return nil, 0, ErrInvalidKey
+	}
+	switch b[0] {
+	case keyNull:
+		return types.Null{}, 1, nil
+	case keyBool:
+		if len(b) < 2 {
+			return nil, 0, ErrInvalidKey
+		}
+		return types.Bool(b[1] == 1), 2, nil
+	case keyNumber:
+		if len(b) < 17 {
+			return nil, 0, ErrInvalidKey
+		}
+		bits := binary.BigEndian.Uint64(b[1:9])
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		f := math.Float64frombits(bits)
+		i := int64(binary.BigEndian.Uint64(b[9:17]) ^ (1 << 63))
+		if f == math.Trunc(f) && float64(i) == f {
+			return types.Int64(i), 17, nil
+		}
+		return types.Float(f), 17, nil
+	case keyString:
+		s, n, err := decodeBytes(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		return types.String(s), n, nil
+	case keyBinary:
+		s, n, err := decodeBytes(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		return types.Binary(s), n, nil
+	case keyReference:
+		coll, n, err := decodeBytes(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		id, c, err := DecodeKey(b[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return types.Reference{Collection: string(coll), ID: id}, n + c, nil
+	case keyArray:
+		arr := make(types.Array, 0)
+		count := 1
+		for {
+			if count >= len(b) {
+				return nil, 0, ErrInvalidKey
+			}
+			if b[count] == keyEnd {
+				return arr, count + 1, nil
+			}
+			value, n, err := DecodeKey(b[count:])
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, value)
+			count += n
+		}
+	}
+	return nil, 0, ErrInvalidKey
+}
+
+// decodeBytes reads a value written by encodeBytes, b starts at the tag
+func decodeBytes(b []byte) ([]byte, int, error) {
+	s := make([]byte, 0)
+	for i := 1; i < len(b); i++ {
+		if b[i] != 0 {
+			s = append(s, b[i])
+			continue
+		}
+		if i+1 >= len(b) {
+			return nil, 0, ErrInvalidKey
+		}
+		if b[i+1] == 1 {
+			return s, i + 2, nil
+		}
+		s = append(s, 0)
+		i++
+	}
+	return nil, 0, ErrInvalidKey
+}
+
+// DecodeKeys decodes n values encoded one after the other
+func DecodeKeys(b []byte, n int) ([]types.Object, int, error) {
+	values := make([]types.Object, 0, n)
+	count := 0
+	for i := 0; i < n; i++ {
+		value, c, err := DecodeKey(b[count:])
+		if err != nil {
+			return nil, 0, err
+		}
+		values = append(values, value)
+		count += c
+	}
+	return values, count, nil
+}
+
+// prefixEnd returns the smallest key that is bigger than every key
+// starting with prefix, or nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrStaleDocument = errors.New("document was changed since it was loaded")
+)
+
+// first byte of a stored value that starts with a meta header, values
+// written before metadata existed start with types.DocumentType
+const metaHeader byte = 0xfe
+
+// like metaHeader but followed by the insertion sequence of a document of
+// a capped collection after the times
+const metaHeaderSeq byte = 0xfc
+
+// Meta is the system metadata of a stored document, it is kept apart from
+// the fields of the document
+type Meta struct {
+	// starts at 1 and grows by one every time the document is saved
+	Revision uint64
+	Created  time.Time
+	Updated  time.Time
+	// badger commit version the document was loaded at
+	Version uint64
+	// when the document expires, zero if it doesn't
+	Expires time.Time
+	// insertion order in a capped collection, 0 in other collections
+	Seq uint64
+}
+
+// Meta returns the metadata of the document, it is zero for a document
+// that was never loaded nor saved
+func (d *Document) Meta() Meta {
+	return d.meta
+}
+
+// next returns the metadata of the next revision of a document whose
+// stored metadata is current, current is nil for a new document
+func nextMeta(current *Meta, now time.Time) Meta {
+	if current == nil {
+		return Meta{Revision: 1, Created: now, Updated: now}
+	}
+	return Meta{Revision: current.Revision + 1, Created: current.Created, Updated: now, Seq: current.Seq}
+}
+
+// encodeStored returns the value stored in badger for a document
+func encodeStored(doc *Document, meta Meta) ([]byte, error) {
+	body, err := doc.MarshalObject()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 1, 1+2*binary.MaxVarintLen64+16+len(body))
+	b[0] = metaHeader
+	b = binary.AppendUvarint(b, meta.Revision)
+	b = binary.BigEndian.AppendUint64(b, uint64(meta.Created.UnixNano()))
+	b = binary.BigEndian.AppendUint64(b, uint64(meta.Updated.UnixNano()))
+	if meta.Seq > 0 {
+		b[0] = metaHeaderSeq
+		b = binary.AppendUvarint(b, meta.Seq)
+	}
+	return append(b, body...), nil
+}
+
+// decodeStored reads a value written by encodeStored into doc, only the
+// given fields when there are some
+func decodeStored(doc *Document, val []byte, fields ...[]byte) error {
+	if len(val) > 0 && (val[0] == metaHeader || val[0] == metaHeaderSeq) {
+		revision, n := binary.Uvarint(val[1:])
+		if n <= 0 || len(val) < 1+n+16 {
+			return types.ErrInvalidLength
+		}
+		rest := val[1+n:]
+		doc.meta.Revision = revision
+		doc.meta.Created = time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8])))
+		doc.meta.Updated = time.Unix(0, int64(binary.BigEndian.Uint64(rest[8:16])))
+		rest = rest[16:]
+		if val[0] == metaHeaderSeq {
+			seq, n := binary.Uvarint(rest)
+			if n <= 0 {
+				return types.ErrInvalidLength
+			}
+			doc.meta.Seq = seq
+			rest = rest[n:]
+		}
+		val = rest
+	}
+	if len(fields) > 0 {
+		_, err := doc.Project(val, fields...)
+		return err
+	}
+	_, err := doc.UnmarshalObject(val)
+	return err
+}
@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrReferenced         = errors.New("referenced by another document")
+	ErrReferenceNotFound  = errors.New("referenced document not found")
+	ErrInvalidReference   = errors.New("reference points to another collection")
+	ErrForeignKeyExists   = errors.New("field already has a foreign key")
+	ErrForeignKeyNotFound = errors.New("foreign key not found")
+	ErrInvalidOnDelete    = errors.New("on delete must be restrict, cascade or set_null")
+	ErrIndexInUse         = errors.New("index is used by a foreign key")
+)
+
+// OnDelete is what happens to the documents that reference a document
+// when it is deleted
+type OnDelete string
+
+const (
+	// the delete fails while the document is referenced
+	Restrict OnDelete = "restrict"
+	// the documents that reference it are deleted with it
+	Cascade OnDelete = "cascade"
+	// the field of the documents that reference it is set to null
+	SetNull OnDelete = "set_null"
+)
+
+// ForeignKey declares that a field references documents of another
+// collection. the field holds a types.Reference to that collection or the
+// id itself, null or missing means no reference. only top-level fields
+// are supported, a field of a nested document can't be a foreign key
+type ForeignKey struct {
+	Field      string   `json:"field"`
+	Collection string   `json:"collection"`
+	OnDelete   OnDelete `json:"on_delete"`
+}
+
+// the documents that reference a document are found with an index over
+// the field, it is created with the foreign key
+func foreignKeyIndex(field string) string {
+	return "fk_" + field
+}
+
+// f/<collection>/<id> is written by every write that references the
+// document and read by its delete. badger doesn't track the index scan of
+// the delete, the marker makes a delete conflict with a reference
+// committed after the delete started
+const referencePrefix = "f/"
+
+func referenceKeyPrefix(coll string) []byte {
+	return []byte(referencePrefix + coll + "/")
+}
+
+// AddForeignKey makes field reference the documents of the collection
+// target. the documents already stored must reference documents that
+// exist, and the ones of target must not expire
+func (c *Collection) AddForeignKey(field, target string, onDelete OnDelete) error {
+	if !ValidName(field) || field == "id" {
+		return ErrInvalidName
+	}
+	if onDelete != Restrict && onDelete != Cascade && onDelete != SetNull {
+		return ErrInvalidOnDelete
+	}
+	referenced, err := c.db.catalog.Get(target)
+	if err != nil {
+		return err
+	}
+	// expired documents would be deleted without the foreign key
+	if expiring, err := referenced.expiring(); err != nil {
+		return err
+	} else if expiring {
+		return ErrExpiryReferenced
+	}
+	if c.foreignKey(field) != nil {
+		return ErrForeignKeyExists
+	}
+	if err := c.CreateIndex(foreignKeyIndex(field), field); err != nil {
+		return err
+	}
+	fk := &ForeignKey{Field: field, Collection: target, OnDelete: onDelete}
+	if err := c.saveForeignKeys(func(fks []*ForeignKey) []*ForeignKey { return append(fks, fk) }); err != nil {
+		return err
+	}
+	// writes from now on are checked, check the documents already stored
+	err = c.db.View(func(txn *badger.Txn) error {
+		it, err := c.ScanTxn(txn, ScanOptions{})
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+			if _, err := c.checkReference(txn, fk, it.Document().kv[field]); err != nil {
+				return err
+			}
+		}
+		return it.Err()
+	})
+	if err != nil {
+		if derr := c.DropForeignKey(field); derr != nil {
+			return derr
+		}
+		return err
+	}
+	return nil
+}
+
+// DropForeignKey removes the foreign key of field and its index
+func (c *Collection) DropForeignKey(field string) error {
+	if c.foreignKey(field) == nil {
+		return ErrForeignKeyNotFound
+	}
+	err := c.saveForeignKeys(func(fks []*ForeignKey) []*ForeignKey {
+		kept := make([]*ForeignKey, 0, len(fks))
+		for _, fk := range fks {
+			if fk.Field != field {
+				kept = append(kept, fk)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		return err
+	}
+	return c.DropIndex(foreignKeyIndex(field))
+}
+
+// ForeignKeys returns a copy of the foreign keys of the collection
+func (c *Collection) ForeignKeys() []ForeignKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fks := make([]ForeignKey, len(c.info.ForeignKeys))
+	for i, fk := range c.info.ForeignKeys {
+		fks[i] = *fk
+	}
+	return fks
+}
+
+func (c *Collection) saveForeignKeys(change func([]*ForeignKey) []*ForeignKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.copyInfo()
+	info.ForeignKeys = change(info.ForeignKeys)
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return err
+	}
+	c.info = info
+	return nil
+}
+
+func (c *Collection) foreignKey(field string) *ForeignKey {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return findForeignKey(c.info.ForeignKeys, field)
+}
+
+func findForeignKey(fks []*ForeignKey, field string) *ForeignKey {
+	for _, fk := range fks {
+		if fk.Field == field {
+			return fk
+		}
+	}
+	return nil
+}
+
+// referencedID returns the id a value of the field references, nil if it
+// doesn't reference anything
+func (fk *ForeignKey) referencedID(value types.Object) (types.Object, error) {
+	if value == nil || value.Type() == types.NullType {
+		return nil, nil
+	}
+	if ref, ok := value.(types.Reference); ok {
+		if ref.Collection != fk.Collection {
+			return nil, fmt.Errorf("%w: %s references %s, not %s", ErrInvalidReference, fk.Field, ref.Collection, fk.Collection)
+		}
+		return ref.ID, nil
+	}
+	return value, nil
+}
+
+// checkReference fails if value references a document that doesn't
+// exist. the read makes a delete of that document committed meanwhile
+// conflict, it returns the marker the write must set, nil if value
+// doesn't reference anything
+func (c *Collection) checkReference(txn *badger.Txn, fk *ForeignKey, value types.Object) ([]byte, error) {
+	id, err := fk.referencedID(value)
+	if id == nil || err != nil {
+		return nil, err
+	}
+	target, err := c.db.catalog.Get(fk.Collection)
+	if err != nil {
+		return nil, err
+	}
+	key, err := target.key(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
+		return nil, fmt.Errorf("%w: %s %s of %s", ErrReferenceNotFound, fk.Collection, id.String(), fk.Field)
+	} else if err != nil {
+		return nil, err
+	}
+	return EncodeKey(referenceKeyPrefix(fk.Collection), id)
+}
+
+// checkReferences checks the foreign keys of doc whose value changed and
+// returns the markers of the documents it references
+func (c *Collection) checkReferences(txn *badger.Txn, old, doc *Document) ([][]byte, error) {
+	c.mu.RLock()
+	fks := c.info.ForeignKeys
+	c.mu.RUnlock()
+	var markers [][]byte
+	for _, fk := range fks {
+		value := doc.kv[fk.Field]
+		if old != nil && value != nil && old.kv[fk.Field] != nil && types.Equal(value, old.kv[fk.Field]) {
+			continue
+		}
+		marker, err := c.checkReference(txn, fk, value)
+		if err != nil {
+			return nil, err
+		}
+		if marker != nil {
+			markers = append(markers, marker)
+		}
+	}
+	return markers, nil
+}
+
+// onDelete applies the foreign keys of every collection that references
+// this one to the documents that reference old
+func (c *Collection) onDelete(txn *badger.Txn, old *Document) error {
+	marked := false
+	for _, name := range c.db.catalog.Names() {
+		coll, err := c.db.catalog.Get(name)
+		if err != nil {
+			continue
+		}
+		for _, fk := range coll.ForeignKeys() {
+			if fk.Collection != c.name {
+				continue
+			}
+			if !marked {
+				if err := c.unmark(txn, old.ID()); err != nil {
+					return err
+				}
+				marked = true
+			}
+			ids, err := coll.referencing(txn, fk.Field, types.Reference{Collection: c.name, ID: old.ID()}, old.ID())
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				if err := coll.applyOnDelete(txn, fk, id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// unmark reads the marker of the document id so a reference written
+// meanwhile conflicts with the delete, and deletes it
+func (c *Collection) unmark(txn *badger.Txn, id types.Object) error {
+	marker, err := EncodeKey(referenceKeyPrefix(c.name), id)
+	if err != nil {
+		return err
+	}
+	if _, err := txn.Get(marker); err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return txn.Delete(marker)
+}
+
+// referencing returns the ids of the documents whose field holds one of
+// the values
+func (c *Collection) referencing(txn *badger.Txn, field string, values ...types.Object) ([]types.Object, error) {
+	ids := make([]types.Object, 0)
+	for _, value := range values {
+		it, err := c.ScanTxn(txn, ScanOptions{Index: foreignKeyIndex(field), Prefix: []types.Object{value}, KeysOnly: true})
+		if err != nil {
+			return nil, err
+		}
+		for it.Next() {
+			ids = append(ids, it.Entry().ID)
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+func (c *Collection) applyOnDelete(txn *badger.Txn, fk ForeignKey, id types.Object) error {
+	switch fk.OnDelete {
+	case Cascade:
+		// a cycle of cascades reaches documents that are already deleted
+		if err := c.DelTxn(txn, id); err != nil && err != ErrDocumentNotFound {
+			return err
+		}
+		return nil
+	case SetNull:
+		doc, err := c.GetTxn(txn, id)
+		if err == ErrDocumentNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		doc.kv[fk.Field] = types.Null{}
+		return c.SetTxn(txn, doc)
+	}
+	return fmt.Errorf("%w: %s %s (%s)", ErrReferenced, c.name, id.String(), fk.Field)
+}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrInvalidName      = errors.New("invalid name")
+	ErrDatabaseNotFound = errors.New("database not found")
+	ErrDatabaseExists   = errors.New("database already exists")
+	ErrRegistryLocked   = errors.New("data directory is in use by another process")
+	ErrRegistryClosed   = errors.New("registry closed")
+)
+
+// name of the lock file kept in the data directory
+const lockFileName = "LOCK"
+
+// Registry manages the named databases stored under one data directory.
+// databases are opened the first time they are used and stay open until
+// the registry is closed. only one process can own a data directory at a time.
+type Registry struct {
+	path string
+	opts Options
+
+	mu     sync.Mutex
+	dbs    map[string]*Database
+	lock   *os.File
+	closed bool
+}
+
+// NewRegistry creates the data directory if needed and takes ownership of it
+func NewRegistry(path string) (*Registry, error) {
+	return NewRegistryWithOptions(path, DefaultOptions())
+}
+
+// NewRegistryWithOptions is NewRegistry with the options used to open
+// every database
+func NewRegistryWithOptions(path string, opts Options) (*Registry, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(path, lockFileName), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Registry{
+		path: path,
+		opts: opts,
+		dbs:  make(map[string]*Database),
+		lock: f,
+	}, nil
+}
+
+func (r *Registry) Path() string {
+	return r.path
+}
+
+// ValidName reports if name can be used for a database or a collection
+func ValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && c != '_' && !(i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Names returns the names of all the databases in the data directory
+func (r *Registry) Names() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	entries, err := os.ReadDir(r.path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() && ValidName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (r *Registry) Exists(name string) bool {
+	if !ValidName(name) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(r.path, name))
+	return err == nil && info.IsDir()
+}
+
+// Get returns an existing database, opening it if needed
+func (r *Registry) Get(name string) (*Database, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if db, ok := r.dbs[name]; ok {
+		return db, nil
+	}
+	if !r.Exists(name) {
+		return nil, ErrDatabaseNotFound
+	}
+	return r.open(name)
+}
+
+// Create creates a new database and opens it
+func (r *Registry) Create(name string) (*Database, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	if r.Exists(name) {
+		return nil, ErrDatabaseExists
+	}
+	return r.open(name)
+}
+
+// must be called with the lock held
+func (r *Registry) open(name string) (*Database, error) {
+	db, err := NewDatabaseWithOptions(name, r.path, r.opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	r.dbs[name] = db
+	return db, nil
+}
+
+// Drop closes a database and deletes all its files
+func (r *Registry) Drop(name string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	if !r.Exists(name) {
+		return ErrDatabaseNotFound
+	}
+	if db, ok := r.dbs[name]; ok {
+		if err := db.Close(); err != nil {
+			return err
+		}
+		delete(r.dbs, name)
+	}
+	return os.RemoveAll(filepath.Join(r.path, name))
+}
+
+// Close closes every open database and releases the data directory
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	var firstErr error
+	for name, db := range r.dbs {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(r.dbs, name)
+	}
+	if err := unlockFile(r.lock); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := r.lock.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
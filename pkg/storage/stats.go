@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+// the number of buckets of the histograms Analyze builds
+const histogramBuckets = 32
+
+// Stats describes a collection as it was when it was last analyzed, see
+// Collection.Analyze. writes don't change it so it gets out of date, it
+// is only used to guess how many documents a scan reads
+type Stats struct {
+	// when the collection was analyzed and the version it was read at
+	Analyzed  time.Time `json:"analyzed"`
+	Version   uint64    `json:"version"`
+	Documents int64     `json:"documents"`
+	// bytes of the stored documents
+	Size int64 `json:"size"`
+	// the ids, and the entries of the indexes by name
+	Primary *IndexStats            `json:"primary"`
+	Indexes map[string]*IndexStats `json:"indexes,omitempty"`
+	// the top level fields of the documents by name, encrypted fields
+	// are left out
+	Fields map[string]*FieldStats `json:"fields,omitempty"`
+}
+
+// FieldStats describes the values of a top level field
+type FieldStats struct {
+	// documents that have the field
+	Count int64 `json:"count"`
+	// how many of the values have each type, by types.XType
+	Types map[byte]int64 `json:"types"`
+}
+
+// IndexStats describes the keys of the primary key or of an index
+type IndexStats struct {
+	Entries int64 `json:"entries"`
+	// Distinct[i] is the number of distinct values of the first i+1 fields
+	Distinct []int64 `json:"distinct"`
+	// the values of the first field in ranges of about as many entries
+	Histogram []Bucket `json:"histogram,omitempty"`
+}
+
+// Bucket is a range of values of the first field, from after the upper
+// bound of the previous bucket to Upper
+type Bucket struct {
+	// key encoding of the largest value in the bucket
+	Upper    []byte `json:"upper"`
+	Count    int64  `json:"count"`
+	Distinct int64  `json:"distinct"`
+}
+
+// Stats returns the statistics of the last Analyze, nil if the collection
+// was never analyzed. it must not be changed
+func (c *Collection) Stats() *Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.info.Stats
+}
+
+// Analyze reads the ids and the index entries of the collection to count
+// the documents and the distinct values of the indexes, and stores the
+// result in the catalog
+func (c *Collection) Analyze() (*Stats, error) {
+	stats := &Stats{Analyzed: time.Now(), Indexes: make(map[string]*IndexStats)}
+	indexes := c.Indexes()
+	err := c.db.View(func(txn *badger.Txn) error {
+		stats.Version = txn.ReadTs()
+		var err error
+		if stats.Primary, err = analyzeKeys(txn, documentKeyPrefix(c.name), 1, &stats.Size); err != nil {
+			return err
+		}
+		stats.Documents = stats.Primary.Entries
+		if stats.Fields, err = c.analyzeFields(txn); err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			if stats.Indexes[index.Name], err = analyzeKeys(txn, indexKeyPrefix(c.name, index.Name), len(index.Fields), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := c.copyInfo()
+	// an index can be dropped while the others are read
+	for name := range stats.Indexes {
+		if findIndex(info.Indexes, name) == nil {
+			delete(stats.Indexes, name)
+		}
+	}
+	info.Stats = stats
+	err = c.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.info = info
+	return stats, nil
+}
+
+func findIndex(indexes []*IndexInfo, name string) *IndexInfo {
+	for _, index := range indexes {
+		if index.Name == name {
+			return index
+		}
+	}
+	return nil
+}
+
+// withoutIndex returns the statistics without those of an index
+func (s *Stats) withoutIndex(name string) *Stats {
+	if s == nil || s.Indexes[name] == nil {
+		return s
+	}
+	copied := *s
+	copied.Indexes = make(map[string]*IndexStats, len(s.Indexes))
+	for other, stats := range s.Indexes {
+		if other != name {
+			copied.Indexes[other] = stats
+		}
+	}
+	return &copied
+}
+
+// analyzeKeys reads the keys under prefix, made of fields values and the
+// id for an index. size gets the size of the values if it is not nil
+func analyzeKeys(txn *badger.Txn, prefix []byte, fields int, size *int64) (*IndexStats, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	// the first pass counts the entries for the size of the buckets
+	stats := &IndexStats{Distinct: make([]int64, fields)}
+	for it.Rewind(); it.Valid(); it.Next() {
+		stats.Entries++
+		if size != nil {
+			*size += it.Item().ValueSize()
+		}
+	}
+	depth := (stats.Entries + histogramBuckets - 1) / histogramBuckets
+	var prev [][]byte
+	var bucket Bucket
+	for it.Rewind(); it.Valid(); it.Next() {
+		values, err := splitKey(it.Item().KeyCopy(nil)[len(prefix):], fields)
+		if err != nil {
+			return nil, err
+		}
+		// a new value of the first fields changes all the longer prefixes
+		for i := range values {
+			if prev == nil || !bytes.Equal(values[i], prev[i]) {
+				for j := i; j < fields; j++ {
+					stats.Distinct[j]++
+				}
+				break
+			}
+		}
+		if prev != nil && !bytes.Equal(values[0], prev[0]) && bucket.Count >= depth {
+			stats.Histogram = append(stats.Histogram, bucket)
+			bucket = Bucket{}
+		}
+		if bucket.Count == 0 || !bytes.Equal(values[0], bucket.Upper) {
+			bucket.Distinct++
+		}
+		bucket.Upper = values[0]
+		bucket.Count++
+		prev = values
+	}
+	if bucket.Count > 0 {
+		stats.Histogram = append(stats.Histogram, bucket)
+	}
+	return stats, nil
+}
+
+// analyzeFields reads the documents to count the types of the values of
+// their fields
+func (c *Collection) analyzeFields(txn *badger.Txn) (map[string]*FieldStats, error) {
+	encrypted := make(map[string]bool)
+	for _, field := range c.encryptedFields() {
+		encrypted[field.Field] = true
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = documentKeyPrefix(c.name)
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	fields := make(map[string]*FieldStats)
+	for it.Rewind(); it.Valid(); it.Next() {
+		doc := NewDocument(c.db, c, nil)
+		err := it.Item().Value(func(val []byte) error {
+			return decodeStored(doc, val)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range doc.kv {
+			if encrypted[name] {
+				continue
+			}
+			field := fields[name]
+			if field == nil {
+				field = &FieldStats{Types: make(map[byte]int64)}
+				fields[name] = field
+			}
+			field.Count++
+			field.Types[value.Type()]++
+		}
+	}
+	return fields, nil
+}
+
+// splitKey returns the encodings of the first n values of a key, each one
+// with the ones before it
+func splitKey(key []byte, n int) ([][]byte, error) {
+	values := make([][]byte, n)
+	end := 0
+	for i := range values {
+		_, size, err := DecodeKey(key[end:])
+		if err != nil {
+			return nil, err
+		}
+		end += size
+		values[i] = key[:end]
+	}
+	return values, nil
+}
+
+// EstimateEqual guesses how many entries have the same values for the
+// first n fields
+func (s *IndexStats) EstimateEqual(n int) float64 {
+	n = min(n, len(s.Distinct))
+	if n < 1 || s.Distinct[n-1] == 0 {
+		return 0
+	}
+	return float64(s.Entries) / float64(s.Distinct[n-1])
+}
+
+// EstimateValue guesses how many entries have value for the first field,
+// the values of its bucket are taken to be as frequent as each other
+func (s *IndexStats) EstimateValue(value types.Object) float64 {
+	key, err := EncodeKey(nil, value)
+	if err != nil {
+		return s.EstimateEqual(1)
+	}
+	for _, b := range s.Histogram {
+		if bytes.Compare(key, b.Upper) > 0 {
+			continue
+		}
+		if b.Distinct == 1 && !bytes.Equal(key, b.Upper) {
+			return 0
+		}
+		return float64(b.Count) / float64(b.Distinct)
+	}
+	return 0
+}
+
+// EstimateRange guesses how many entries have a first field from start
+// included to end excluded, nil for no bound. half of a bucket that is
+// partly in the range is counted
+func (s *IndexStats) EstimateRange(start, end types.Object) float64 {
+	var lo, hi []byte
+	var err error
+	if start != nil {
+		if lo, err = EncodeKey(nil, start); err != nil {
+			return float64(s.Entries)
+		}
+	}
+	if end != nil {
+		if hi, err = EncodeKey(nil, end); err != nil {
+			return float64(s.Entries)
+		}
+	}
+	in := func(key []byte) bool {
+		return (lo == nil || bytes.Compare(key, lo) >= 0) && (hi == nil || bytes.Compare(key, hi) < 0)
+	}
+	est := 0.0
+	// the bucket holds the values after lower up to its upper bound
+	var lower []byte
+	for _, b := range s.Histogram {
+		switch {
+		case hi != nil && lower != nil && bytes.Compare(lower, hi) >= 0:
+			return est
+		case lo != nil && bytes.Compare(b.Upper, lo) < 0:
+		case b.Distinct == 1:
+			if in(b.Upper) {
+				est += float64(b.Count)
+			}
+		case lower != nil && in(lower) && in(b.Upper), lower == nil && lo == nil && in(b.Upper):
+			est += float64(b.Count)
+		default:
+			est += float64(b.Count) / 2
+		}
+		lower = b.Upper
+	}
+	return est
+}
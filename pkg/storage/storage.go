@@ -1,46 +1,199 @@
 package storage
 
 import (
+	"fmt"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 )
 
+// Options configure how a database is opened
+type Options struct {
+	// how long old versions of the documents stay readable with ViewAt,
+	// 0 keeps only what running transactions need. at most MaxRetention,
+	// every version written during the window is kept on disk and badger
+	// keeps track of them in memory
+	Retention time.Duration
+	// directory of the change logs, each database logs its commits in a
+	// subdirectory named after it. empty to not keep change logs
+	ChangeLogDir string
+	// master key to encrypt the database files with, 16, 24 or 32 bytes
+	// for AES-128, 192 or 256. a database is encrypted from its creation
+	// and always needs the key after. backups and change logs are written
+	// in the clear
+	EncryptionKey []byte
+	// key the encrypted fields of the collections are encrypted with, 16,
+	// 24 or 32 bytes. without it encrypted fields read as their ciphertext
+	// and documents with clear values for them can't be written
+	FieldKey []byte
+	// how often expired documents are swept, 0 for every minute
+	SweepInterval time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{}
+}
+
 type Database struct {
 	name string
 	path string
+	opts Options
 
 	// badger db
 	db *badger.DB
 
+	catalog   *Catalog
+	retention *retention
+	changelog *changeLog
+	sweeper   *sweeper
+	expiries  expiries
+
+	// held shared by transactions, scans and bulk loads and alone by
+	// Restore and Replay, see exclusive
+	gate sync.RWMutex
+
 	closed bool
 }
 
 func NewDatabase(name, path string) (*Database, error) {
+	return NewDatabaseWithOptions(name, path, DefaultOptions())
+}
+
+func NewDatabaseWithOptions(name, path string, opts Options) (*Database, error) {
 	return &Database{
 		name: name,
 		path: path,
+		opts: opts,
 	}, nil
 }
 
 func (d *Database) Open() error {
-	if d.closed {
+	if d.db != nil && !d.closed {
 		return nil
 	}
-	db, err := badger.Open(badger.DefaultOptions(d.path + "/" + d.name))
+	newKey, err := checkEncryptionKey(d.Dir(), d.opts.EncryptionKey)
 	if err != nil {
-		return err
+		return fmt.Errorf("open %s: %w", d.name, err)
+	}
+	if d.opts.Retention > MaxRetention {
+		return fmt.Errorf("open %s: %w", d.name, ErrRetentionTooLong)
+	}
+	if len(d.opts.FieldKey) > 0 && !validKeySize(d.opts.FieldKey) {
+		return fmt.Errorf("open %s: field key: %w", d.name, ErrInvalidEncryptionKey)
+	}
+	opts := badger.DefaultOptions(d.Dir())
+	if len(d.opts.EncryptionKey) > 0 {
+		// badger advises a cache of the table indexes once they are encrypted
+		opts = opts.WithEncryptionKey(d.opts.EncryptionKey).WithIndexCacheSize(100 << 20)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", d.name, openError(err))
+	}
+	if newKey {
+		if err := writeKeyCheck(d.Dir(), keyCheckFile, d.opts.EncryptionKey); err != nil {
+			db.Close()
+			return err
+		}
 	}
 	d.db = db
+	d.closed = false
+	d.catalog = NewCatalog(d)
+	if err := d.catalog.Init(); err != nil {
+		d.db.Close()
+		d.closed = true
+		return err
+	}
+	if err := d.startWorkers(); err != nil {
+		d.db.Close()
+		d.closed = true
+		return err
+	}
+	return nil
+}
+
+// startWorkers starts the change log, the retention and the sweeper
+func (d *Database) startWorkers() error {
+	if d.opts.ChangeLogDir != "" {
+		var err error
+		if d.changelog, err = openChangeLog(d, filepath.Join(d.opts.ChangeLogDir, d.name)); err != nil {
+			return err
+		}
+	}
+	if d.opts.Retention > 0 {
+		d.retention = newRetention(d, d.opts.Retention)
+	}
+	d.sweeper = newSweeper(d, d.opts.SweepInterval)
 	return nil
 }
 
+// stopWorkers stops what startWorkers started, the error is the one of
+// closing the change log
+func (d *Database) stopWorkers() error {
+	if d.sweeper != nil {
+		d.sweeper.stop()
+		d.sweeper = nil
+	}
+	if d.retention != nil {
+		d.retention.stop()
+		d.retention = nil
+	}
+	var err error
+	if d.changelog != nil {
+		err = d.changelog.close()
+		d.changelog = nil
+	}
+	return err
+}
+
+// exclusive runs fn with the workers stopped, once the running
+// transactions, scans and bulk loads are done. the ones that start
+// meanwhile fail with ErrDatabaseBusy
+func (d *Database) exclusive(fn func() error) error {
+	err := d.stopWorkers()
+	if err == nil {
+		d.gate.Lock()
+		err = fn()
+		d.gate.Unlock()
+	}
+	if serr := d.startWorkers(); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// enter lets a transaction, a scan or a bulk load start, it must leave
+// when it is done
+func (d *Database) enter() error {
+	if !d.IsOpen() {
+		return ErrDatabaseClosed
+	}
+	if !d.gate.TryRLock() {
+		return ErrDatabaseBusy
+	}
+	return nil
+}
+
+func (d *Database) leave() {
+	d.gate.RUnlock()
+}
+
 func (d *Database) Close() error {
-	if d.closed {
+	if d.closed || d.db == nil {
 		return nil
 	}
 	d.closed = true
-	return d.db.Close()
+	err := d.stopWorkers()
+	if cerr := d.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (d *Database) Options() Options {
+	return d.opts
 }
 
 func (d *Database) Name() string {
@@ -51,19 +204,65 @@ func (d *Database) Path() string {
 	return d.path
 }
 
-type Catalog struct {
-	db *Database
+// the directory badger stores this database in
+func (d *Database) Dir() string {
+	return filepath.Join(d.path, d.name)
+}
+
+func (d *Database) IsOpen() bool {
+	return d.db != nil && !d.closed
+}
+
+func (d *Database) Catalog() *Catalog {
+	return d.catalog
 }
 
-func NewCatalog(db *Database) *Catalog {
-	return &Catalog{
-		db: db,
+// Collection returns the collection with the given name
+func (d *Database) Collection(name string) (*Collection, error) {
+	if !d.IsOpen() {
+		return nil, ErrDatabaseClosed
 	}
+	return d.catalog.Get(name)
 }
 
-func (c *Catalog) Init() error {
+func (d *Database) CreateCollection(name string) (*Collection, error) {
+	if !d.IsOpen() {
+		return nil, ErrDatabaseClosed
+	}
+	return d.catalog.Create(name)
+}
 
-	return nil
+func (d *Database) DropCollection(name string) error {
+	if !d.IsOpen() {
+		return ErrDatabaseClosed
+	}
+	return d.catalog.Drop(name)
+}
+
+// Collections returns the sorted names of the collections
+func (d *Database) Collections() []string {
+	if !d.IsOpen() {
+		return nil
+	}
+	return d.catalog.Names()
+}
+
+// View runs fn in a read only transaction
+func (d *Database) View(fn func(txn *badger.Txn) error) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	return d.db.View(fn)
+}
+
+// Update runs fn in a read write transaction and commits it if fn succeeds
+func (d *Database) Update(fn func(txn *badger.Txn) error) error {
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+	return d.db.Update(fn)
 }
 
 type Lock struct {
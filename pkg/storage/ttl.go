@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrInvalidExpiry    = errors.New("expires_at must be a unix time in seconds or an RFC3339 string")
+	ErrExpiryReferenced = errors.New("documents referenced by a foreign key can't expire")
+)
+
+// ExpiresAtField is the field a document can set to expire at a given
+// time, a unix time in seconds or an RFC3339 string
+const ExpiresAtField = "expires_at"
+
+// how often the sweeper runs if Options.SweepInterval is not set
+const defaultSweepInterval = time.Minute
+
+// documents that expire are written with badger's TTL, and so are their
+// index entries so they go away together. reads stop seeing them once they
+// expire and badger drops them on compaction. expiring doesn't write
+// anything so it is not a change of the change streams, nor a delete the
+// foreign keys that reference the collection could act on. so collections
+// that are referenced can't have expiring documents
+
+// SetTTL sets how long the documents of the collection live after they
+// are saved, 0 to keep them. documents saved before keep their expiry,
+// the sweeper deletes the ones that are past the new TTL
+func (c *Collection) SetTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		ttl = 0
+	}
+	if ttl > 0 && c.referenced() {
+		return ErrExpiryReferenced
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// expired documents would stay counted in the limits
+	if c.info.Capped != nil {
+		return ErrCappedCollection
+	}
+	info := c.copyInfo()
+	info.TTL = ttl
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err != nil {
+		return err
+	}
+	c.info = info
+	return nil
+}
+
+// TTL returns the default time to live of the documents, 0 if they don't
+// expire
+func (c *Collection) TTL() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.info.TTL
+}
+
+// expiry returns when a document saved at now expires, the earliest of
+// its expires_at and the TTL of the collection. it is zero if it doesn't
+func (c *Collection) expiry(doc *Document, now time.Time) (time.Time, error) {
+	var expires time.Time
+	if value, ok := doc.kv[ExpiresAtField]; ok && value.Type() != types.NullType {
+		if _, capped := c.Capped(); capped {
+			return time.Time{}, ErrCappedCollection
+		}
+		if c.referenced() {
+			return time.Time{}, ErrExpiryReferenced
+		}
+		switch v := value.(type) {
+		case types.Int64, types.Int32:
+			seconds, _ := types.ToInt64(v)
+			expires = time.Unix(seconds, 0)
+		case types.String:
+			t, err := time.Parse(time.RFC3339, string(v))
+			if err != nil {
+				return time.Time{}, ErrInvalidExpiry
+			}
+			expires = t
+		default:
+			return time.Time{}, ErrInvalidExpiry
+		}
+	}
+	if ttl := c.TTL(); ttl > 0 {
+		if byTTL := now.Add(ttl); expires.IsZero() || byTTL.Before(expires) {
+			expires = byTTL
+		}
+	}
+	return expires, nil
+}
+
+// referenced reports if a foreign key references the collection
+func (c *Collection) referenced() bool {
+	for _, name := range c.db.catalog.Names() {
+		coll, err := c.db.catalog.Get(name)
+		if err != nil {
+			continue
+		}
+		for _, fk := range coll.ForeignKeys() {
+			if fk.Collection == c.name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expiring reports if documents of the collection expire, by its TTL or
+// their own expiry
+func (c *Collection) expiring() (bool, error) {
+	if c.TTL() > 0 {
+		return true, nil
+	}
+	expiring := false
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = documentKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid() && !expiring; it.Next() {
+			expiring = it.Item().ExpiresAt() > 0
+		}
+		return nil
+	})
+	return expiring, err
+}
+
+// expiresAt is the expiry as badger keeps it, in seconds rounded up so a
+// document never expires early
+func expiresAt(expires time.Time) uint64 {
+	if expires.IsZero() {
+		return 0
+	}
+	seconds := expires.Unix()
+	if expires.After(time.Unix(seconds, 0)) {
+		seconds++
+	}
+	if seconds < 1 {
+		// 0 means no expiry to badger
+		seconds = 1
+	}
+	return uint64(seconds)
+}
+
+func expiresTime(expiresAt uint64) time.Time {
+	if expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(expiresAt), 0)
+}
+
+// newEntry returns the badger entry of key, with the TTL if it expires.
+// it sets the second WithTTL would compute once for the document and its
+// index entries so they expire together
+func newEntry(key, value []byte, expiresAt uint64) *badger.Entry {
+	e := badger.NewEntry(key, value)
+	e.ExpiresAt = expiresAt
+	return e
+}
+
+// the sweeper deletes the documents that are past the TTL of their
+// collection but were saved without it, with their index entries, and
+// gives badger the chance to reclaim the space of expired values
+type sweeper struct {
+	db       *Database
+	interval time.Duration
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSweeper(db *Database, interval time.Duration) *sweeper {
+	if interval <= 0 {
+		interval = defaultSweepInterval
+	}
+	s := &sweeper{
+		db:       db,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *sweeper) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// the most value log files a sweep rewrites, the rest are left for the
+// next sweeps
+const sweepGCRounds = 4
+
+func (s *sweeper) sweep(now time.Time) {
+	deleted := 0
+	for _, name := range s.db.catalog.Names() {
+		coll, err := s.db.catalog.Get(name)
+		if err != nil || coll.TTL() == 0 {
+			continue
+		}
+		// errors are left for the next sweep, writers may race with it
+		n, _ := coll.Sweep(now)
+		deleted += n
+	}
+	// nothing to reclaim if nothing was deleted nor expired
+	if !s.db.expiries.past(now) && deleted == 0 {
+		return
+	}
+	for i := 0; i < sweepGCRounds && s.db.db.RunValueLogGC(0.5) == nil; i++ {
+	}
+}
+
+// expiries keeps the minutes in which the values written since the
+// database was opened expire, the sweeper reclaims space once one of them
+// is past
+type expiries struct {
+	mu      sync.Mutex
+	minutes map[int64]struct{}
+}
+
+func (e *expiries) add(expiresAt uint64) {
+	if expiresAt == 0 {
+		return
+	}
+	minute := (int64(expiresAt) + 59) / 60
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.minutes == nil {
+		e.minutes = make(map[int64]struct{})
+	}
+	e.minutes[minute] = struct{}{}
+}
+
+// past forgets the minutes before now and reports if there were any
+func (e *expiries) past(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	past := false
+	for minute := range e.minutes {
+		if minute*60 <= now.Unix() {
+			delete(e.minutes, minute)
+			past = true
+		}
+	}
+	return past
+}
+
+func (s *sweeper) stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// sweepBatch is how many documents a sweep deletes per transaction
+const sweepBatch = 1000
+
+// Sweep deletes the documents that are past the TTL of the collection
+// and returns how many it deleted. the sweeper calls it in the background
+func (c *Collection) Sweep(now time.Time) (int, error) {
+	ttl := c.TTL()
+	if ttl == 0 {
+		return 0, nil
+	}
+	expired := make([]types.Object, 0)
+	err := c.db.View(func(txn *badger.Txn) error {
+		it, err := c.ScanTxn(txn, ScanOptions{})
+		if err != nil {
+			return err
+		}
+		defer it.Close()
+		for it.Next() {
+			doc := it.Document()
+			if !doc.meta.Updated.IsZero() && !doc.meta.Updated.Add(ttl).After(now) {
+				expired = append(expired, doc.ID())
+			}
+		}
+		return it.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for len(expired) > 0 {
+		n := min(len(expired), sweepBatch)
+		count := 0
+		err := c.db.Update(func(txn *badger.Txn) error {
+			for _, id := range expired[:n] {
+				// the document may have been saved again since the scan
+				key, err := c.key(id)
+				if err != nil {
+					return err
+				}
+				doc, err := c.load(txn, key)
+				if err != nil {
+					return err
+				}
+				if doc == nil || doc.meta.Updated.Add(ttl).After(now) {
+					continue
+				}
+				if err := c.DelTxn(txn, id); err != nil {
+					return err
+				}
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += count
+		expired = expired[n:]
+	}
+	return deleted, nil
+}
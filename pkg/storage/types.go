@@ -20,6 +20,14 @@ type Document struct {
 	coll *Collection
 	tnx  *badger.Txn
 	key  []byte
+	// system metadata, zero if the document wasn't loaded nor saved
+	meta Meta
+	// length of the stored value, capped collections count it
+	size int
+
+	// the encrypted values it was read with by a reader without the field
+	// key, they are stored back as they were
+	sealed map[string]types.Binary
 
 	modified bool
 	static   bool // if true we can't modify this document
@@ -57,11 +65,21 @@ func (d *Document) Del(key []byte) error {
 		return ErrStaticDocument
 	}
 	// delete a key
+	if string(key) == "id" && d.kv["id"] != nil {
+		d.changeID()
+	}
 	delete(d.kv, string(key))
 	d.modified = true
 	return nil
 }
 
+// changeID forgets what was loaded with the previous id, a document with
+// a new id is saved as an insert
+func (d *Document) changeID() {
+	d.key = nil
+	d.meta = Meta{}
+}
+
 func (d *Document) Get(key []byte) (types.Object, error) {
 	// get a value
 	return d.kv[string(key)], nil
@@ -71,6 +89,9 @@ func (d *Document) Set(key []byte, value types.Object) error {
 	if d.static {
 		return ErrStaticDocument
 	}
+	if string(key) == "id" && (d.kv["id"] == nil || value == nil || !types.Equal(d.kv["id"], value)) {
+		d.changeID()
+	}
 	// set a value
 	d.kv[string(key)] = value
 	d.modified = true
@@ -113,7 +134,7 @@ func (d *Document) UnmarshalObject(b []byte) (int, error) {
 	}
 	count := 1
 	for {
-		if len(b) < 1 {
+		if count >= len(b) {
 			return 0, types.ErrInvalidLength
 		}
 		if b[count] == types.EOFType {
@@ -140,7 +161,8 @@ func (d *Document) UnmarshalObject(b []byte) (int, error) {
 	if _, ok := d.kv["id"]; !ok {
 		return 0, types.ErrInvalidDocument
 	}
-	return count, nil
+	// count the EOF
+	return count + 1, nil
 }
 
 func (d *Document) Project(b []byte, keys ...[]byte) (int, error) {
@@ -164,7 +186,7 @@ func (d *Document) Project(b []byte, keys ...[]byte) (int, error) {
 	}
 	count := 1
 	for {
-		if len(b) < 1 {
+		if count >= len(b) {
 			return 0, types.ErrInvalidLength
 		}
 		if b[count] == types.EOFType {
@@ -195,80 +217,37 @@ func (d *Document) Project(b []byte, keys ...[]byte) (int, error) {
 			count += countValue
 		}
 	}
-	return count, nil
+	// count the EOF
+	return count + 1, nil
 }
 
-// used to generate a key that we use in badger for a document
+// used to generate a key that we use in badger for a document,
+// returns nil if the document has no collection or no valid id
 func (d *Document) GetDBKey() []byte {
-	if d.key == nil {
-		d.key = []byte("document") //FIXME: implement
+	if d.key == nil && d.coll != nil && d.ID() != nil {
+		key, err := EncodeKey(documentKeyPrefix(d.coll.name), d.ID())
+		if err != nil {
+			return nil
+		}
+		d.key = key
 	}
 	return d.key
 }
 
-// save this to the database (this is not thread safe)
-// func (d *Document) save(tnx *badger.Txn) error {
-// 	// save the document to the database
-// 	// encode the document
-// 	encDoc := types.GenericDocumentUnmarshaler(d)
-// 	// save the document to the database
-// 	err := tnx.Set(d.GetDBKey(), encDoc)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	return nil
-// }
-
-type Collection struct {
-	name string
-	db   *Database
-
-	isSecondary bool
-}
-
-// var _ types.Collection = (*Collection)(nil)
-
-func NewCollection(name string, db *Database) *Collection {
-	// create a new collection
-	return &Collection{
-		name: name,
-		db:   db,
-	}
-}
-
-func (c *Collection) Name() string {
-	// get the name
-	return c.name
-}
-
-func (c *Collection) Get(key []byte) (Document, error) {
-	panic("not implemented")
-}
-
-func (c *Collection) Del(key []byte) error {
-	panic("not implemented")
-}
-
-func (c *Collection) Set(key []byte, value Document) error {
-	panic("not implemented")
-}
-
-func (c *Collection) Type() byte {
-	return types.CollectionType
-}
-
-func (c *Collection) Value() interface{} {
-	return c
-}
-
-func (c *Collection) String() string {
-	return "collection"
+// Collection returns the collection the document belongs to, if any
+func (d *Document) Collection() *Collection {
+	return d.coll
 }
 
-func (c *Collection) Encode() []byte {
-	panic("not implemented")
+// Modified reports if the document was changed since it was loaded or saved
+func (d *Document) Modified() bool {
+	return d.modified
 }
 
-func (c *Collection) Decode([]byte) error {
-	panic("not implemented")
+// Version returns the badger commit version the document was loaded at,
+// 0 for a document that was not loaded from the database. a document
+// saved in a transaction gets its new version the next time it is loaded,
+// except by SetIf, SetIfMatch and Upsert that read it back
+func (d *Document) Version() uint64 {
+	return d.meta.Version
 }
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrUniqueViolation = errors.New("unique constraint violated")
+)
+
+// UniqueViolationError is returned when a write would give two documents
+// the same key in a unique index, errors.Is matches ErrUniqueViolation
+type UniqueViolationError struct {
+	Index string
+	// the values of the index fields, folded for case insensitive indexes
+	Key []types.Object
+	// the document that already has the key
+	ID types.Object
+}
+
+func (e *UniqueViolationError) Error() string {
+	values := make([]string, len(e.Key))
+	for i, value := range e.Key {
+		values[i] = value.String()
+	}
+	return fmt.Sprintf("%s: index %s already has (%s) for id %s", ErrUniqueViolation.Error(), e.Index, strings.Join(values, ", "), e.ID.String())
+}
+
+func (e *UniqueViolationError) Unwrap() error {
+	return ErrUniqueViolation
+}
+
+// IndexOptions are the options of CreateIndexWith
+type IndexOptions struct {
+	// no two documents can have the same values in the index fields,
+	// documents with a null or missing field are not constrained
+	Unique bool
+	// strings and emails are indexed lower cased so they match and are
+	// unique regardless of case
+	CaseInsensitive bool
+}
+
+// entries of a unique index are keyed by the values only, without the id,
+// so the entry itself is what two writers of the same values conflict on:
+// badger tracks the read of the entry even if it is missing and aborts the
+// second commit with badger.ErrConflict. entries with a null value are
+// keyed with the id like in other indexes
+
+// CreateIndexWith adds an index with options over the fields and builds it
+// from the documents already in the collection. if two documents already
+// break a unique index the index is dropped again and the violation
+// returned
+func (c *Collection) CreateIndexWith(name string, opts IndexOptions, fields ...string) error {
+	if !ValidName(name) || len(fields) == 0 {
+		return ErrInvalidName
+	}
+	index := &IndexInfo{Name: name, Fields: fields, Unique: opts.Unique, CaseInsensitive: opts.CaseInsensitive}
+	c.mu.Lock()
+	for _, existing := range c.info.Indexes {
+		if existing.Name == name {
+			c.mu.Unlock()
+			return ErrIndexExists
+		}
+	}
+	for _, field := range fields {
+		if f := findEncrypted(c.info.Encrypted, field); f != nil && !f.Deterministic {
+			c.mu.Unlock()
+			return ErrEncryptedIndex
+		}
+	}
+	info := c.copyInfo()
+	info.Indexes = append(info.Indexes, index)
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return saveCollectionInfo(txn, info)
+	})
+	if err == nil {
+		c.info = info
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// writes from now on maintain the index, build the entries of the
+	// documents that are already stored
+	if !index.Unique {
+		return c.buildIndex(index)
+	}
+	if err := c.buildUniqueIndex(index); err != nil {
+		if derr := c.DropIndex(name); derr != nil {
+			return derr
+		}
+		return err
+	}
+	return nil
+}
+
+// foldCase lower cases the values a case insensitive index compares
+func foldCase(o types.Object) types.Object {
+	switch v := o.(type) {
+	case types.String:
+		return types.String(strings.ToLower(string(v)))
+	case types.Email:
+		return types.Email(strings.ToLower(string(v)))
+	case types.Array:
+		folded := make(types.Array, len(v))
+		for i, value := range v {
+			folded[i] = foldCase(value)
+		}
+		return folded
+	}
+	return o
+}
+
+// checkUnique fails if the unique entry key belongs to another document
+// than the one with the encoded id
+func (c *Collection) checkUnique(txn *badger.Txn, index *IndexInfo, key, id []byte) error {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	existing, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(existing, id) {
+		return nil
+	}
+	return uniqueViolation(c.name, index, key, existing)
+}
+
+func uniqueViolation(coll string, index *IndexInfo, key, id []byte) error {
+	e := &UniqueViolationError{Index: index.Name}
+	e.Key, _, _ = DecodeKeys(key[len(indexKeyPrefix(coll, index.Name)):], len(index.Fields))
+	e.ID, _, _ = DecodeKey(id)
+	return e
+}
+
+// buildUniqueIndex builds the entries of a unique index in transactions so
+// the documents written meanwhile are checked against them
+func (c *Collection) buildUniqueIndex(index *IndexInfo) error {
+	keys := make([][]byte, 0)
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = documentKeyPrefix(c.name)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	encrypted := c.encryptedFields()
+	for len(keys) > 0 {
+		n := min(len(keys), sweepBatch)
+		err := c.db.Update(func(txn *badger.Txn) error {
+			for _, key := range keys[:n] {
+				// the document as it is now, it may have changed since
+				doc, err := c.load(txn, key)
+				if err != nil {
+					return err
+				}
+				if doc == nil {
+					continue
+				}
+				entry, unique, err := c.indexKey(index, encrypted, doc)
+				if err != nil {
+					return err
+				}
+				id := key[len(documentKeyPrefix(c.name)):]
+				if unique {
+					if err := c.checkUnique(txn, index, entry, id); err != nil {
+						return err
+					}
+				}
+				if err := txn.SetEntry(newEntry(entry, id, expiresAt(doc.meta.Expires))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/noahmern/terara/pkg/types"
+)
+
+var (
+	ErrInvalidUpdate = errors.New("invalid update")
+)
+
+// update operators
+const (
+	UpdateSet = iota
+	UpdateUnset
+	UpdateInc
+	UpdateDec
+	UpdatePush
+	UpdatePull
+	UpdateAddToSet
+	UpdateMerge
+)
+
+var updateNames = map[int]string{
+	UpdateSet:      "set",
+	UpdateUnset:    "unset",
+	UpdateInc:      "inc",
+	UpdateDec:      "dec",
+	UpdatePush:     "push",
+	UpdatePull:     "pull",
+	UpdateAddToSet: "addToSet",
+	UpdateMerge:    "merge",
+}
+
+// UpdateOp changes one field of a document. Field can be a path like
+// "address.city", merge with an empty field merges into the document itself
+type UpdateOp struct {
+	Op    int
+	Field string
+	Value types.Object
+}
+
+func (op UpdateOp) String() string {
+	if op.Value == nil {
+		return updateNames[op.Op] + "(" + op.Field + ")"
+	}
+	return updateNames[op.Op] + "(" + op.Field + ", " + op.Value.String() + ")"
+}
+
+func (op UpdateOp) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidUpdate, op.String(), fmt.Sprintf(format, args...))
+}
+
+// Apply applies the operator to a document in memory
+func (op UpdateOp) Apply(doc types.Document) error {
+	if op.Field == "id" || strings.HasPrefix(op.Field, "id.") {
+		return op.errorf("the id can't be updated")
+	}
+	current, err := types.GetPath(doc, op.Field)
+	if err != nil {
+		return err
+	}
+	var value types.Object
+	switch op.Op {
+	case UpdateSet:
+		value = op.Value
+	case UpdateUnset:
+		return types.DelPath(doc, op.Field)
+	case UpdateInc, UpdateDec:
+		if !types.IsNumeric(op.Value.Type()) {
+			return op.errorf("the amount is not a number")
+		}
+		if current == nil {
+			current = types.Int64(0)
+		}
+		if !types.IsNumeric(current.Type()) {
+			return op.errorf("the field is not a number")
+		}
+		value = addNumbers(current, op.Value, op.Op == UpdateDec)
+	case UpdatePush, UpdatePull, UpdateAddToSet:
+		arr := types.Array{}
+		if current != nil {
+			existing, ok := current.(types.Array)
+			if !ok {
+				return op.errorf("the field is not an array")
+			}
+			arr = append(arr, existing...)
+		}
+		switch op.Op {
+		case UpdatePush:
+			arr = append(arr, op.Value)
+		case UpdateAddToSet:
+			if !contains(arr, op.Value) {
+				arr = append(arr, op.Value)
+			}
+		case UpdatePull:
+			kept := types.Array{}
+			for _, element := range arr {
+				if !types.Equal(element, op.Value) {
+					kept = append(kept, element)
+				}
+			}
+			arr = kept
+		}
+		value = arr
+	case UpdateMerge:
+		src, ok := op.Value.(types.Document)
+		if !ok {
+			return op.errorf("only documents can be merged")
+		}
+		if op.Field == "" {
+			if id, _ := src.Get([]byte("id")); id != nil && !types.Equal(id, doc.ID()) {
+				return op.errorf("the id can't be updated")
+			}
+			return Merge(doc, src)
+		}
+		dst := types.Map{}
+		if current != nil {
+			existing, ok := current.(types.Document)
+			if !ok {
+				return op.errorf("the field is not a document")
+			}
+			if err := Merge(dst, existing); err != nil {
+				return err
+			}
+		}
+		if err := Merge(dst, src); err != nil {
+			return err
+		}
+		value = dst
+	default:
+		return op.errorf("unknown operator")
+	}
+	if err := types.SetPath(doc, op.Field, value); err != nil {
+		return op.errorf("%s", err.Error())
+	}
+	return nil
+}
+
+func addNumbers(a, b types.Object, subtract bool) types.Object {
+	ai, aok := types.ToInt64(a)
+	bi, bok := types.ToInt64(b)
+	if aok && bok {
+		if subtract {
+			return types.Int64(ai - bi)
+		}
+		return types.Int64(ai + bi)
+	}
+	af, _ := types.ToFloat(a)
+	bf, _ := types.ToFloat(b)
+	if subtract {
+		return types.Float(af - bf)
+	}
+	return types.Float(af + bf)
+}
+
+func contains(arr types.Array, value types.Object) bool {
+	for _, element := range arr {
+		if types.Equal(element, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Merge deep merges src into dst: documents present on both sides are
+// merged recursively, any other value of src replaces the one of dst
+func Merge(dst, src types.Document) error {
+	for _, key := range src.Keys() {
+		value, err := src.Get(key)
+		if err != nil {
+			return err
+		}
+		if srcDoc, ok := value.(types.Document); ok {
+			current, err := dst.Get(key)
+			if err != nil {
+				return err
+			}
+			merged := types.Map{}
+			if dstDoc, ok := current.(types.Document); ok {
+				if err := Merge(merged, dstDoc); err != nil {
+					return err
+				}
+			}
+			if err := Merge(merged, srcDoc); err != nil {
+				return err
+			}
+			value = merged
+		}
+		if err := dst.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyUpdate applies the operators in order, the document is left
+// unchanged if any of them fails
+func ApplyUpdate(doc *Document, ops ...UpdateOp) error {
+	if doc.static {
+		return ErrStaticDocument
+	}
+	copied := NewDocument(doc.db, doc.coll, doc.tnx)
+	if err := Merge(copied, doc); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := op.Apply(copied); err != nil {
+			return err
+		}
+	}
+	doc.kv = copied.kv
+	doc.modified = true
+	return nil
+}
+
+// Update applies the operators to the stored document in a transaction
+// and returns the updated document
+func (c *Collection) Update(id types.Object, ops ...UpdateOp) (*Document, error) {
+	var doc *Document
+	err := c.db.Update(func(txn *badger.Txn) error {
+		var err error
+		doc, err = c.UpdateTxn(txn, id, ops...)
+		return err
+	})
+	return doc, err
+}
+
+// UpdateTxn reads, changes and writes back a document inside a transaction,
+// badger fails the commit if the document was changed concurrently
+func (c *Collection) UpdateTxn(txn *badger.Txn, id types.Object, ops ...UpdateOp) (*Document, error) {
+	doc, err := c.GetTxn(txn, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplyUpdate(doc, ops...); err != nil {
+		return nil, err
+	}
+	if err := c.SetTxn(txn, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
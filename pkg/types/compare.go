@@ -0,0 +1,127 @@
+package types
+
+import (
+	"bytes"
+	"strings"
+)
+
+func IsNumeric(t byte) bool {
+	return t == Int64Type || t == Int32Type || t == FloatType
+}
+
+func IsInteger(t byte) bool {
+	return t == Int64Type || t == Int32Type
+}
+
+// ToInt64 returns the value of an integer object
+func ToInt64(o Object) (int64, bool) {
+	switch v := o.(type) {
+	case Int64:
+		return int64(v), true
+	case Int32:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// ToFloat returns the value of any numeric object as a float64
+func ToFloat(o Object) (float64, bool) {
+	switch v := o.(type) {
+	case Int64:
+		return float64(v), true
+	case Int32:
+		return float64(v), true
+	case Float:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Comparable reports if a and b can be ordered against each other,
+// numbers compare with numbers, strings with strings and chars, and so on
+func Comparable(a, b Object) bool {
+	return rank(a.Type()) == rank(b.Type())
+}
+
+// rank groups types that compare with each other and orders the groups
+func rank(t byte) int {
+	switch t {
+	case NullType:
+		return 0
+	case BoolType:
+		return 1
+	case Int64Type, Int32Type, FloatType:
+		return 2
+	case StringType, CharType, EmailType, PhoneType:
+		return 3
+	case ArrayType:
+		return 4
+	case DocumentType:
+		return 5
+	}
+	return 6 + int(t)
+}
+
+// Compare returns -1, 0 or 1. it defines a total order over all objects,
+// objects of types that aren't comparable are ordered by their type
+func Compare(a, b Object) int {
+	ra, rb := rank(a.Type()), rank(b.Type())
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch ra {
+	case 0:
+		return 0
+	case 1:
+		return compareInts(int64(boolToByte(bool(a.(Bool)))), int64(boolToByte(bool(b.(Bool)))))
+	case 2:
+		if ia, ok := ToInt64(a); ok {
+			if ib, ok := ToInt64(b); ok {
+				return compareInts(ia, ib)
+			}
+		}
+		fa, _ := ToFloat(a)
+		fb, _ := ToFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case 3:
+		return bytes.Compare([]byte(a.String()), []byte(b.String()))
+	case 4:
+		aa, ba := a.(Array), b.(Array)
+		for i := 0; i < len(aa) && i < len(ba); i++ {
+			if c := Compare(aa[i], ba[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(int64(len(aa)), int64(len(ba)))
+	}
+	if ra, ok := a.(Reference); ok {
+		rb := b.(Reference)
+		if c := strings.Compare(ra.Collection, rb.Collection); c != 0 {
+			return c
+		}
+		return Compare(ra.ID, rb.ID)
+	}
+	return bytes.Compare([]byte(a.String()), []byte(b.String()))
+}
+
+// Equal reports if two objects hold the same value, numbers of different
+// types are equal if they have the same value
+func Equal(a, b Object) bool {
+	return Comparable(a, b) && Compare(a, b) == 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"errors"
+	"sort"
 )
 
 var (
@@ -21,11 +22,17 @@ type Document interface {
 
 // takes a document and returns a byte slice
 func GenericDocumentUnmarshaler(doc Document) ([]byte, error) {
-	b := make([]byte, 1)
-	b[0] = doc.Type()
 	if doc.ID() == nil {
 		return nil, ErrInvalidDocument
 	}
+	return marshalDocument(doc)
+}
+
+// marshals the fields of a document, documents nested in another one
+// don't need an id
+func marshalDocument(doc Document) ([]byte, error) {
+	b := make([]byte, 1)
+	b[0] = doc.Type()
 	keys := doc.Keys()
 	for _, key := range keys {
 		// make key a Name type
@@ -84,6 +91,9 @@ func (a Array) MarshalObject() ([]byte, error) {
 		}
 		b = append(b, marshaledValue...)
 	}
+	// add EOF at the end
+	marshaledEOF, _ := MarshalObject(EOF{})
+	b = append(b, marshaledEOF...)
 	return b, nil
 }
 
@@ -96,7 +106,7 @@ func (a *Array) UnmarshalObject(b []byte) (int, error) {
 	}
 	count := 1
 	for {
-		if len(b) < 1 {
+		if count >= len(b) {
 			return 0, ErrInvalidLength
 		}
 		if b[count] == EOFType {
@@ -109,7 +119,8 @@ func (a *Array) UnmarshalObject(b []byte) (int, error) {
 		count += n
 		*a = append(*a, value)
 	}
-	return count, nil
+	// count the EOF
+	return count + 1, nil
 }
 
 func UnmarshalArray(b []byte) (Array, int, error) {
@@ -117,3 +128,108 @@ func UnmarshalArray(b []byte) (Array, int, error) {
 	count, err := a.UnmarshalObject(b)
 	return a, count, err
 }
+
+// Map is a document that is not stored on its own, like a document nested
+// in another one. unlike a stored document it doesn't need an id
+type Map map[string]Object
+
+var _ Document = Map(nil)
+
+func (m Map) ID() Object {
+	return m["id"]
+}
+
+func (m Map) Del(key []byte) error {
+	delete(m, string(key))
+	return nil
+}
+
+func (m Map) Get(key []byte) (Object, error) {
+	return m[string(key)], nil
+}
+
+func (m Map) Set(key []byte, value Object) error {
+	m[string(key)] = value
+	return nil
+}
+
+func (m Map) Keys() [][]byte {
+	keys := make([][]byte, 0, len(m))
+	for key := range m {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+func (m Map) Type() byte {
+	return DocumentType
+}
+
+func (m Map) Value() interface{} {
+	return map[string]Object(m)
+}
+
+func (m Map) String() string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	s := "{"
+	for i, key := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += key + ": " + m[key].String()
+	}
+	return s + "}"
+}
+
+func (m Map) MarshalObject() ([]byte, error) {
+	return marshalDocument(m)
+}
+
+func (m *Map) UnmarshalObject(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, ErrInvalidLength
+	}
+	if b[0] != DocumentType {
+		return 0, ErrInvalidType
+	}
+	if *m == nil {
+		*m = make(Map)
+	}
+	count := 1
+	for {
+		if count >= len(b) {
+			return 0, ErrInvalidLength
+		}
+		if b[count] == EOFType {
+			break
+		}
+		var name Name
+		nameCount, err := name.UnmarshalObject(b[count:])
+		if err != nil {
+			return 0, err
+		}
+		count += nameCount
+		value, countValue, err := UnmarshalObject(b[count:])
+		if err != nil {
+			return 0, err
+		}
+		// value can't be internal values like EOF, Last, Name
+		if IsInternal(value.Type()) {
+			return 0, ErrInvalidDocument
+		}
+		count += countValue
+		(*m)[string(name)] = value
+	}
+	// count the EOF
+	return count + 1, nil
+}
+
+func UnmarshalMap(b []byte) (Map, int, error) {
+	var m Map
+	count, err := m.UnmarshalObject(b)
+	return m, count, err
+}
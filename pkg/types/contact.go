@@ -0,0 +1,172 @@
+package types
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var (
+	ErrInvalidEmail = errors.New("invalid email address")
+	ErrInvalidPhone = errors.New("invalid phone number")
+)
+
+// Email is an email address, it is stored like a string with its own type
+// so the schema can tell it apart
+type Email string
+
+func NewEmail(s string) (Email, error) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != strings.TrimSpace(s) {
+		return "", ErrInvalidEmail
+	}
+	return Email(addr.Address), nil
+}
+
+func (e Email) Type() byte {
+	return EmailType
+}
+
+func (e Email) Value() interface{} {
+	return string(e)
+}
+
+func (e Email) String() string {
+	return string(e)
+}
+
+func (e Email) MarshalObject() ([]byte, error) {
+	return marshalCString(e.Type(), string(e)), nil
+}
+
+func (e *Email) UnmarshalObject(b []byte) (int, error) {
+	s, n, err := unmarshalCString(e.Type(), b)
+	*e = Email(s)
+	return n, err
+}
+
+// Phone is a phone number, digits with an optional leading + and the
+// separators people write between them
+type Phone string
+
+func NewPhone(s string) (Phone, error) {
+	s = strings.TrimSpace(s)
+	digits := 0
+	for i, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '+' && i == 0:
+		case r == ' ' || r == '-' || r == '.' || r == '(' || r == ')':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	if digits < 3 || digits > 15 {
+		return "", ErrInvalidPhone
+	}
+	return Phone(s), nil
+}
+
+func (p Phone) Type() byte {
+	return PhoneType
+}
+
+func (p Phone) Value() interface{} {
+	return string(p)
+}
+
+func (p Phone) String() string {
+	return string(p)
+}
+
+func (p Phone) MarshalObject() ([]byte, error) {
+	return marshalCString(p.Type(), string(p)), nil
+}
+
+func (p *Phone) UnmarshalObject(b []byte) (int, error) {
+	s, n, err := unmarshalCString(p.Type(), b)
+	*p = Phone(s)
+	return n, err
+}
+
+// Binary is raw bytes, unlike strings it can hold zeros so it is stored
+// with its length
+type Binary []byte
+
+func (b Binary) Type() byte {
+	return BinaryType
+}
+
+func (b Binary) Value() interface{} {
+	return []byte(b)
+}
+
+// String returns the bytes in hex, it keeps the order of the bytes
+func (b Binary) String() string {
+	return hex.EncodeToString(b)
+}
+
+func (b Binary) MarshalObject() ([]byte, error) {
+	out := binary.AppendUvarint([]byte{b.Type()}, uint64(len(b)))
+	return append(out, b...), nil
+}
+
+func (b *Binary) UnmarshalObject(buf []byte) (int, error) {
+	if len(buf) < 2 {
+		return 0, ErrInvalidLength
+	}
+	if buf[0] != b.Type() {
+		return 0, ErrInvalidType
+	}
+	size, n := binary.Uvarint(buf[1:])
+	if n <= 0 || uint64(len(buf)-1-n) < size {
+		return 0, ErrInvalidLength
+	}
+	start := 1 + n
+	*b = append(Binary{}, buf[start:start+int(size)]...)
+	return start + int(size), nil
+}
+
+func UnmarshalEmail(b []byte) (Email, int, error) {
+	var e Email
+	n, err := e.UnmarshalObject(b)
+	return e, n, err
+}
+
+func UnmarshalPhone(b []byte) (Phone, int, error) {
+	var p Phone
+	n, err := p.UnmarshalObject(b)
+	return p, n, err
+}
+
+func UnmarshalBinary(b []byte) (Binary, int, error) {
+	var bin Binary
+	n, err := bin.UnmarshalObject(b)
+	return bin, n, err
+}
+
+func marshalCString(t byte, s string) []byte {
+	b := make([]byte, len(s)+2)
+	b[0] = t
+	copy(b[1:], s)
+	b[len(b)-1] = NullTerm
+	return b
+}
+
+func unmarshalCString(t byte, b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, ErrInvalidLength
+	}
+	if b[0] != t {
+		return "", 0, ErrInvalidType
+	}
+	for i := 1; i < len(b); i++ {
+		if b[i] == NullTerm {
+			return string(b[1:i]), i + 1, nil
+		}
+	}
+	return "", 0, ErrInvalidLength
+}
@@ -0,0 +1,78 @@
+package types
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotDocument = errors.New("not a document")
+)
+
+// paths like "address.city" name a field inside nested documents
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// GetPath returns the value at path or nil if any part of it is missing
+func GetPath(doc Document, path string) (Object, error) {
+	parts := splitPath(path)
+	for i, part := range parts {
+		value, err := doc.Get([]byte(part))
+		if err != nil || value == nil {
+			return nil, err
+		}
+		if i == len(parts)-1 {
+			return value, nil
+		}
+		next, ok := value.(Document)
+		if !ok {
+			return nil, nil
+		}
+		doc = next
+	}
+	return nil, nil
+}
+
+// SetPath sets the value at path, the missing documents on the way are
+// created. it fails if a part of the path holds something else
+func SetPath(doc Document, path string, value Object) error {
+	parts := splitPath(path)
+	for _, part := range parts[:len(parts)-1] {
+		next, err := doc.Get([]byte(part))
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			m := make(Map)
+			if err := doc.Set([]byte(part), m); err != nil {
+				return err
+			}
+			next = m
+		}
+		nextDoc, ok := next.(Document)
+		if !ok {
+			return ErrNotDocument
+		}
+		doc = nextDoc
+	}
+	return doc.Set([]byte(parts[len(parts)-1]), value)
+}
+
+// DelPath removes the value at path, a missing path is not an error
+func DelPath(doc Document, path string) error {
+	parts := splitPath(path)
+	for _, part := range parts[:len(parts)-1] {
+		next, err := doc.Get([]byte(part))
+		if err != nil {
+			return err
+		}
+		nextDoc, ok := next.(Document)
+		if !ok {
+			return nil
+		}
+		doc = nextDoc
+	}
+	return doc.Del([]byte(parts[len(parts)-1]))
+}
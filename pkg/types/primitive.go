@@ -45,6 +45,10 @@ const (
 	EOFType
 	NameType
 
+	// types added after the internal ones, so the stored values of the
+	// ones above don't change
+	ReferenceType
+
 	// this is the last type
 	LastType
 )
@@ -485,6 +489,16 @@ func UnmarshalObject(b []byte) (Object, int, error) {
 		return UnmarshalName(b)
 	case ArrayType:
 		return UnmarshalArray(b)
+	case DocumentType:
+		return UnmarshalMap(b)
+	case EmailType:
+		return UnmarshalEmail(b)
+	case PhoneType:
+		return UnmarshalPhone(b)
+	case BinaryType:
+		return UnmarshalBinary(b)
+	case ReferenceType:
+		return UnmarshalReference(b)
 	}
 	return nil, 0, ErrInvalidType
 }
@@ -512,6 +526,17 @@ func MarshalObject(o Object) ([]byte, error) {
 		return o.(Name).MarshalObject()
 	case ArrayType:
 		return o.(Array).MarshalObject()
+	case DocumentType:
+		// stored documents and maps are both marshaled by their fields
+		return marshalDocument(o.(Document))
+	case EmailType:
+		return o.(Email).MarshalObject()
+	case PhoneType:
+		return o.(Phone).MarshalObject()
+	case BinaryType:
+		return o.(Binary).MarshalObject()
+	case ReferenceType:
+		return o.(Reference).MarshalObject()
 	}
 	return nil, ErrInvalidType
 }
@@ -0,0 +1,48 @@
+package types
+
+// Reference points to the document with the id ID in another collection
+type Reference struct {
+	Collection string
+	ID         Object
+}
+
+func (r Reference) Type() byte {
+	return ReferenceType
+}
+
+func (r Reference) Value() interface{} {
+	return r
+}
+
+func (r Reference) String() string {
+	return "ref(" + r.Collection + ", " + r.ID.String() + ")"
+}
+
+// a reference is stored as the collection as a c string followed by the id
+func (r Reference) MarshalObject() ([]byte, error) {
+	id, err := MarshalObject(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return append(marshalCString(r.Type(), r.Collection), id...), nil
+}
+
+func (r *Reference) UnmarshalObject(b []byte) (int, error) {
+	coll, n, err := unmarshalCString(r.Type(), b)
+	if err != nil {
+		return 0, err
+	}
+	id, count, err := UnmarshalObject(b[n:])
+	if err != nil {
+		return 0, err
+	}
+	r.Collection = coll
+	r.ID = id
+	return n + count, nil
+}
+
+func UnmarshalReference(b []byte) (Reference, int, error) {
+	var r Reference
+	n, err := r.UnmarshalObject(b)
+	return r, n, err
+}